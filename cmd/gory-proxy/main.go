@@ -2,15 +2,19 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"runtime"
+	"syscall"
+	"time"
 
 	"github.com/johnietre/gory-proxy/server"
 	jtutils "github.com/johnietre/utils/go"
@@ -24,7 +28,7 @@ func main() {
 		Use:                   "gory-proxy",
 		DisableFlagsInUseLine: true,
 	}
-	cmd.AddCommand(makeServerCmd(), makeClientCmd())
+	cmd.AddCommand(makeServerCmd(), makeClientCmd(), makeTunnelCmd())
 	if err := cmd.Execute(); err != nil {
 		log.SetFlags(0)
 		log.SetOutput(os.Stderr)
@@ -52,8 +56,73 @@ func makeServerCmd() *cobra.Command {
 		"Path of the server on the tunneled-to proxy (must have tunnel flag",
 	)
 	flags.Bool("hidden", false, "Whether the tunnel server should be hidden")
+	flags.String(
+		"tunnel-auth",
+		"",
+		"Path to a JSON file with the credentials tunnels must register with "+
+			"(tunnels can register any free path if not set)",
+	)
+	addTunnelFlags(cmd)
+	flags.String(
+		"tunnel-tcp-ports",
+		"",
+		"Ports TCP services registered by tunnels are allowed on, in the form min-max, or \"any\" "+
+			"to allocate random ports, ignoring those requested (TCP services aren't allowed if not set)",
+	)
+	flags.String("tunnel-tcp-host", "", "Host the ports of TCP services registered by tunnels are opened on")
+	flags.String(
+		"tunnel-udp-ports",
+		"",
+		"Ports UDP services registered by tunnels are allowed on, in the form min-max, or \"any\" "+
+			"to allocate random ports, ignoring those requested (UDP services aren't allowed if not set)",
+	)
+	flags.String("tunnel-udp-host", "", "Host the ports of UDP services registered by tunnels are opened on")
+	flags.Duration(
+		"tunnel-udp-idle",
+		time.Minute,
+		"Time a client's flow to a UDP service registered by a tunnel is kept without datagrams",
+	)
+	flags.StringArray(
+		"tunnel-service",
+		nil,
+		"Additional server registered over the tunnel in the form "+
+			"name=name,path=path,(route=local-path|upstream=url)[,hidden] or "+
+			"name=name,path=path,protocol=tcp,target=host:port[,port=port|sni=server-name] or "+
+			"name=name,path=path,protocol=udp,target=host:port[,port=port] "+
+			"(can be passed multiple times)",
+	)
 	flags.String("cert", "", "Path to cert file for TLS")
 	flags.String("key", "", "Path to key file for TLS")
+	flags.StringArray(
+		"listen",
+		nil,
+		"Additional listener in the form [network://]addr[?cert=file&key=file&routes=path1,path2&name=name&noadmin&notunnels] "+
+			"(can be passed multiple times; --addr is only used when passed explicitly if this is passed)",
+	)
+	flags.Bool(
+		"admin-listeners",
+		false,
+		"Allow adding and removing listeners over the admin API (anyone who can reach it could then listen on any address)",
+	)
+	flags.Duration("read-header-timeout", 10*time.Second, "Max time to read request headers (0 = no limit)")
+	flags.Duration(
+		"read-timeout",
+		0,
+		"Max time to read a whole request (0 = no limit; streaming routes opt out)",
+	)
+	flags.Duration(
+		"write-timeout",
+		0,
+		"Max time to write a response (0 = no limit; streaming routes opt out)",
+	)
+	flags.Duration("idle-timeout", 2*time.Minute, "Max time to keep idle keep-alive connections open")
+	flags.Duration(
+		"drain-timeout",
+		30*time.Second,
+		"Max time to wait for in-flight requests to finish on SIGTERM/interrupt",
+	)
+	addLogFlags(cmd)
+	flags.String("client-ca", "", "Path to the CA file used to verify optional client certs")
 	cmd.MarkFlagsRequiredTogether("cert", "key")
 	cmd.MarkFlagsRequiredTogether("name", "path")
 
@@ -61,26 +130,53 @@ func makeServerCmd() *cobra.Command {
 }
 
 func runServer(cmd *cobra.Command, _ []string) {
-	_, thisFile, _, ok := runtime.Caller(0)
-	if !ok {
-		server.Logger.Fatal("error getting log directory")
-	}
-	server.LogFilePath = filepath.Join(filepath.Dir(thisFile), "proxy.log")
-	f, err := os.OpenFile(server.LogFilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-	if err != nil {
-		server.Logger.Fatal(err)
-	}
-	server.Logger.SetOutput(f)
-
 	flags := cmd.Flags()
+	setupLogging(cmd)
+
 	addr := jtutils.Must(flags.GetString("addr"))
-	tunnelAddr := jtutils.Must(flags.GetString("tunnel"))
+	tunnelCfg := tunnelConfigFromFlags(cmd)
+	tunnelCfg.Addr = jtutils.Must(flags.GetString("tunnel"))
+	tunnelAuthPath := jtutils.Must(flags.GetString("tunnel-auth"))
+	var tunnelTCP *server.TunnelTCP
+	if ports := jtutils.Must(flags.GetString("tunnel-tcp-ports")); ports != "" {
+		tunnelTCP = &server.TunnelTCP{Host: jtutils.Must(flags.GetString("tunnel-tcp-host"))}
+		if ports != "any" {
+			var err error
+			tunnelTCP.MinPort, tunnelTCP.MaxPort, err = server.ParsePortRange(ports)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+	var tunnelUDP *server.TunnelUDP
+	if ports := jtutils.Must(flags.GetString("tunnel-udp-ports")); ports != "" {
+		tunnelUDP = &server.TunnelUDP{
+			Host:        jtutils.Must(flags.GetString("tunnel-udp-host")),
+			IdleTimeout: server.Duration(jtutils.Must(flags.GetDuration("tunnel-udp-idle"))),
+		}
+		if ports != "any" {
+			var err error
+			tunnelUDP.MinPort, tunnelUDP.MaxPort, err = server.ParsePortRange(ports)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
 	tunnelSrvr := &server.Server{
 		Name: jtutils.Must(flags.GetString("name")),
 		Path: jtutils.Must(flags.GetString("path")),
 	}
 	certPath := jtutils.Must(flags.GetString("cert"))
 	keyPath := jtutils.Must(flags.GetString("key"))
+	listens := jtutils.Must(flags.GetStringArray("listen"))
+	var tunnelServices []server.TunnelService
+	for _, spec := range jtutils.Must(flags.GetStringArray("tunnel-service")) {
+		ts, err := server.ParseTunnelServiceSpec(spec)
+		if err != nil {
+			log.Fatalf("error parsing tunnel service %q: %v", spec, err)
+		}
+		tunnelServices = append(tunnelServices, ts)
+	}
 
 	if keyPath != "" {
 		if _, err := os.Stat(keyPath); err != nil {
@@ -90,30 +186,347 @@ func runServer(cmd *cobra.Command, _ []string) {
 		}
 	}
 
+	var lnCfgs []server.ListenerConfig
+	if len(listens) == 0 || flags.Changed("addr") {
+		lnCfgs = append(lnCfgs, server.ListenerConfig{
+			Addr:         addr,
+			CertFile:     certPath,
+			KeyFile:      keyPath,
+			ClientCAFile: jtutils.Must(flags.GetString("client-ca")),
+		})
+	}
+	for _, spec := range listens {
+		cfg, err := server.ParseListenerSpec(spec)
+		if err != nil {
+			log.Fatalf("error parsing listener %q: %v", spec, err)
+		}
+		lnCfgs = append(lnCfgs, cfg)
+	}
+
+	var err error
 	var r *server.Router
-	if tunnelAddr != "" {
+	if tunnelCfg.Addr != "" {
 		if tunnelSrvr.Name == "" || tunnelSrvr.Path == "" {
 			fmt.Fprintln(os.Stderr, "must provide name and path when tunneling")
 			return
 		}
-		log.Println("attempting tunneling to", tunnelAddr)
-		r, err = server.NewTunneledRouter(addr, tunnelAddr, tunnelSrvr)
+		log.Println("attempting tunneling to", tunnelCfg.Addr)
+		r, err = server.NewTunneledRouterWithConfig(tunnelCfg, tunnelSrvr, lnCfgs...)
 	} else {
-		r, err = server.NewRouter(addr)
+		r, err = server.NewRouterWithListeners(lnCfgs...)
 	}
 	if err != nil {
 		server.Logger.Fatal(err)
 	}
+	r.SetAdminListeners(jtutils.Must(flags.GetBool("admin-listeners")))
+	if err := r.SetTunnelHeartbeat(tunnelCfg.Heartbeat); err != nil {
+		log.Fatal(err)
+	}
+	if tunnelAuthPath != "" {
+		ta, err := server.LoadTunnelAuth(tunnelAuthPath)
+		if err != nil {
+			log.Fatal("error loading tunnel auth: ", err)
+		}
+		r.SetTunnelAuth(ta)
+	}
+	if err := r.SetTunnelTCP(tunnelTCP); err != nil {
+		log.Fatal(err)
+	}
+	if err := r.SetTunnelUDP(tunnelUDP); err != nil {
+		log.Fatal(err)
+	}
+	for _, ts := range tunnelServices {
+		if err := r.AddTunnelService(ts); err != nil {
+			log.Fatalf("error registering tunnel service %s: %v", ts.Path, err)
+		}
+	}
 	s := &http.Server{
-		Handler:  r,
-		ErrorLog: server.Logger,
+		Handler:           r,
+		ErrorLog:          server.Logger,
+		ConnContext:       r.ConnContext,
+		ReadHeaderTimeout: jtutils.Must(flags.GetDuration("read-header-timeout")),
+		ReadTimeout:       jtutils.Must(flags.GetDuration("read-timeout")),
+		WriteTimeout:      jtutils.Must(flags.GetDuration("write-timeout")),
+		IdleTimeout:       jtutils.Must(flags.GetDuration("idle-timeout")),
 	}
-	log.Println("starting proxy on", addr)
-	if keyPath != "" {
-		server.Logger.Fatal(s.ServeTLS(r, certPath, keyPath))
-	} else {
-		server.Logger.Fatal(s.Serve(r))
+	for _, l := range r.Listeners() {
+		log.Println("starting proxy on", l.Name())
+	}
+	done := make(chan struct{})
+	go shutdownOnSignal(r, s, jtutils.Must(flags.GetDuration("drain-timeout")), done)
+	if err := s.Serve(r); err != http.ErrServerClosed {
+		server.Logger.Fatal(err)
+	}
+	<-done
+}
+
+func makeTunnelCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:                   "tunnel",
+		Run:                   runTunnel,
+		DisableFlagsInUseLine: true,
+	}
+	flags := cmd.Flags()
+
+	flags.String("local", "", "URL of the local app requests are proxied to (include proto)")
+	flags.String("remote", "", "Address of the proxy to tunnel to")
+	flags.String("path", "", "Path of the app on the tunneled-to proxy")
+	flags.String("name", "", "Name of the app displayed on the tunneled-to proxy (defaults to the path)")
+	flags.Bool("hidden", false, "Whether the app should be hidden on the tunneled-to proxy")
+	flags.String(
+		"host-header",
+		"",
+		"Host header sent to the local app, or \"rewrite\" to use the local app's host "+
+			"(the original one is kept if not set)",
+	)
+	addTunnelFlags(cmd)
+	addLogFlags(cmd)
+	cmd.MarkFlagRequired("local")
+	cmd.MarkFlagRequired("remote")
+	cmd.MarkFlagRequired("path")
+
+	return cmd
+}
+
+func runTunnel(cmd *cobra.Command, _ []string) {
+	flags := cmd.Flags()
+	setupLogging(cmd)
+
+	local := jtutils.Must(flags.GetString("local"))
+	host := jtutils.Must(flags.GetString("host-header"))
+	if host == "rewrite" {
+		u, err := url.Parse(local)
+		if err != nil {
+			log.Fatal("bad local URL: ", err)
+		}
+		host = u.Host
+	}
+	handler, err := server.NewUpstreamHandler(local, host)
+	if err != nil {
+		log.Fatal("bad local URL: ", err)
+	}
+	failed := make(chan server.TunnelStatus, 1)
+	tunnelCfg := tunnelConfigFromFlags(cmd)
+	tunnelCfg.Addr = jtutils.Must(flags.GetString("remote"))
+	tunnelCfg.Handler = handler
+	tunnelCfg.OnStateChange = func(status server.TunnelStatus) {
+		if status.State == server.TunnelFailed {
+			failed <- status
+		}
+	}
+	tunnelSrvr := &server.Server{
+		Name:   jtutils.Must(flags.GetString("name")),
+		Path:   jtutils.Must(flags.GetString("path")),
+		Hidden: jtutils.Must(flags.GetBool("hidden")),
+	}
+	if tunnelSrvr.Name == "" {
+		tunnelSrvr.Name = tunnelSrvr.Path
+	}
+
+	log.Printf("tunneling %s to %s", local, tunnelCfg.Addr)
+	r, err := server.NewTunneledRouterWithConfig(tunnelCfg, tunnelSrvr)
+	if err != nil {
+		server.Logger.Fatal(err)
+	}
+	log.Printf("serving %s at /%s", local, tunnelSrvr.Path)
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, os.Interrupt)
+	select {
+	case sig := <-ch:
+		server.Logger.Printf("received %v, closing tunnel", sig)
+		r.Close()
+	case status := <-failed:
+		server.Logger.Fatal("tunnel failed: ", status.LastError)
+	}
+}
+
+// shutdownOnSignal drains the router and shuts down the server once SIGTERM
+// or an interrupt is received, closing done once finished.
+func shutdownOnSignal(
+	r *server.Router, s *http.Server, timeout time.Duration, done chan struct{},
+) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, os.Interrupt)
+	sig := <-ch
+	signal.Stop(ch)
+	server.Logger.Printf("received %v, draining", sig)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := r.Shutdown(ctx); err != nil {
+		server.Logger.Print("error draining servers: ", err)
+	}
+	// Give the server a little time to write the last responses
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		server.Logger.Print("error shutting down: ", err)
+	}
+	server.Logger.Print("shut down")
+	close(done)
+}
+
+// addTunnelFlags adds the flags configuring how a tunnel connects to the
+// tunneled-to proxy.
+func addTunnelFlags(cmd *cobra.Command) {
+	flags := cmd.Flags()
+	flags.String("tunnel-credential-id", "", "ID of the credential to register the tunnel with")
+	flags.String(
+		"tunnel-token",
+		"",
+		"Pre-shared token to register the tunnel with (defaults to $GORY_TUNNEL_TOKEN)",
+	)
+	flags.String(
+		"tunnel-secret",
+		"",
+		"Secret used to answer the HMAC challenge when registering the tunnel "+
+			"(defaults to $GORY_TUNNEL_SECRET)",
+	)
+	flags.Bool("tunnel-tls", false, "Connect the tunnel over TLS")
+	flags.String(
+		"tunnel-transport",
+		server.TunnelTransportTCP,
+		"How the tunnel connects: tcp, upgrade (HTTP upgrade) or websocket "+
+			"(the last two work through HTTP proxies and L7 load balancers)",
+	)
+	flags.String(
+		"tunnel-proxy",
+		"",
+		"URL of the HTTP proxy the tunnel connects through, or \"env\" to use $HTTPS_PROXY/$HTTP_PROXY",
+	)
+	flags.String(
+		"tunnel-ca",
+		"",
+		"Path to the CA file used to verify the tunneled-to proxy's cert (implies --tunnel-tls)",
+	)
+	flags.String(
+		"tunnel-cert",
+		"",
+		"Path to the client cert file sent when tunneling over TLS (implies --tunnel-tls)",
+	)
+	flags.String("tunnel-key", "", "Path to the client key file sent when tunneling over TLS")
+	flags.String(
+		"tunnel-server-name",
+		"",
+		"Server name used to verify the tunneled-to proxy's cert (defaults to the tunnel host)",
+	)
+	flags.Duration(
+		"tunnel-heartbeat-interval",
+		15*time.Second,
+		"How often tunnels are pinged to check the other side is still there",
+	)
+	flags.Int(
+		"tunnel-heartbeat-misses",
+		3,
+		"Number of unanswered tunnel pings before the other side is considered gone",
+	)
+	flags.Duration(
+		"tunnel-reconnect-min",
+		time.Second,
+		"Delay before reconnecting the tunnel after the first failed attempt (doubles each attempt)",
+	)
+	flags.Duration("tunnel-reconnect-max", time.Minute, "Max delay between attempts to reconnect the tunnel")
+	flags.Int(
+		"tunnel-reconnect-attempts",
+		0,
+		"Number of failed attempts in a row before giving up reconnecting the tunnel (0 = never give up)",
+	)
+	cmd.MarkFlagsRequiredTogether("tunnel-cert", "tunnel-key")
+}
+
+// tunnelConfigFromFlags returns the tunnel config set by the flags added by
+// addTunnelFlags, without the address.
+func tunnelConfigFromFlags(cmd *cobra.Command) server.TunnelConfig {
+	flags := cmd.Flags()
+	tunnelCfg := server.TunnelConfig{
+		CredentialID: jtutils.Must(flags.GetString("tunnel-credential-id")),
+		Token:        jtutils.Must(flags.GetString("tunnel-token")),
+		Secret:       jtutils.Must(flags.GetString("tunnel-secret")),
+		Heartbeat: server.TunnelHeartbeat{
+			Interval:  server.Duration(jtutils.Must(flags.GetDuration("tunnel-heartbeat-interval"))),
+			MaxMissed: jtutils.Must(flags.GetInt("tunnel-heartbeat-misses")),
+		},
+		Reconnect: server.TunnelReconnect{
+			MinDelay:    server.Duration(jtutils.Must(flags.GetDuration("tunnel-reconnect-min"))),
+			MaxDelay:    server.Duration(jtutils.Must(flags.GetDuration("tunnel-reconnect-max"))),
+			MaxAttempts: jtutils.Must(flags.GetInt("tunnel-reconnect-attempts")),
+		},
+	}
+	if tunnelCfg.Token == "" {
+		tunnelCfg.Token = os.Getenv("GORY_TUNNEL_TOKEN")
+	}
+	if tunnelCfg.Secret == "" {
+		tunnelCfg.Secret = os.Getenv("GORY_TUNNEL_SECRET")
+	}
+	tunnelCA := jtutils.Must(flags.GetString("tunnel-ca"))
+	tunnelCert := jtutils.Must(flags.GetString("tunnel-cert"))
+	if jtutils.Must(flags.GetBool("tunnel-tls")) || tunnelCA != "" || tunnelCert != "" {
+		cfg, err := server.NewTunnelTLSConfig(
+			tunnelCA,
+			tunnelCert,
+			jtutils.Must(flags.GetString("tunnel-key")),
+			jtutils.Must(flags.GetString("tunnel-server-name")),
+		)
+		if err != nil {
+			log.Fatal("error loading tunnel TLS config: ", err)
+		}
+		tunnelCfg.TLS = cfg
+	}
+	tunnelCfg.Transport = jtutils.Must(flags.GetString("tunnel-transport"))
+	switch proxy := jtutils.Must(flags.GetString("tunnel-proxy")); proxy {
+	case "":
+	case "env":
+		tunnelCfg.Proxy = http.ProxyFromEnvironment
+	default:
+		u, err := url.Parse(proxy)
+		if err != nil {
+			log.Fatal("bad tunnel proxy URL: ", err)
+		}
+		tunnelCfg.Proxy = http.ProxyURL(u)
+	}
+	return tunnelCfg
+}
+
+// addLogFlags adds the flags used by setupLogging.
+func addLogFlags(cmd *cobra.Command) {
+	flags := cmd.Flags()
+	flags.String(
+		"log-file",
+		"stderr",
+		"Path to the log file (or stdout/stderr to log to those)",
+	)
+	flags.Int64("log-max-size", 0, "Max size of the log file in MB before rotating (0 = no limit)")
+	flags.Duration("log-max-age", 0, "Max age of the log file before rotating (0 = no limit)")
+	flags.Int("log-max-backups", 0, "Number of rotated log files to keep (0 = keep all)")
+	flags.Bool("log-compress", false, "Whether rotated log files should be gzipped")
+}
+
+func setupLogging(cmd *cobra.Command) {
+	flags := cmd.Flags()
+	logFile := jtutils.Must(flags.GetString("log-file"))
+	switch logFile {
+	case "stderr", "":
+		server.Logger.SetOutput(os.Stderr)
+		return
+	case "stdout":
+		server.Logger.SetOutput(os.Stdout)
+		return
+	}
+	path, err := filepath.Abs(logFile)
+	if err != nil {
+		log.Fatal("error getting log file path: ", err)
+	}
+	lf, err := server.OpenLogFile(path, server.LogFileOptions{
+		MaxSize:    jtutils.Must(flags.GetInt64("log-max-size")) * (1 << 20),
+		MaxAge:     jtutils.Must(flags.GetDuration("log-max-age")),
+		MaxBackups: jtutils.Must(flags.GetInt("log-max-backups")),
+		Compress:   jtutils.Must(flags.GetBool("log-compress")),
+	})
+	if err != nil {
+		log.Fatal("error opening log file: ", err)
 	}
+	server.LogFilePath = lf.Path()
+	server.Logger.SetOutput(lf)
+	notifyReopen(lf)
 }
 
 func makeClientCmd() *cobra.Command {
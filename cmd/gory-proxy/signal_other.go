@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "github.com/johnietre/gory-proxy/server"
+
+// notifyReopen does nothing since SIGUSR1 isn't available.
+func notifyReopen(lf *server.LogFile) {}
@@ -0,0 +1,28 @@
+//go:build unix
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/johnietre/gory-proxy/server"
+)
+
+// notifyReopen reopens the log file whenever SIGUSR1 is received.
+func notifyReopen(lf *server.LogFile) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1)
+	go func() {
+		for range ch {
+			if err := lf.Reopen(); err != nil {
+				// Logger may be writing to the closed file so use stderr
+				log.Print("error reopening log file: ", err)
+				continue
+			}
+			server.Logger.Println("reopened log file")
+		}
+	}()
+}
@@ -0,0 +1,244 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Algorithms an adaptive concurrency limiter can use
+const (
+	// AdaptiveGradient scales the limit by the ratio of the lowest observed
+	// latency to the current latency
+	AdaptiveGradient = "gradient"
+	// AdaptiveAIMD increases the limit by one while latency is fine and
+	// multiplies it by the backoff ratio when it's not
+	AdaptiveAIMD = "aimd"
+)
+
+// AdaptiveConcurrency configures a concurrency limit that's adjusted based on
+// the latency of requests, so that overload is shed before latency explodes.
+type AdaptiveConcurrency struct {
+	// Algorithm is the algorithm used to adjust the limit (see the Adaptive
+	// constants). Defaults to gradient.
+	Algorithm string `json:"algorithm,omitempty"`
+	// InitialLimit is the limit to start with. Defaults to 20.
+	InitialLimit int `json:"initialLimit,omitempty"`
+	// MinLimit is the lowest the limit can go. Defaults to 1.
+	MinLimit int `json:"minLimit,omitempty"`
+	// MaxLimit is the highest the limit can go. Defaults to 1000.
+	MaxLimit int `json:"maxLimit,omitempty"`
+	// Tolerance is how many times the lowest observed latency the latency can
+	// be before the limit is reduced. Defaults to 2.
+	Tolerance float64 `json:"tolerance,omitempty"`
+	// BackoffRatio is what the limit is multiplied by when requests fail or
+	// latency is too high with AIMD. Defaults to 0.9.
+	BackoffRatio float64 `json:"backoffRatio,omitempty"`
+	// SampleWindow is how often the limit is updated from the latency of the
+	// requests in the window. Defaults to 1s.
+	SampleWindow Duration `json:"sampleWindow,omitempty"`
+}
+
+func (ac *AdaptiveConcurrency) validate() error {
+	switch ac.Algorithm {
+	case "", AdaptiveGradient, AdaptiveAIMD:
+	default:
+		return fmt.Errorf("invalid adaptive concurrency algorithm: %s", ac.Algorithm)
+	}
+	if ac.InitialLimit < 0 || ac.MinLimit < 0 || ac.MaxLimit < 0 {
+		return fmt.Errorf("adaptive concurrency limits can't be negative")
+	} else if ac.MaxLimit != 0 && ac.MaxLimit < ac.minLimit() {
+		return fmt.Errorf("adaptive concurrency max limit is less than the min")
+	} else if ac.Tolerance != 0 && ac.Tolerance < 1 {
+		return fmt.Errorf("adaptive concurrency tolerance must be at least 1")
+	} else if ac.BackoffRatio < 0 || ac.BackoffRatio >= 1 {
+		return fmt.Errorf("adaptive concurrency backoff ratio must be between 0 and 1")
+	} else if ac.SampleWindow < 0 {
+		return fmt.Errorf("adaptive concurrency sample window can't be negative")
+	}
+	return nil
+}
+
+func (ac *AdaptiveConcurrency) initialLimit() int {
+	if ac.InitialLimit <= 0 {
+		return 20
+	}
+	return ac.InitialLimit
+}
+
+func (ac *AdaptiveConcurrency) minLimit() int {
+	if ac.MinLimit <= 0 {
+		return 1
+	}
+	return ac.MinLimit
+}
+
+func (ac *AdaptiveConcurrency) maxLimit() int {
+	if ac.MaxLimit <= 0 {
+		return 1000
+	}
+	return ac.MaxLimit
+}
+
+func (ac *AdaptiveConcurrency) tolerance() float64 {
+	if ac.Tolerance == 0 {
+		return 2
+	}
+	return ac.Tolerance
+}
+
+func (ac *AdaptiveConcurrency) backoffRatio() float64 {
+	if ac.BackoffRatio == 0 {
+		return 0.9
+	}
+	return ac.BackoffRatio
+}
+
+func (ac *AdaptiveConcurrency) sampleWindow() time.Duration {
+	return ac.SampleWindow.Or(time.Second)
+}
+
+// How often the lowest observed latency is reset so it can follow the
+// server's latency going up
+const minLatencyResetInterval = 30 * time.Second
+
+// adaptiveLimiter wraps a server's proxy, limiting the number of requests
+// passed to it at once.
+type adaptiveLimiter struct {
+	cfg  AdaptiveConcurrency
+	next http.Handler
+
+	rejected int64
+
+	mtx      sync.Mutex
+	limit    float64
+	inFlight int
+	// Lowest average latency of a window and when it was last reset
+	minLatency      time.Duration
+	minLatencyReset time.Time
+	// The current sample window
+	windowStart    time.Time
+	windowSum      time.Duration
+	windowCount    int
+	windowFailed   bool
+	windowInFlight int
+}
+
+func newAdaptiveLimiter(cfg AdaptiveConcurrency, next http.Handler) *adaptiveLimiter {
+	now := time.Now()
+	return &adaptiveLimiter{
+		cfg:             cfg,
+		next:            next,
+		limit:           float64(cfg.initialLimit()),
+		minLatencyReset: now,
+		windowStart:     now,
+	}
+}
+
+func (al *adaptiveLimiter) ServeHTTP(w RW, r Req) {
+	al.mtx.Lock()
+	if al.inFlight >= int(al.limit) {
+		al.mtx.Unlock()
+		atomic.AddInt64(&al.rejected, 1)
+		writeRetryAfter(w, time.Second, "Server overloaded")
+		return
+	}
+	al.inFlight++
+	if al.inFlight > al.windowInFlight {
+		al.windowInFlight = al.inFlight
+	}
+	al.mtx.Unlock()
+
+	// Deferred since the proxy panics with http.ErrAbortHandler when the
+	// client goes away mid-response
+	defer al.release(r, time.Now())
+	al.next.ServeHTTP(w, r)
+}
+
+// release frees the request's slot, sampling its latency.
+func (al *adaptiveLimiter) release(r Req, start time.Time) {
+	latency := time.Since(start)
+	al.mtx.Lock()
+	defer al.mtx.Unlock()
+	al.inFlight--
+	// The latency of upgraded connections says nothing about the server and
+	// the result of requests the client gave up on isn't known
+	ps := getProxyState(r.Context())
+	if r.Header.Get("Upgrade") != "" || ps == nil || !ps.known {
+		return
+	}
+	al.sample(latency, ps.failed)
+}
+
+// Must be called with the lock held
+func (al *adaptiveLimiter) sample(latency time.Duration, failed bool) {
+	al.windowSum += latency
+	al.windowCount++
+	al.windowFailed = al.windowFailed || failed
+	now := time.Now()
+	if now.Sub(al.windowStart) < al.cfg.sampleWindow() {
+		return
+	}
+	avg := al.windowSum / time.Duration(al.windowCount)
+	if al.minLatency == 0 || avg < al.minLatency ||
+		now.Sub(al.minLatencyReset) >= minLatencyResetInterval {
+		al.minLatency, al.minLatencyReset = avg, now
+	}
+	// Only grow the limit if it's actually being used
+	utilized := float64(al.windowInFlight) >= al.limit/2
+	tol := al.cfg.tolerance()
+	limit := al.limit
+	switch al.cfg.Algorithm {
+	case AdaptiveAIMD:
+		if al.windowFailed || float64(avg) > float64(al.minLatency)*tol {
+			limit *= al.cfg.backoffRatio()
+		} else if utilized {
+			limit++
+		}
+	default:
+		gradient := math.Max(0.5, math.Min(1, tol*float64(al.minLatency)/float64(avg)))
+		newLimit := limit * gradient
+		if al.windowFailed {
+			newLimit = limit * al.cfg.backoffRatio()
+		} else if utilized {
+			// Leave room for some queueing
+			newLimit += math.Sqrt(limit)
+		}
+		limit = 0.8*limit + 0.2*newLimit
+	}
+	limit = math.Max(float64(al.cfg.minLimit()), math.Min(float64(al.cfg.maxLimit()), limit))
+	al.limit = limit
+	al.windowStart, al.windowSum, al.windowCount = now, 0, 0
+	al.windowFailed, al.windowInFlight = false, al.inFlight
+}
+
+// AdaptiveStatus is the status of a server's adaptive concurrency limiter.
+type AdaptiveStatus struct {
+	Limit      int      `json:"limit"`
+	InFlight   int      `json:"inFlight"`
+	MinLatency Duration `json:"minLatency"`
+	Rejected   int64    `json:"rejected"`
+}
+
+func (al *adaptiveLimiter) status() AdaptiveStatus {
+	al.mtx.Lock()
+	defer al.mtx.Unlock()
+	return AdaptiveStatus{
+		Limit:      int(al.limit),
+		InFlight:   al.inFlight,
+		MinLatency: Duration(al.minLatency),
+		Rejected:   atomic.LoadInt64(&al.rejected),
+	}
+}
+
+// AdaptiveStatus returns the status of the server's adaptive concurrency
+// limiter. False is returned if the server doesn't have one.
+func (s *Server) AdaptiveStatus() (AdaptiveStatus, bool) {
+	if s.adaptive == nil {
+		return AdaptiveStatus{}, false
+	}
+	return s.adaptive.status(), true
+}
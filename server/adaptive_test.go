@@ -0,0 +1,94 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdaptiveSample(t *testing.T) {
+	const minLatency = 10 * time.Millisecond
+	tests := []struct {
+		name      string
+		algorithm string
+		limit     float64
+		// Max requests in flight during the window
+		inFlight int
+		latency  time.Duration
+		failed   bool
+		want     float64
+	}{
+		{"aimd grows when used", AdaptiveAIMD, 10, 10, minLatency, false, 11},
+		{"aimd holds when unused", AdaptiveAIMD, 10, 1, minLatency, false, 10},
+		{"aimd backs off on failure", AdaptiveAIMD, 10, 10, minLatency, true, 9},
+		{"aimd backs off when slow", AdaptiveAIMD, 10, 10, 3 * minLatency, false, 9},
+		{"aimd stays above min", AdaptiveAIMD, 1, 1, minLatency, true, 1},
+		{"aimd stays below max", AdaptiveAIMD, 1000, 1000, minLatency, false, 1000},
+		{"gradient grows when used", AdaptiveGradient, 10, 10, minLatency, false, 0.8*10 + 0.2*(10+math.Sqrt(10))},
+		{"gradient backs off on failure", AdaptiveGradient, 10, 10, minLatency, true, 0.8*10 + 0.2*9},
+		{"gradient shrinks when slow", AdaptiveGradient, 10, 1, 4 * minLatency, false, 0.8*10 + 0.2*5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			al := newAdaptiveLimiter(AdaptiveConcurrency{
+				Algorithm: test.algorithm,
+				// Every sample ends the window
+				SampleWindow: Duration(time.Nanosecond),
+			}, nil)
+			al.limit, al.minLatency, al.windowInFlight = test.limit, minLatency, test.inFlight
+			al.mtx.Lock()
+			al.sample(test.latency, test.failed)
+			al.mtx.Unlock()
+			if math.Abs(al.limit-test.want) > 1e-9 {
+				t.Fatalf("got limit %v, want %v", al.limit, test.want)
+			}
+		})
+	}
+}
+
+func TestAdaptiveLimiterRejects(t *testing.T) {
+	block, entered := make(chan struct{}), make(chan struct{})
+	al := newAdaptiveLimiter(AdaptiveConcurrency{InitialLimit: 1}, http.HandlerFunc(func(RW, Req) {
+		entered <- struct{}{}
+		<-block
+	}))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		al.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}()
+	<-entered
+	w := httptest.NewRecorder()
+	al.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("got %d with Retry-After %q over the limit", w.Code, w.Header().Get("Retry-After"))
+	}
+	close(block)
+	<-done
+	if status := al.status(); status.InFlight != 0 || status.Rejected != 1 {
+		t.Fatalf("got status %+v", status)
+	}
+}
+
+func TestAdaptiveLimiterPanic(t *testing.T) {
+	al := newAdaptiveLimiter(AdaptiveConcurrency{InitialLimit: 1}, http.HandlerFunc(func(RW, Req) {
+		panic(http.ErrAbortHandler)
+	}))
+	for i := 0; i < 2; i++ {
+		func() {
+			defer func() {
+				if err := recover(); err != http.ErrAbortHandler {
+					t.Fatalf("request %d: got panic %v", i, err)
+				}
+			}()
+			w := httptest.NewRecorder()
+			al.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			t.Fatalf("request %d: handler didn't panic, got %d", i, w.Code)
+		}()
+	}
+	if status := al.status(); status.InFlight != 0 || status.Rejected != 0 {
+		t.Fatalf("slot leaked by panicking handler: %+v", status)
+	}
+}
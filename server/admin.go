@@ -0,0 +1,385 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// AdminPath is the path the admin API is served under. It's in the router's
+// reserved route so it can't shadow a server's.
+const AdminPath = "/" + reservedRoute + "/admin"
+
+// SetAdminListeners sets whether listeners can be added and removed over the
+// admin API, which isn't allowed by default. Anyone who can reach the admin
+// API could then listen on any address and load cert files from any path.
+func (router *Router) SetAdminListeners(allow bool) {
+	router.adminListeners.Store(allow)
+}
+
+// serveAdmin serves the admin API under AdminPath.
+func (router *Router) serveAdmin(w RW, r Req) {
+	switch strings.Trim(strings.TrimPrefix(r.URL.Path, AdminPath), "/") {
+	case "listeners":
+		switch r.Method {
+		case http.MethodGet:
+			router.getListeners(w, r)
+		case http.MethodPost, http.MethodDelete:
+			if !router.adminListeners.Load() {
+				http.Error(w, "Changing listeners over the admin API is disabled", http.StatusForbidden)
+			} else if r.Method == http.MethodPost {
+				router.addListener(w, r)
+			} else {
+				router.deleteListener(w, r)
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	case "servers":
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		router.getServers(w, r)
+	case "targets":
+		switch r.Method {
+		case http.MethodGet:
+			router.getTargets(w, r)
+		case http.MethodPost:
+			router.addTarget(w, r)
+		case http.MethodDelete:
+			router.deleteTarget(w, r)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	case "tunnel":
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		status, ok := router.TunnelStatus()
+		if !ok {
+			http.Error(w, "Router isn't tunneled", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, status)
+	case "tunnel/tcp":
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		services := router.TCPServices()
+		if services == nil {
+			services = []TCPServiceStatus{}
+		}
+		writeJSON(w, services)
+	case "tunnel/udp":
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		services := router.UDPServices()
+		if services == nil {
+			services = []UDPServiceStatus{}
+		}
+		writeJSON(w, services)
+	case "tunnel/services":
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, router.TunnelServices())
+		case http.MethodPost, http.MethodPut:
+			router.putTunnelService(w, r)
+		case http.MethodDelete:
+			router.deleteTunnelService(w, r)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+type listenerData struct {
+	ListenerConfig
+	// Addr is the actual address being listened on
+	ListenAddr string `json:"listenAddr"`
+	TLS        bool   `json:"tls"`
+}
+
+func (router *Router) getListeners(w RW, r Req) {
+	var data []listenerData
+	for _, l := range router.Listeners() {
+		data = append(data, listenerData{
+			ListenerConfig: l.Config(),
+			ListenAddr:     l.Addr().String(),
+			TLS:            l.IsTLS(),
+		})
+	}
+	writeJSON(w, data)
+}
+
+func (router *Router) addListener(w RW, r Req) {
+	defer r.Body.Close()
+	cfg := ListenerConfig{}
+	if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+		http.Error(w, "Bad json", http.StatusBadRequest)
+		return
+	}
+	l, err := router.AddListener(cfg)
+	if err == ErrListenerExists {
+		http.Error(w, "Listener already exists", http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "Error creating listener: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	Logger.Printf("added listener %s", l.Name())
+	writeJSON(w, listenerData{
+		ListenerConfig: l.Config(),
+		ListenAddr:     l.Addr().String(),
+		TLS:            l.IsTLS(),
+	})
+}
+
+func (router *Router) deleteListener(w RW, r Req) {
+	defer r.Body.Close()
+	cfg := ListenerConfig{}
+	if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+		http.Error(w, "Bad json", http.StatusBadRequest)
+		return
+	}
+	if err := router.RemoveListener(cfg.Name); err == ErrListenerNotExist {
+		http.Error(w, "Listener does not exist", http.StatusNotFound)
+		return
+	} else if err != nil {
+		Logger.Printf("error closing listener %s: %v", cfg.Name, err)
+	}
+	Logger.Printf("removed listener %s", cfg.Name)
+	w.WriteHeader(http.StatusOK)
+}
+
+type serverData struct {
+	Name           string               `json:"name"`
+	Path           string               `json:"path"`
+	Addr           string               `json:"addr,omitempty"`
+	Hidden         bool                 `json:"hidden,omitempty"`
+	Tunnel         bool                 `json:"tunnel,omitempty"`
+	Draining       bool                 `json:"draining,omitempty"`
+	Active         int                  `json:"activeRequests"`
+	Balance        string               `json:"balance,omitempty"`
+	HashOn         string               `json:"hashOn,omitempty"`
+	HealthCheck    *HealthCheck         `json:"healthCheck,omitempty"`
+	Health         string               `json:"health,omitempty"`
+	Outlier        *OutlierDetection    `json:"outlierDetection,omitempty"`
+	Ejections      []EjectionEvent      `json:"ejections,omitempty"`
+	Breaker        *CircuitBreaker      `json:"circuitBreaker,omitempty"`
+	BreakerStatus  *BreakerStatus       `json:"breakerStatus,omitempty"`
+	Retry          *RetryPolicy         `json:"retry,omitempty"`
+	Hedge          *HedgePolicy         `json:"hedge,omitempty"`
+	Concurrency    *ConcurrencyLimit    `json:"concurrency,omitempty"`
+	LimiterStatus  *LimiterStatus       `json:"limiterStatus,omitempty"`
+	Adaptive       *AdaptiveConcurrency `json:"adaptiveConcurrency,omitempty"`
+	AdaptiveStatus *AdaptiveStatus      `json:"adaptiveStatus,omitempty"`
+	Targets        []targetData         `json:"targets,omitempty"`
+}
+
+func (router *Router) getServers(w RW, r Req) {
+	data := []serverData{}
+	addData := func(_ string, srvr *Server) bool {
+		sd := serverData{
+			Name:        srvr.Name,
+			Path:        srvr.Path,
+			Addr:        srvr.Addr,
+			Hidden:      srvr.Hidden,
+			Tunnel:      srvr.isTunnel,
+			Draining:    srvr.Draining(),
+			Active:      srvr.ActiveRequests(),
+			Balance:     srvr.Balance,
+			HashOn:      srvr.HashOn,
+			HealthCheck: srvr.HealthCheck,
+			Health:      srvr.healthSummary(),
+			Outlier:     srvr.Outlier,
+			Ejections:   srvr.RecentEjections(),
+			Breaker:     srvr.Breaker,
+			Retry:       srvr.Retry,
+			Hedge:       srvr.Hedge,
+			Concurrency: srvr.Concurrency,
+			Adaptive:    srvr.Adaptive,
+		}
+		if bs, ok := srvr.BreakerStatus(); ok {
+			sd.BreakerStatus = &bs
+		}
+		if ls, ok := srvr.LimiterStatus(); ok {
+			sd.LimiterStatus = &ls
+		}
+		if as, ok := srvr.AdaptiveStatus(); ok {
+			sd.AdaptiveStatus = &as
+		}
+		for _, t := range srvr.GetTargets() {
+			sd.Targets = append(sd.Targets, newTargetData(t))
+		}
+		data = append(data, sd)
+		return true
+	}
+	router.routes.Range(addData)
+	router.draining.Range(addData)
+	sort.Slice(data, func(i, j int) bool {
+		return data[i].Path < data[j].Path
+	})
+	writeJSON(w, data)
+}
+
+type targetData struct {
+	Addr        string     `json:"addr"`
+	Weight      int        `json:"weight,omitempty"`
+	Outstanding int64      `json:"outstanding"`
+	Healthy     bool       `json:"healthy"`
+	LastCheck   *time.Time `json:"lastCheck,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+	Ejected     bool       `json:"ejected"`
+	// EjectedUntil is the end of the current (or last) ejection
+	EjectedUntil   *time.Time `json:"ejectedUntil,omitempty"`
+	TotalEjections int64      `json:"totalEjections,omitempty"`
+}
+
+func newTargetData(t *Target) targetData {
+	td := targetData{
+		Addr:        t.Addr,
+		Weight:      t.Weight,
+		Outstanding: t.Outstanding(),
+		Healthy:     t.Healthy(),
+		Ejected:     t.Ejected(),
+
+		TotalEjections: t.TotalEjections(),
+	}
+	if last, err := t.LastHealthCheck(); !last.IsZero() {
+		td.LastCheck = &last
+		if err != nil {
+			td.LastError = err.Error()
+		}
+	}
+	if until := t.EjectedUntil(); !until.IsZero() {
+		td.EjectedUntil = &until
+	}
+	return td
+}
+
+// targetReq is the body of requests to add or delete targets.
+type targetReq struct {
+	// Path of the server
+	Path string `json:"path"`
+	Target
+}
+
+func (router *Router) getTargets(w RW, r Req) {
+	srvr, ok := router.routes.Load(r.URL.Query().Get("path"))
+	if !ok {
+		http.Error(w, "Server does not exist", http.StatusNotFound)
+		return
+	}
+	data := []targetData{}
+	for _, t := range srvr.GetTargets() {
+		data = append(data, newTargetData(t))
+	}
+	writeJSON(w, data)
+}
+
+func (router *Router) addTarget(w RW, r Req) {
+	defer r.Body.Close()
+	req := targetReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad json", http.StatusBadRequest)
+		return
+	}
+	switch err := router.AddTarget(req.Path, &req.Target); err {
+	case nil:
+		Logger.Printf("added target %s to %s", req.Addr, req.Path)
+		w.WriteHeader(http.StatusOK)
+	case ErrServerNotExist:
+		http.Error(w, "Server does not exist", http.StatusNotFound)
+	case ErrTargetExists:
+		http.Error(w, "Target already exists", http.StatusBadRequest)
+	case ErrNoTargetPool:
+		http.Error(w, "Server does not have targets", http.StatusBadRequest)
+	default:
+		http.Error(w, "Bad target: "+err.Error(), http.StatusBadRequest)
+	}
+}
+
+func (router *Router) deleteTarget(w RW, r Req) {
+	defer r.Body.Close()
+	req := targetReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad json", http.StatusBadRequest)
+		return
+	}
+	switch err := router.RemoveTarget(req.Path, req.Addr); err {
+	case nil:
+		Logger.Printf("removed target %s from %s", req.Addr, req.Path)
+		w.WriteHeader(http.StatusOK)
+	case ErrServerNotExist:
+		http.Error(w, "Server does not exist", http.StatusNotFound)
+	case ErrTargetNotExist:
+		http.Error(w, "Target does not exist", http.StatusNotFound)
+	case ErrNoTargetPool:
+		http.Error(w, "Server does not have targets", http.StatusBadRequest)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// putTunnelService adds a tunnel service with POST or updates one with PUT.
+func (router *Router) putTunnelService(w RW, r Req) {
+	defer r.Body.Close()
+	ts := TunnelService{}
+	if err := json.NewDecoder(r.Body).Decode(&ts); err != nil {
+		http.Error(w, "Bad json", http.StatusBadRequest)
+		return
+	}
+	var err error
+	if r.Method == http.MethodPost {
+		err = router.AddTunnelService(ts)
+	} else {
+		err = router.UpdateTunnelService(ts)
+	}
+	switch err {
+	case nil:
+		// Include the port allocated to the service
+		if svc, ok := router.tunnelServices.Load(ts.Path); ok {
+			ts.Port = int(atomic.LoadInt32(&svc.port))
+		}
+		writeJSON(w, ts)
+	case ErrTunnelServiceNotExist:
+		http.Error(w, "Tunnel service does not exist", http.StatusNotFound)
+	case ErrTunnelNotConnected:
+		http.Error(w, "Tunnel not connected", http.StatusServiceUnavailable)
+	default:
+		http.Error(w, "Error registering tunnel service: "+err.Error(), http.StatusBadRequest)
+	}
+}
+
+func (router *Router) deleteTunnelService(w RW, r Req) {
+	defer r.Body.Close()
+	ts := TunnelService{}
+	if err := json.NewDecoder(r.Body).Decode(&ts); err != nil {
+		http.Error(w, "Bad json", http.StatusBadRequest)
+		return
+	}
+	if err := router.RemoveTunnelService(ts.Path); err == ErrTunnelServiceNotExist {
+		http.Error(w, "Tunnel service does not exist", http.StatusNotFound)
+		return
+	} else if err != nil {
+		Logger.Printf("error withdrawing tunnel service %s: %v", ts.Path, err)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func writeJSON(w RW, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		Logger.Println(err)
+	}
+}
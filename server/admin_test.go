@@ -0,0 +1,86 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminPath(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w RW, r Req) {
+		io.WriteString(w, "upstream")
+	}))
+	defer upstream.Close()
+	router, err := NewRouterWithListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+	// A server can use the path the admin API used to be under
+	s := &Server{Name: "admin", Path: "admin", Addr: upstream.URL}
+	if err := s.AddTargetsProxy(); err != nil {
+		t.Fatal(err)
+	} else if err := router.AddServer(s); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		code int
+		// What the body must contain
+		body string
+	}{
+		{"/admin/", http.StatusOK, "upstream"},
+		{"/admin/servers", http.StatusOK, "upstream"},
+		{AdminPath + "/servers", http.StatusOK, `"admin"`},
+		{AdminPath + "x/servers", http.StatusNotFound, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.path, nil))
+			if w.Code != test.code || !strings.Contains(w.Body.String(), test.body) {
+				t.Fatalf("got %d: %q", w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestAdminListeners(t *testing.T) {
+	tests := []struct {
+		name  string
+		allow bool
+		// Status of adding and then removing a listener
+		add, del int
+	}{
+		{"disabled", false, http.StatusForbidden, http.StatusForbidden},
+		{"allowed", true, http.StatusOK, http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			router, err := NewRouterWithListeners()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer router.Close()
+			router.SetAdminListeners(test.allow)
+			serve := func(method string) int {
+				body := `{"name":"extra","addr":"127.0.0.1:0"}`
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, httptest.NewRequest(method, AdminPath+"/listeners", strings.NewReader(body)))
+				return w.Code
+			}
+			if code := serve(http.MethodPost); code != test.add {
+				t.Fatalf("adding got %d, want %d", code, test.add)
+			} else if n := len(router.Listeners()); (n == 1) != test.allow {
+				t.Fatalf("got %d listeners", n)
+			}
+			if code := serve(http.MethodDelete); code != test.del {
+				t.Fatalf("removing got %d, want %d", code, test.del)
+			} else if n := len(router.Listeners()); n != 0 {
+				t.Fatalf("got %d listeners", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Load balancing strategies for a Server with multiple targets
+const (
+	// BalanceRoundRobin cycles through the targets in order
+	BalanceRoundRobin = "round-robin"
+	// BalanceWeighted cycles through the targets in proportion to their
+	// weights
+	BalanceWeighted = "weighted"
+	// BalanceLeastRequests picks the target with the least outstanding
+	// requests
+	BalanceLeastRequests = "least-requests"
+	// BalanceRandomTwo picks two random targets and uses the one with the
+	// least outstanding requests
+	BalanceRandomTwo = "random-two"
+	// BalanceHash consistently hashes on the client IP or a header (see
+	// Server.HashOn)
+	BalanceHash = "hash"
+)
+
+// balancer picks a target for a request. Only targets for which ok returns
+// true can be picked. nil is returned if there are none.
+type balancer interface {
+	pick(r Req, targets []*Target, ok func(*Target) bool) *Target
+}
+
+func newBalancer(strategy, hashOn string) (balancer, error) {
+	switch strategy {
+	case "", BalanceRoundRobin:
+		return &roundRobinBalancer{}, nil
+	case BalanceWeighted:
+		return &weightedBalancer{current: make(map[*Target]int)}, nil
+	case BalanceLeastRequests:
+		return &leastRequestsBalancer{}, nil
+	case BalanceRandomTwo:
+		return randomTwoBalancer{}, nil
+	case BalanceHash:
+		if hashOn != "" && hashOn != "ip" && !strings.HasPrefix(hashOn, "header:") {
+			return nil, fmt.Errorf("invalid hash on: %s", hashOn)
+		}
+		return &hashBalancer{hashOn: hashOn}, nil
+	}
+	return nil, fmt.Errorf("invalid balance strategy: %s", strategy)
+}
+
+type roundRobinBalancer struct {
+	next uint32
+}
+
+func (b *roundRobinBalancer) pick(_ Req, targets []*Target, ok func(*Target) bool) *Target {
+	if len(targets) == 0 {
+		return nil
+	}
+	start := int(atomic.AddUint32(&b.next, 1) % uint32(len(targets)))
+	for i := range targets {
+		if t := targets[(start+i)%len(targets)]; ok(t) {
+			return t
+		}
+	}
+	return nil
+}
+
+// weightedBalancer implements smooth weighted round robin.
+type weightedBalancer struct {
+	mtx     sync.Mutex
+	current map[*Target]int
+}
+
+func (b *weightedBalancer) pick(_ Req, targets []*Target, ok func(*Target) bool) *Target {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	var best *Target
+	total := 0
+	for _, t := range targets {
+		if !ok(t) {
+			continue
+		}
+		w := t.weight()
+		total += w
+		b.current[t] += w
+		if best == nil || b.current[t] > b.current[best] {
+			best = t
+		}
+	}
+	if best != nil {
+		b.current[best] -= total
+	}
+	// Forget removed targets
+	if len(b.current) > len(targets) {
+		keep := make(map[*Target]int, len(targets))
+		for _, t := range targets {
+			if cur, ok := b.current[t]; ok {
+				keep[t] = cur
+			}
+		}
+		b.current = keep
+	}
+	return best
+}
+
+type leastRequestsBalancer struct {
+	next uint32
+}
+
+func (b *leastRequestsBalancer) pick(_ Req, targets []*Target, ok func(*Target) bool) *Target {
+	if len(targets) == 0 {
+		return nil
+	}
+	// Start from a rotating offset so ties are spread out
+	start := int(atomic.AddUint32(&b.next, 1) % uint32(len(targets)))
+	var best *Target
+	for i := range targets {
+		t := targets[(start+i)%len(targets)]
+		if ok(t) && (best == nil || t.Outstanding() < best.Outstanding()) {
+			best = t
+		}
+	}
+	return best
+}
+
+type randomTwoBalancer struct{}
+
+func (randomTwoBalancer) pick(_ Req, targets []*Target, ok func(*Target) bool) *Target {
+	var avail []*Target
+	for _, t := range targets {
+		if ok(t) {
+			avail = append(avail, t)
+		}
+	}
+	switch len(avail) {
+	case 0:
+		return nil
+	case 1:
+		return avail[0]
+	}
+	i := rand.Intn(len(avail))
+	j := rand.Intn(len(avail) - 1)
+	if j >= i {
+		j++
+	}
+	if avail[j].Outstanding() < avail[i].Outstanding() {
+		return avail[j]
+	}
+	return avail[i]
+}
+
+// Number of points each unit of weight gets on the hash ring
+const hashRingReplicas = 64
+
+type hashRingPoint struct {
+	hash   uint64
+	target *Target
+}
+
+type hashBalancer struct {
+	hashOn string
+
+	mtx  sync.Mutex
+	ring []hashRingPoint
+	// The targets the ring was built from
+	ringTargets []*Target
+}
+
+func (b *hashBalancer) pick(r Req, targets []*Target, ok func(*Target) bool) *Target {
+	ring := b.getRing(targets)
+	if len(ring) == 0 {
+		return nil
+	}
+	h := hashString(b.key(r))
+	start := sort.Search(len(ring), func(i int) bool {
+		return ring[i].hash >= h
+	})
+	// Walk the ring until an available target is found
+	for i := range ring {
+		if t := ring[(start+i)%len(ring)].target; ok(t) {
+			return t
+		}
+	}
+	return nil
+}
+
+func (b *hashBalancer) key(r Req) string {
+	if strings.HasPrefix(b.hashOn, "header:") {
+		if v := r.Header.Get(b.hashOn[len("header:"):]); v != "" {
+			return v
+		}
+	}
+	return clientIP(r)
+}
+
+func (b *hashBalancer) getRing(targets []*Target) []hashRingPoint {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if sameTargets(b.ringTargets, targets) {
+		return b.ring
+	}
+	var ring []hashRingPoint
+	for _, t := range targets {
+		for i := 0; i < t.weight()*hashRingReplicas; i++ {
+			ring = append(ring, hashRingPoint{
+				hash:   hashString(t.Addr + "#" + strconv.Itoa(i)),
+				target: t,
+			})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+	b.ring, b.ringTargets = ring, targets
+	return ring
+}
+
+func sameTargets(a, b []*Target) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	// FNV doesn't spread similar strings (like "addr#1" and "addr#2") out
+	// well, so mix the bits more
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testTargets returns targets at a.test, b.test, ... with the weights.
+func testTargets(t *testing.T, weights ...int) []*Target {
+	targets := make([]*Target, len(weights))
+	for i, w := range weights {
+		target, err := NewTarget(fmt.Sprintf("http://%c.test", 'a'+i), w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		targets[i] = target
+	}
+	return targets
+}
+
+// pickNames returns the hosts of the next n targets picked by the balancer.
+func pickNames(b balancer, r Req, targets []*Target, ok func(*Target) bool, n int) string {
+	names := make([]string, n)
+	for i := range names {
+		if t := b.pick(r, targets, ok); t != nil {
+			names[i] = t.URL().Host[:1]
+		} else {
+			names[i] = "-"
+		}
+	}
+	return strings.Join(names, "")
+}
+
+func allTargets(*Target) bool { return true }
+
+func TestNewBalancer(t *testing.T) {
+	tests := []struct {
+		strategy, hashOn string
+		err              bool
+	}{
+		{"", "", false},
+		{BalanceRoundRobin, "", false},
+		{BalanceWeighted, "", false},
+		{BalanceLeastRequests, "", false},
+		{BalanceRandomTwo, "", false},
+		{BalanceHash, "", false},
+		{BalanceHash, "ip", false},
+		{BalanceHash, "header:X-User", false},
+		{BalanceHash, "cookie:user", true},
+		{"fastest", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.strategy+" "+test.hashOn, func(t *testing.T) {
+			if _, err := newBalancer(test.strategy, test.hashOn); (err != nil) != test.err {
+				t.Fatalf("got error %v", err)
+			}
+		})
+	}
+}
+
+func TestWeightedBalancer(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []int
+		// Index of a target that can't be picked, -1 for none
+		down int
+		want string
+	}{
+		{"equal", []int{1, 1, 1}, -1, "abcabc"},
+		{"default weight", []int{0, 2}, -1, "babbab"},
+		{"smooth", []int{5, 1, 1}, -1, "aabacaa"},
+		{"skips unavailable", []int{5, 1, 1}, 0, "bcbcbcb"},
+		{"none available", []int{1}, 0, "--"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b, _ := newBalancer(BalanceWeighted, "")
+			targets := testTargets(t, test.weights...)
+			ok := func(target *Target) bool {
+				return test.down < 0 || target != targets[test.down]
+			}
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if got := pickNames(b, r, targets, ok, len(test.want)); got != test.want {
+				t.Fatalf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLeastRequestsBalancer(t *testing.T) {
+	tests := []struct {
+		name        string
+		outstanding []int64
+		down        int
+		want        string
+	}{
+		{"least", []int64{3, 1, 2}, -1, "b"},
+		{"skips unavailable", []int64{3, 1, 2}, 1, "c"},
+		{"ties spread out", []int64{0, 0, 5}, -1, "ab"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b, _ := newBalancer(BalanceLeastRequests, "")
+			targets := testTargets(t, make([]int, len(test.outstanding))...)
+			for i, n := range test.outstanding {
+				targets[i].outstanding = n
+			}
+			ok := func(target *Target) bool {
+				return test.down < 0 || target != targets[test.down]
+			}
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			got := pickNames(b, r, targets, ok, len(test.want))
+			if len(test.want) > 1 {
+				// Which of the tied targets comes first depends on the offset
+				if got != test.want && got != reverse(test.want) {
+					t.Fatalf("got %s, want both of %s", got, test.want)
+				}
+			} else if got != test.want {
+				t.Fatalf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func reverse(s string) string {
+	b := []byte(s)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
+
+func TestHashBalancer(t *testing.T) {
+	req := func(ip, user string) Req {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = ip + ":1234"
+		if user != "" {
+			r.Header.Set("X-User", user)
+		}
+		return r
+	}
+	tests := []struct {
+		name   string
+		hashOn string
+		// Requests that should go to the same target
+		same []Req
+	}{
+		{"ip", "", []Req{req("10.0.0.1", "u1"), req("10.0.0.1", "u2")}},
+		{"header", "header:X-User", []Req{req("10.0.0.1", "u1"), req("10.0.0.2", "u1")}},
+		{"header falls back to ip", "header:X-User", []Req{req("10.0.0.1", ""), req("10.0.0.1", "")}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b, _ := newBalancer(BalanceHash, test.hashOn)
+			targets := testTargets(t, 1, 1, 1, 1)
+			want := b.pick(test.same[0], targets, allTargets)
+			for _, r := range test.same {
+				for i := 0; i < 3; i++ {
+					if got := b.pick(r, targets, allTargets); got != want {
+						t.Fatalf("got %s, want %s", got.Addr, want.Addr)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestHashBalancerConsistent(t *testing.T) {
+	b, _ := newBalancer(BalanceHash, "header:X-User")
+	targets := testTargets(t, 1, 1, 1, 1)
+	picks := make(map[string]*Target)
+	req := func(user string) Req {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-User", user)
+		return r
+	}
+	for i := 0; i < 200; i++ {
+		user := fmt.Sprint("user", i)
+		picks[user] = b.pick(req(user), targets, allTargets)
+	}
+	// Only the keys of the unavailable target move, and they're spread over
+	// the rest
+	down := targets[0]
+	moved := make(map[*Target]bool)
+	for user, was := range picks {
+		got := b.pick(req(user), targets, func(t *Target) bool { return t != down })
+		if was != down && got != was {
+			t.Fatalf("%s moved from %s to %s", user, was.Addr, got.Addr)
+		} else if was == down {
+			moved[got] = true
+		}
+	}
+	if len(moved) < 2 {
+		t.Fatalf("keys of the unavailable target moved to %d target(s)", len(moved))
+	}
+	// Removing a target keeps the keys of the others where they were
+	for user, was := range picks {
+		if got := b.pick(req(user), targets[1:], allTargets); was != down && got != was {
+			t.Fatalf("%s moved from %s to %s after removal", user, was.Addr, got.Addr)
+		}
+	}
+}
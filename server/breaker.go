@@ -0,0 +1,224 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CircuitBreaker configures a server's circuit breaker. Failures are the same
+// as for outlier detection: failures to get a response and 5xx responses.
+type CircuitBreaker struct {
+	// FailureThreshold is the number of consecutive failures that opens the
+	// circuit. Defaults to 5.
+	FailureThreshold int `json:"failureThreshold,omitempty"`
+	// SuccessThreshold is the number of consecutive successes needed while
+	// half-open to close the circuit. Defaults to 2.
+	SuccessThreshold int `json:"successThreshold,omitempty"`
+	// CoolDown is how long the circuit stays open before letting requests
+	// through to test the server (half-open). Defaults to 30s.
+	CoolDown Duration `json:"coolDown,omitempty"`
+	// HalfOpenRequests is the max number of requests let through at once
+	// while half-open. Defaults to 1.
+	HalfOpenRequests int `json:"halfOpenRequests,omitempty"`
+}
+
+func (cb *CircuitBreaker) validate() error {
+	if cb.FailureThreshold < 0 || cb.SuccessThreshold < 0 || cb.HalfOpenRequests < 0 {
+		return fmt.Errorf("circuit breaker thresholds can't be negative")
+	} else if cb.CoolDown < 0 {
+		return fmt.Errorf("circuit breaker cool down can't be negative")
+	}
+	return nil
+}
+
+func (cb *CircuitBreaker) failureThreshold() int {
+	if cb.FailureThreshold <= 0 {
+		return 5
+	}
+	return cb.FailureThreshold
+}
+
+func (cb *CircuitBreaker) successThreshold() int {
+	if cb.SuccessThreshold <= 0 {
+		return 2
+	}
+	return cb.SuccessThreshold
+}
+
+func (cb *CircuitBreaker) coolDown() time.Duration {
+	return cb.CoolDown.Or(30 * time.Second)
+}
+
+func (cb *CircuitBreaker) halfOpenRequests() int {
+	if cb.HalfOpenRequests <= 0 {
+		return 1
+	}
+	return cb.HalfOpenRequests
+}
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets all requests through
+	BreakerClosed BreakerState = iota
+	// BreakerOpen rejects all requests
+	BreakerOpen
+	// BreakerHalfOpen lets a limited number of requests through to test if
+	// the server has recovered
+	BreakerHalfOpen
+)
+
+func (bs BreakerState) String() string {
+	switch bs {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+func (bs BreakerState) MarshalText() ([]byte, error) {
+	return []byte(bs.String()), nil
+}
+
+type breaker struct {
+	cfg  CircuitBreaker
+	path string
+
+	// Number of requests rejected and number of times opened
+	rejected, opens int64
+
+	mtx       sync.Mutex
+	state     BreakerState
+	failures  int
+	successes int
+	openedAt  time.Time
+	probes    int
+}
+
+func newBreaker(cfg CircuitBreaker, path string) *breaker {
+	return &breaker{cfg: cfg, path: path}
+}
+
+// allow returns whether a request can go through. If not, the time until
+// the circuit will be half-open is returned. If the request is allowed,
+// done must be called with the same value of probe once it's finished.
+func (b *breaker) allow() (ok, probe bool, retryAfter time.Duration) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.state == BreakerOpen {
+		if left := b.cfg.coolDown() - time.Since(b.openedAt); left > 0 {
+			atomic.AddInt64(&b.rejected, 1)
+			return false, false, left
+		}
+		b.setState(BreakerHalfOpen)
+	}
+	if b.state == BreakerHalfOpen {
+		if b.probes >= b.cfg.halfOpenRequests() {
+			atomic.AddInt64(&b.rejected, 1)
+			return false, false, time.Second
+		}
+		b.probes++
+		return true, true, 0
+	}
+	return true, false, 0
+}
+
+// done records the result of a request let through by allow. known is false
+// if the result of the request isn't known (e.g., the client went away).
+func (b *breaker) done(probe, known, failed bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if probe {
+		b.probes--
+	}
+	if !known {
+		return
+	}
+	switch b.state {
+	case BreakerClosed:
+		if !failed {
+			b.failures = 0
+		} else if b.failures++; b.failures >= b.cfg.failureThreshold() {
+			b.setState(BreakerOpen)
+		}
+	case BreakerHalfOpen:
+		// Only results from probes count when half-open
+		if !probe {
+			return
+		}
+		if failed {
+			b.setState(BreakerOpen)
+		} else if b.successes++; b.successes >= b.cfg.successThreshold() {
+			b.setState(BreakerClosed)
+		}
+	}
+}
+
+// Must be called with the lock held
+func (b *breaker) setState(state BreakerState) {
+	if b.state == state {
+		return
+	}
+	Logger.Printf("circuit breaker for %s is now %s", b.path, state)
+	b.state, b.failures, b.successes = state, 0, 0
+	if state == BreakerOpen {
+		b.openedAt = time.Now()
+		atomic.AddInt64(&b.opens, 1)
+	}
+}
+
+// BreakerStatus is the status of a server's circuit breaker.
+type BreakerStatus struct {
+	State BreakerState `json:"state"`
+	// Failures is the current number of consecutive failures while closed
+	Failures int `json:"failures,omitempty"`
+	// HalfOpenAt is when the circuit will become half-open, if it's open
+	HalfOpenAt *time.Time `json:"halfOpenAt,omitempty"`
+	Rejected   int64      `json:"rejected"`
+	Opens      int64      `json:"opens"`
+}
+
+func (b *breaker) status() BreakerStatus {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	bs := BreakerStatus{
+		State:    b.state,
+		Failures: b.failures,
+		Rejected: atomic.LoadInt64(&b.rejected),
+		Opens:    atomic.LoadInt64(&b.opens),
+	}
+	if b.state == BreakerOpen {
+		at := b.openedAt.Add(b.cfg.coolDown())
+		bs.HalfOpenAt = &at
+	}
+	return bs
+}
+
+// BreakerStatus returns the status of the server's circuit breaker. False is
+// returned if the server doesn't have one.
+func (s *Server) BreakerStatus() (BreakerStatus, bool) {
+	if s.breaker == nil {
+		return BreakerStatus{}, false
+	}
+	return s.breaker.status(), true
+}
+
+// writeRetryAfter responds with a 503 and a Retry-After header with the given
+// duration (rounded up to the second).
+func writeRetryAfter(w RW, retryAfter time.Duration, msg string) {
+	secs := int64((retryAfter + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+	http.Error(w, msg, http.StatusServiceUnavailable)
+}
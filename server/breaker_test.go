@@ -0,0 +1,114 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	// Each step is a request: whether it's let through and, if so, whether it
+	// fails. The state after the step is checked.
+	type step struct {
+		cool   bool
+		ok     bool
+		probe  bool
+		failed bool
+		state  BreakerState
+	}
+	cfg := CircuitBreaker{
+		FailureThreshold: 2,
+		SuccessThreshold: 2,
+		CoolDown:         Duration(time.Hour),
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "successes keep it closed",
+			steps: []step{
+				{ok: true, state: BreakerClosed},
+				{ok: true, failed: true, state: BreakerClosed},
+				{ok: true, state: BreakerClosed},
+				{ok: true, failed: true, state: BreakerClosed},
+			},
+		},
+		{
+			name: "consecutive failures open it",
+			steps: []step{
+				{ok: true, failed: true, state: BreakerClosed},
+				{ok: true, failed: true, state: BreakerOpen},
+				{ok: false, state: BreakerOpen},
+			},
+		},
+		{
+			name: "probes close it after cooling down",
+			steps: []step{
+				{ok: true, failed: true, state: BreakerClosed},
+				{ok: true, failed: true, state: BreakerOpen},
+				{cool: true, ok: true, probe: true, state: BreakerHalfOpen},
+				{ok: true, probe: true, state: BreakerClosed},
+			},
+		},
+		{
+			name: "failed probe opens it again",
+			steps: []step{
+				{ok: true, failed: true, state: BreakerClosed},
+				{ok: true, failed: true, state: BreakerOpen},
+				{cool: true, ok: true, probe: true, failed: true, state: BreakerOpen},
+				{ok: false, state: BreakerOpen},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := newBreaker(cfg, "test")
+			for i, s := range test.steps {
+				if s.cool {
+					b.mtx.Lock()
+					b.openedAt = time.Now().Add(-cfg.coolDown())
+					b.mtx.Unlock()
+				}
+				ok, probe, retryAfter := b.allow()
+				if ok != s.ok || probe != s.probe {
+					t.Fatalf("step %d: got ok=%v probe=%v, want ok=%v probe=%v", i, ok, probe, s.ok, s.probe)
+				} else if !ok && retryAfter <= 0 {
+					t.Fatalf("step %d: rejected without a retry after", i)
+				}
+				if ok {
+					b.done(probe, true, s.failed)
+				}
+				if state := b.status().State; state != s.state {
+					t.Fatalf("step %d: got state %s, want %s", i, state, s.state)
+				}
+			}
+		})
+	}
+}
+
+func TestBreakerHalfOpenLimit(t *testing.T) {
+	b := newBreaker(CircuitBreaker{FailureThreshold: 1, HalfOpenRequests: 2}, "test")
+	if ok, _, _ := b.allow(); !ok {
+		t.Fatal("closed breaker rejected request")
+	}
+	b.done(false, true, true)
+	b.mtx.Lock()
+	b.openedAt = time.Now().Add(-b.cfg.coolDown())
+	b.mtx.Unlock()
+	for i := 0; i < 2; i++ {
+		if ok, probe, _ := b.allow(); !ok || !probe {
+			t.Fatalf("probe %d: got ok=%v probe=%v", i, ok, probe)
+		}
+	}
+	if ok, _, _ := b.allow(); ok {
+		t.Fatal("let through more probes than allowed")
+	}
+	// A probe whose result isn't known frees its slot without counting
+	b.done(true, false, false)
+	if ok, probe, _ := b.allow(); !ok || !probe {
+		t.Fatalf("got ok=%v probe=%v after a probe finished", ok, probe)
+	}
+	if state := b.status().State; state != BreakerHalfOpen {
+		t.Fatalf("got state %s, want %s", state, BreakerHalfOpen)
+	}
+}
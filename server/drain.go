@@ -0,0 +1,193 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// drainState tracks a server's in-flight requests (including upgraded
+// connections) so the server can be drained before being removed.
+type drainState struct {
+	mtx      sync.Mutex
+	active   int
+	draining bool
+	deadline time.Time
+	// Closed once the server is draining and there are no active requests
+	idle    chan struct{}
+	nextID  uint64
+	cancels map[uint64]context.CancelFunc
+}
+
+func newDrainState() *drainState {
+	return &drainState{
+		idle:    make(chan struct{}),
+		cancels: make(map[uint64]context.CancelFunc),
+	}
+}
+
+// enter registers a request, returning the request to serve and the function
+// to call once it's done. False is returned if the server is draining.
+func (d *drainState) enter(r Req) (Req, func(), bool) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.draining {
+		return r, nil, false
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	id := d.nextID
+	d.nextID++
+	d.active++
+	d.cancels[id] = cancel
+	return r.WithContext(ctx), func() { d.leave(id) }, true
+}
+
+func (d *drainState) leave(id uint64) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if cancel, ok := d.cancels[id]; ok {
+		cancel()
+		delete(d.cancels, id)
+	}
+	d.active--
+	if d.draining && d.active == 0 {
+		close(d.idle)
+	}
+}
+
+// activeRequests returns the number of requests in flight.
+func (d *drainState) activeRequests() int {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return d.active
+}
+
+// retryAfter returns how long until the server will have finished draining.
+func (d *drainState) retryAfter() time.Duration {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	return time.Until(d.deadline)
+}
+
+// drain stops new requests from being accepted and waits for the active ones
+// to finish. If the context is done first, the active requests are cancelled
+// and the number of them is returned along with the context's error.
+func (d *drainState) drain(ctx context.Context) (int, error) {
+	d.mtx.Lock()
+	if d.draining {
+		d.mtx.Unlock()
+		return 0, nil
+	}
+	d.draining = true
+	if deadline, ok := ctx.Deadline(); ok {
+		d.deadline = deadline
+	}
+	if d.active == 0 {
+		close(d.idle)
+	}
+	d.mtx.Unlock()
+	select {
+	case <-d.idle:
+		return 0, nil
+	case <-ctx.Done():
+	}
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	for _, cancel := range d.cancels {
+		cancel()
+	}
+	return d.active, ctx.Err()
+}
+
+func (s *Server) drainTimeout() time.Duration {
+	return s.DrainTimeout.Or(30 * time.Second)
+}
+
+// ActiveRequests returns the number of requests the server is handling.
+func (s *Server) ActiveRequests() int {
+	if s.drain == nil {
+		return 0
+	}
+	return s.drain.activeRequests()
+}
+
+// Draining returns whether the server is being drained.
+func (s *Server) Draining() bool {
+	if s.drain == nil {
+		return false
+	}
+	s.drain.mtx.Lock()
+	defer s.drain.mtx.Unlock()
+	return s.drain.draining
+}
+
+// unroute moves the server from the router's routes to draining. False is
+// returned if it had already been removed, in which case whatever removed it
+// drains it.
+func (router *Router) unroute(s *Server) bool {
+	cur, ok := router.routes.LoadAndDelete(s.Path)
+	if !ok {
+		return false
+	} else if cur != s {
+		// It was replaced in the meantime so put the replacement back
+		router.routes.LoadOrStore(s.Path, cur)
+		return false
+	}
+	router.draining.Store(s.Path, s)
+	return true
+}
+
+// drainServer drains a server that's been removed from the router's routes,
+// stopping the server once it's done. Until then, requests to the server's
+// path get a 503 unless a replacement is added. The server's drain timeout is
+// used if the context doesn't have a shorter deadline.
+func (router *Router) drainServer(ctx context.Context, s *Server) {
+	router.draining.Store(s.Path, s)
+	ctx, cancel := context.WithTimeout(ctx, s.drainTimeout())
+	defer cancel()
+	if s.drain != nil {
+		if n, err := s.drain.drain(ctx); err != nil {
+			Logger.Printf("cancelled %d requests to %s after draining: %v", n, s.Path, err)
+		}
+	}
+	s.stop()
+	// Services share the conn of their tunnel's server
+	if s.isTunnel && s.tunnelConn != nil {
+		s.tunnelConn.Close()
+	}
+	if cur, ok := router.draining.Load(s.Path); ok && cur == s {
+		router.draining.Delete(s.Path)
+	}
+	Logger.Printf("removed server %s", s.Path)
+}
+
+// serveDraining responds to a request to a server being drained.
+func (router *Router) serveDraining(w RW, s *Server) {
+	retryAfter := time.Second
+	if s.drain != nil {
+		if left := s.drain.retryAfter(); left > retryAfter {
+			retryAfter = left
+		}
+	}
+	writeRetryAfter(w, retryAfter, "Server draining")
+}
+
+// Shutdown drains all of the router's servers, waiting until they're done or
+// the context is done. New requests to the servers get a 503 in the meantime.
+// The listeners aren't closed.
+func (router *Router) Shutdown(ctx context.Context) error {
+	var wg sync.WaitGroup
+	router.routes.Range(func(_ string, s *Server) bool {
+		if !router.unroute(s) {
+			return true
+		}
+		wg.Add(1)
+		go func(s *Server) {
+			defer wg.Done()
+			router.drainServer(ctx, s)
+		}(s)
+		return true
+	})
+	wg.Wait()
+	return ctx.Err()
+}
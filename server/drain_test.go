@@ -0,0 +1,156 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDrainState(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		// How long the active request takes, -1 for no active request and 0 for
+		// one that doesn't finish
+		request   time.Duration
+		cancelled int
+		err       error
+	}{
+		{"idle", time.Second, -1, 0, nil},
+		{"finishes in time", time.Second, 20 * time.Millisecond, 0, nil},
+		{"cancelled after timeout", 20 * time.Millisecond, 0, 1, context.DeadlineExceeded},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := newDrainState()
+			var reqCtx context.Context
+			if test.request >= 0 {
+				r, leave, ok := d.enter(httptest.NewRequest(http.MethodGet, "/", nil))
+				if !ok {
+					t.Fatal("request not let in")
+				}
+				reqCtx = r.Context()
+				if test.request > 0 {
+					time.AfterFunc(test.request, leave)
+				}
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), test.timeout)
+			defer cancel()
+			if n, err := d.drain(ctx); n != test.cancelled || !errors.Is(err, test.err) {
+				t.Fatalf("got %d cancelled with %v, want %d with %v", n, err, test.cancelled, test.err)
+			}
+			if test.cancelled != 0 && reqCtx.Err() == nil {
+				t.Fatal("active request wasn't cancelled")
+			}
+			if _, _, ok := d.enter(httptest.NewRequest(http.MethodGet, "/", nil)); ok {
+				t.Fatal("request let in while draining")
+			}
+		})
+	}
+}
+
+func TestDeleteServerDrains(t *testing.T) {
+	release, entered := make(chan struct{}), make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w RW, r Req) {
+		if r.URL.Path == "/slow" {
+			entered <- struct{}{}
+			<-release
+		}
+	}))
+	defer upstream.Close()
+	router := NewRouterHandler()
+	s := &Server{Name: "s", Path: "s", Addr: upstream.URL}
+	if err := s.AddTargetsProxy(); err != nil {
+		t.Fatal(err)
+	} else if err := router.AddServer(s); err != nil {
+		t.Fatal(err)
+	}
+	serve := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	var inFlight *httptest.ResponseRecorder
+	go func() {
+		defer wg.Done()
+		inFlight = serve("/s/slow")
+	}()
+	<-entered
+	if err := router.DeleteServer(s); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "draining", func() bool {
+		_, ok := router.draining.Load("s")
+		return ok
+	})
+	if w := serve("/s/"); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("got %d with Retry-After %q while draining", w.Code, w.Header().Get("Retry-After"))
+	}
+	close(release)
+	wg.Wait()
+	if inFlight.Code != http.StatusOK {
+		t.Fatalf("in-flight request got %d", inFlight.Code)
+	}
+	waitFor(t, "drained", func() bool {
+		_, ok := router.draining.Load("s")
+		return !ok
+	})
+	if w := serve("/s/"); w.Code != http.StatusNotFound {
+		t.Fatalf("got %d once drained", w.Code)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(RW, Req) {}))
+	defer upstream.Close()
+	router := NewRouterHandler()
+	for _, path := range []string{"a", "b"} {
+		s := &Server{Name: path, Path: path, Addr: upstream.URL}
+		if err := s.AddTargetsProxy(); err != nil {
+			t.Fatal(err)
+		} else if err := router.AddServer(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := router.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	} else if servers := router.GetServers(); len(servers) != 0 {
+		t.Fatalf("%d servers left after shutdown", len(servers))
+	}
+}
+
+func TestDeleteServerConcurrent(t *testing.T) {
+	router := NewRouterHandler()
+	s := &Server{Name: "s", Path: "s", Addr: "http://127.0.0.1:1"}
+	if err := s.AddTargetsProxy(); err != nil {
+		t.Fatal(err)
+	} else if err := router.AddServer(s); err != nil {
+		t.Fatal(err)
+	}
+	const n = 8
+	var wg sync.WaitGroup
+	var deleted int32
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if router.DeleteServer(s) == nil {
+				atomic.AddInt32(&deleted, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if deleted != 1 {
+		t.Fatalf("server deleted %d times", deleted)
+	}
+}
@@ -0,0 +1,351 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Version of the tunnel protocol. Version 1 is the handshake of a header
+// followed by the server's JSON, which is still accepted from older tunnels.
+const tunnelProtocolVersion = 2
+
+// Capabilities tunnel peers can negotiate
+const (
+	// capMux means requests are multiplexed over the tunnel's conn rather than
+	// sent over conns the tunnel dials back
+	capMux = "mux"
+	// capHeartbeat means the peer answers pings
+	capHeartbeat = "heartbeat"
+	// capServices means the tunnel can register more servers over the session
+	// with control messages
+	capServices = "services"
+	// capTCP means the tunnel can register TCP services
+	capTCP = "tcp"
+	// capUDP means the tunnel can register UDP services
+	capUDP = "udp"
+)
+
+// Capabilities supported by this version
+var tunnelCapabilities = []string{capMux, capHeartbeat, capServices, capTCP, capUDP}
+
+// Types of frames sent during a tunnel handshake. Each frame is the type (1
+// byte), the payload length (4 bytes) and then the JSON payload.
+const (
+	// hsHello is sent by the tunnel to start the handshake (tunnelHello)
+	hsHello byte = iota + 1
+	// hsChallenge asks the tunnel for its credentials (tunnelChallenge)
+	hsChallenge
+	// hsAuth answers a challenge (tunnelAuthResponse)
+	hsAuth
+	// hsWelcome means the tunnel was registered (tunnelWelcome)
+	hsWelcome
+	// hsError means the handshake failed (tunnelHandshakeError)
+	hsError
+)
+
+const (
+	hsHeaderLen  = 5
+	hsMaxPayload = 64 << 10
+	// Max time the handshake can take
+	tunnelHandshakeTimeout = 30 * time.Second
+)
+
+// Codes of handshake errors
+const (
+	hsErrBadMessage    = "bad-message"
+	hsErrAlreadyExists = "already-exists"
+	hsErrUnauthorized  = "unauthorized"
+	hsErrVersion       = "unsupported-version"
+)
+
+var (
+	errHandshakeUnsupported = fmt.Errorf("tunneled-to server doesn't support the tunnel handshake")
+	errTunnelExists         = fmt.Errorf("name or path already exists on tunneled-to server")
+)
+
+type tunnelHello struct {
+	Version      int      `json:"version"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	Server       *Server  `json:"server"`
+	// Takeover is the token of a previous session of the tunnel, which lets
+	// it replace the session's registration if it's still there
+	Takeover []byte `json:"takeover,omitempty"`
+}
+
+type tunnelChallenge struct {
+	Nonce []byte `json:"nonce"`
+}
+
+type tunnelWelcome struct {
+	Version int `json:"version"`
+	// Capabilities supported by both sides
+	Capabilities []string `json:"capabilities,omitempty"`
+	// Secret is the secret dialed-back conns must send, if the tunnel was
+	// authenticated
+	Secret []byte `json:"secret,omitempty"`
+	// Takeover is the token the tunnel can send when reconnecting to replace
+	// the session's registration
+	Takeover []byte `json:"takeover,omitempty"`
+}
+
+type tunnelHandshakeError struct {
+	Code    string `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func (he tunnelHandshakeError) toError() *TunnelError {
+	header := HeaderNothing
+	switch he.Code {
+	case hsErrBadMessage:
+		header = HeaderBadMessage
+	case hsErrAlreadyExists:
+		header = HeaderAlreadyExists
+	case hsErrUnauthorized:
+		header = HeaderUnauthorized
+	}
+	return newTunnelError(header, he.Message)
+}
+
+func writeHandshakeFrame(w io.Writer, typ byte, v any) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	// End with a newline so that older servers see a malformed HTTP request
+	// line and respond right away rather than waiting for the rest of it
+	payload = append(payload, '\n')
+	buf := make([]byte, hsHeaderLen, hsHeaderLen+len(payload))
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(payload)))
+	_, err = w.Write(append(buf, payload...))
+	return err
+}
+
+// readHandshakeFrame reads a frame, returning its type and payload. Error
+// frames are returned as a *TunnelError.
+func readHandshakeFrame(r io.Reader) (byte, []byte, error) {
+	var hdr [hsHeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	typ, n := hdr[0], binary.BigEndian.Uint32(hdr[1:])
+	if typ < hsHello || typ > hsError {
+		// Older servers respond with HTTP
+		return 0, nil, errHandshakeUnsupported
+	} else if n > hsMaxPayload {
+		return 0, nil, fmt.Errorf("tunnel handshake frame too large: %d bytes", n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	if typ == hsError {
+		var he tunnelHandshakeError
+		if err := json.Unmarshal(payload, &he); err != nil {
+			return 0, nil, err
+		}
+		return typ, nil, he.toError()
+	}
+	return typ, payload, nil
+}
+
+func hasCap(caps []string, c string) bool {
+	for _, cap := range caps {
+		if cap == c {
+			return true
+		}
+	}
+	return false
+}
+
+// commonCaps returns the capabilities supported by this version that are in
+// caps.
+func commonCaps(caps []string) []string {
+	var common []string
+	for _, c := range tunnelCapabilities {
+		if hasCap(caps, c) {
+			common = append(common, c)
+		}
+	}
+	return common
+}
+
+// tunneledServer returns the server a tunnel registers from the one it sent.
+// Only its name, path and whether it's hidden are used; the rest of its config
+// (timeouts, transport, limits, etc.) is up to this router and ignored.
+func tunneledServer(s *Server) *Server {
+	return &Server{Name: s.Name, Path: s.Path, Addr: "tunnel", Hidden: s.Hidden}
+}
+
+// handleHello handles a tunnel registering with the framed handshake.
+func (router *Router) handleHello(bc BufConn) {
+	fail := func(code, msg string) {
+		writeHandshakeFrame(bc, hsError, tunnelHandshakeError{Code: code, Message: msg})
+		bc.Close()
+	}
+	// Get rid of the header still in the buffer
+	if _, err := io.ReadFull(bc, make([]byte, 4)); err != nil {
+		bc.Close()
+		return
+	}
+	typ, payload, err := readHandshakeFrame(bc)
+	if err != nil {
+		Logger.Printf("error reading tunnel hello: %v", err)
+		bc.Close()
+		return
+	} else if typ != hsHello {
+		fail(hsErrBadMessage, "expected hello")
+		return
+	}
+	var hello tunnelHello
+	if err := json.Unmarshal(payload, &hello); err != nil {
+		fail(hsErrBadMessage, "bad hello")
+		return
+	} else if hello.Version < tunnelProtocolVersion {
+		fail(hsErrVersion, fmt.Sprintf("unsupported version %d", hello.Version))
+		return
+	}
+	if hello.Server == nil || hello.Server.Name == "" || hello.Server.Path == "" {
+		fail(hsErrBadMessage, "bad name or path")
+		return
+	}
+	s := tunneledServer(hello.Server)
+	secret, cred, err := router.authTunnel(s.Path, func(nonce []byte) (tunnelAuthResponse, error) {
+		var resp tunnelAuthResponse
+		err := writeHandshakeFrame(bc, hsChallenge, tunnelChallenge{Nonce: nonce})
+		if err != nil {
+			return resp, err
+		}
+		typ, payload, err := readHandshakeFrame(bc)
+		if err != nil {
+			return resp, err
+		} else if typ == hsAuth {
+			// A bad response fails the check
+			json.Unmarshal(payload, &resp)
+		}
+		return resp, nil
+	})
+	if err == errTunnelUnauthorized {
+		fail(hsErrUnauthorized, err.Error())
+		return
+	} else if err != nil {
+		bc.Close()
+		return
+	}
+	bc.SetReadDeadline(time.Time{})
+	s.tunnelCred = cred
+	s.tunnelTakeover = make([]byte, tunnelSecretLen)
+	if _, err := rand.Read(s.tunnelTakeover); err != nil {
+		Logger.Printf("error generating tunnel takeover token: %v", err)
+		bc.Close()
+		return
+	}
+	caps := commonCaps(hello.Capabilities)
+	router.registerTunnel(bc, s, secret, caps, hello.Takeover, func(err error) {
+		if err == errTunnelExists {
+			fail(hsErrAlreadyExists, err.Error())
+		} else if err != nil {
+			fail(hsErrBadMessage, err.Error())
+		} else {
+			writeHandshakeFrame(bc, hsWelcome, tunnelWelcome{
+				Version:      tunnelProtocolVersion,
+				Capabilities: caps,
+				Secret:       secret,
+				Takeover:     s.tunnelTakeover,
+			})
+		}
+	})
+}
+
+// tunnelLink is a tunnel's connection to the tunneled-to proxy.
+type tunnelLink struct {
+	conn net.Conn
+	// Set if requests are multiplexed over the conn
+	mux *muxSession
+	// Secret dialed-back conns must send, if the tunnel was authenticated
+	secret  []byte
+	version int
+	caps    []string
+	// Token used to take over the session's registration when reconnecting
+	takeover []byte
+
+	// Control messages waiting for their results
+	ctlMtx  sync.Mutex
+	ctlSeq  uint32
+	pending map[uint32]chan tunnelControl
+}
+
+// helloTunnel connects to the tunneled-to proxy with the framed handshake.
+// takeover is the token of the tunnel's previous session, if any.
+func helloTunnel(tc TunnelConfig, s *Server, takeover []byte) (*tunnelLink, error) {
+	c, err := tc.dial()
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(tunnelHandshakeTimeout))
+	link, err := clientHello(c, tc, s, takeover)
+	if err != nil {
+		c.Close()
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			// Older servers close conns they don't understand over TLS
+			err = errHandshakeUnsupported
+		}
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	return link, nil
+}
+
+func clientHello(c net.Conn, tc TunnelConfig, s *Server, takeover []byte) (*tunnelLink, error) {
+	hello := tunnelHello{
+		Version:      tunnelProtocolVersion,
+		Capabilities: tunnelCapabilities,
+		Server:       s,
+		Takeover:     takeover,
+	}
+	if _, err := c.Write(headerHelloBytes); err != nil {
+		return nil, err
+	} else if err := writeHandshakeFrame(c, hsHello, hello); err != nil {
+		return nil, err
+	}
+	typ, payload, err := readHandshakeFrame(c)
+	if err != nil {
+		return nil, err
+	}
+	if typ == hsChallenge {
+		var ch tunnelChallenge
+		if err := json.Unmarshal(payload, &ch); err != nil {
+			return nil, err
+		}
+		resp, err := tc.authResponse(ch.Nonce, s.Path)
+		if err != nil {
+			return nil, err
+		} else if err := writeHandshakeFrame(c, hsAuth, resp); err != nil {
+			return nil, err
+		}
+		if typ, payload, err = readHandshakeFrame(c); err != nil {
+			return nil, err
+		}
+	}
+	if typ != hsWelcome {
+		return nil, newTunnelError(HeaderNothing, "unexpected tunnel handshake frame")
+	}
+	var welcome tunnelWelcome
+	if err := json.Unmarshal(payload, &welcome); err != nil {
+		return nil, err
+	}
+	return &tunnelLink{
+		conn:     c,
+		secret:   welcome.Secret,
+		version:  welcome.Version,
+		caps:     welcome.Capabilities,
+		takeover: welcome.Takeover,
+	}, nil
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandshakeFrames(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  []byte
+		typ  byte
+		err  string
+		// Header of the *TunnelError returned, if any
+		header uint32
+	}{
+		{
+			name: "hello",
+			raw: func() []byte {
+				var buf bytes.Buffer
+				writeHandshakeFrame(&buf, hsHello, tunnelHello{Version: tunnelProtocolVersion})
+				return buf.Bytes()
+			}(),
+			typ: hsHello,
+		},
+		{
+			name: "error",
+			raw: func() []byte {
+				var buf bytes.Buffer
+				writeHandshakeFrame(&buf, hsError, tunnelHandshakeError{Code: hsErrUnauthorized})
+				return buf.Bytes()
+			}(),
+			header: HeaderUnauthorized,
+		},
+		{
+			name: "http response from older server",
+			raw:  []byte("HTTP/1.1 400 Bad Request\r\n\r\n"),
+			err:  errHandshakeUnsupported.Error(),
+		},
+		{
+			name: "too large",
+			raw:  []byte{hsHello, 0xFF, 0xFF, 0xFF, 0xFF},
+			err:  "too large",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			typ, _, err := readHandshakeFrame(bytes.NewReader(test.raw))
+			var te *TunnelError
+			switch {
+			case test.header != 0:
+				if !errors.As(err, &te) || te.header != test.header {
+					t.Fatalf("got %v, want tunnel error with header %x", err, test.header)
+				}
+			case test.err != "":
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got %v, want error containing %q", err, test.err)
+				}
+			default:
+				if err != nil || typ != test.typ {
+					t.Fatalf("got type %d with %v, want %d", typ, err, test.typ)
+				}
+			}
+		})
+	}
+}
+
+func TestCommonCaps(t *testing.T) {
+	tests := []struct {
+		name string
+		caps []string
+		want []string
+	}{
+		{"none", nil, nil},
+		{"unknown ignored", []string{"future", capMux}, []string{capMux}},
+		{"in our order", []string{capUDP, capMux, capHeartbeat}, []string{capMux, capHeartbeat, capUDP}},
+		{"all", tunnelCapabilities, tunnelCapabilities},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := commonCaps(test.caps); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	auth := &TunnelAuth{Credentials: []TunnelCredential{
+		{ID: "tok", Token: "token", Paths: []string{"t"}},
+		{ID: "mac", Secret: "secret", PathPrefix: "m"},
+	}}
+	tests := []struct {
+		name string
+		auth *TunnelAuth
+		tc   TunnelConfig
+		path string
+		// Path registered before the tunnel connects, if any
+		taken string
+		// Header of the *TunnelError returned, 0 if it should succeed
+		header uint32
+	}{
+		{name: "no auth", path: "t"},
+		{name: "token", auth: auth, tc: TunnelConfig{CredentialID: "tok", Token: "token"}, path: "t"},
+		{name: "hmac", auth: auth, tc: TunnelConfig{CredentialID: "mac", Secret: "secret"}, path: "mine"},
+		{
+			name:   "wrong token",
+			auth:   auth,
+			tc:     TunnelConfig{CredentialID: "tok", Token: "nope"},
+			path:   "t",
+			header: HeaderUnauthorized,
+		},
+		{
+			name:   "path not allowed",
+			auth:   auth,
+			tc:     TunnelConfig{CredentialID: "tok", Token: "token"},
+			path:   "other",
+			header: HeaderUnauthorized,
+		},
+		{name: "path taken", path: "t", taken: "t", header: HeaderAlreadyExists},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			router, err := NewRouterWithListeners()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer router.Close()
+			if err := router.SetTunnelAuth(test.auth); err != nil {
+				t.Fatal(err)
+			}
+			if test.taken != "" {
+				s := &Server{Name: test.taken, Path: test.taken, Addr: "http://127.0.0.1:1"}
+				if err := s.AddTargetsProxy(); err != nil {
+					t.Fatal(err)
+				} else if err := router.AddServer(s); err != nil {
+					t.Fatal(err)
+				}
+			}
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+			go router.handleHello(NewBufConn(c2))
+			link, err := clientHello(c1, test.tc, &Server{Name: test.path, Path: test.path}, nil)
+			if test.header != 0 {
+				var te *TunnelError
+				if !errors.As(err, &te) || te.header != test.header {
+					t.Fatalf("got %v, want tunnel error with header %x", err, test.header)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if link.version != tunnelProtocolVersion || !reflect.DeepEqual(link.caps, tunnelCapabilities) {
+				t.Fatalf("negotiated version %d with %v", link.version, link.caps)
+			} else if (test.auth != nil) != (len(link.secret) == tunnelSecretLen) {
+				t.Fatalf("got secret of %d bytes with auth %v", len(link.secret), test.auth != nil)
+			} else if len(link.takeover) == 0 {
+				t.Fatal("no takeover token")
+			}
+			if s, ok := router.routes.Load(test.path); !ok || !s.isTunnel {
+				t.Fatalf("tunnel not registered on %s", test.path)
+			}
+		})
+	}
+}
+
+func TestHandshakeOldVersion(t *testing.T) {
+	router, err := NewRouterWithListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	go router.handleHello(NewBufConn(c2))
+	go func() {
+		c1.Write(headerHelloBytes)
+		writeHandshakeFrame(c1, hsHello, tunnelHello{
+			Version: tunnelProtocolVersion - 1,
+			Server:  &Server{Name: "t", Path: "t"},
+		})
+	}()
+	_, _, err = readHandshakeFrame(c1)
+	var te *TunnelError
+	if !errors.As(err, &te) || te.msg == "" {
+		t.Fatalf("got %v, want an unsupported version error", err)
+	}
+}
+
+func TestHandshakeIgnoresServerConfig(t *testing.T) {
+	// Everything but the name, path and whether it's hidden is up to the
+	// tunneled-to router
+	sent := &Server{
+		Name:         "t",
+		Path:         "t",
+		Addr:         "http://127.0.0.1:1",
+		Hidden:       true,
+		Timeouts:     &Timeouts{Streaming: true},
+		Transport:    &TransportConfig{},
+		DrainTimeout: Duration(time.Hour),
+		Breaker:      &CircuitBreaker{},
+		Concurrency:  &ConcurrencyLimit{},
+		Adaptive:     &AdaptiveConcurrency{},
+	}
+	tests := []struct {
+		name  string
+		hello func(c net.Conn) error
+	}{
+		{"framed", func(c net.Conn) error {
+			_, err := clientHello(c, TunnelConfig{}, sent, nil)
+			return err
+		}},
+		{"legacy", func(c net.Conn) error {
+			_, err := legacyHandshake(c, TunnelConfig{}, sent, false)
+			return err
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			router, err := NewRouterWithListeners()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer router.Close()
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+			go func() {
+				bc := NewBufConn(c2)
+				h, err := bc.Peek(4)
+				if err != nil {
+					return
+				}
+				router.handleTunnel(bc, getHeader(h))
+			}()
+			if err := test.hello(c1); err != nil {
+				t.Fatal(err)
+			}
+			s, ok := router.routes.Load("t")
+			if !ok {
+				t.Fatal("tunnel not registered")
+			}
+			if s.Name != "t" || s.Addr != "tunnel" || !s.Hidden ||
+				s.Timeouts != nil || s.Transport != nil || s.DrainTimeout != 0 ||
+				s.Breaker != nil || s.Concurrency != nil || s.Adaptive != nil {
+				t.Fatalf("registered %+v", s)
+			}
+		})
+	}
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HealthCheck configures active health checking of a server's targets.
+type HealthCheck struct {
+	// Type is either "http" (default) or "tcp". TCP checks only check that a
+	// connection can be made.
+	Type string `json:"type,omitempty"`
+	// Path is the path requested by HTTP checks. Defaults to "/".
+	Path string `json:"path,omitempty"`
+	// Interval is the time between checks. Defaults to 10s.
+	Interval Duration `json:"interval,omitempty"`
+	// Timeout is how long a check has to succeed. Defaults to 2s.
+	Timeout Duration `json:"timeout,omitempty"`
+	// ExpectStatus is the status HTTP checks must get back. Any 2xx or 3xx
+	// status is accepted if 0.
+	ExpectStatus int `json:"expectStatus,omitempty"`
+	// HealthyThreshold is the number of consecutive passes needed for an
+	// unhealthy target to become healthy. Defaults to 2.
+	HealthyThreshold int `json:"healthyThreshold,omitempty"`
+	// UnhealthyThreshold is the number of consecutive failures needed for a
+	// healthy target to become unhealthy. Defaults to 3.
+	UnhealthyThreshold int `json:"unhealthyThreshold,omitempty"`
+}
+
+func (hc *HealthCheck) validate() error {
+	switch hc.Type {
+	case "", "http", "tcp":
+	default:
+		return fmt.Errorf("invalid health check type: %s", hc.Type)
+	}
+	if hc.Interval < 0 || hc.Timeout < 0 {
+		return fmt.Errorf("health check interval and timeout can't be negative")
+	} else if hc.HealthyThreshold < 0 || hc.UnhealthyThreshold < 0 {
+		return fmt.Errorf("health check thresholds can't be negative")
+	}
+	return nil
+}
+
+func (hc *HealthCheck) interval() time.Duration {
+	return hc.Interval.Or(10 * time.Second)
+}
+
+func (hc *HealthCheck) timeout() time.Duration {
+	return hc.Timeout.Or(2 * time.Second)
+}
+
+func (hc *HealthCheck) healthyThreshold() int {
+	if hc.HealthyThreshold <= 0 {
+		return 2
+	}
+	return hc.HealthyThreshold
+}
+
+func (hc *HealthCheck) unhealthyThreshold() int {
+	if hc.UnhealthyThreshold <= 0 {
+		return 3
+	}
+	return hc.UnhealthyThreshold
+}
+
+// targetHealth holds the results of a target's health checks.
+type targetHealth struct {
+	unhealthy int32
+
+	mtx       sync.Mutex
+	passes    int
+	fails     int
+	lastCheck time.Time
+	lastErr   error
+}
+
+// Healthy returns whether the target is passing its health checks. Targets
+// are healthy until they've failed enough checks.
+func (t *Target) Healthy() bool {
+	return atomic.LoadInt32(&t.health.unhealthy) == 0
+}
+
+// LastHealthCheck returns the time of the last health check and the error it
+// failed with (if it did).
+func (t *Target) LastHealthCheck() (time.Time, error) {
+	t.health.mtx.Lock()
+	defer t.health.mtx.Unlock()
+	return t.health.lastCheck, t.health.lastErr
+}
+
+// record records the result of a check, returning true if the health of the
+// target changed.
+func (th *targetHealth) record(hc *HealthCheck, err error) bool {
+	th.mtx.Lock()
+	defer th.mtx.Unlock()
+	th.lastCheck, th.lastErr = time.Now(), err
+	if err != nil {
+		th.passes = 0
+		th.fails++
+		if th.fails >= hc.unhealthyThreshold() {
+			return atomic.CompareAndSwapInt32(&th.unhealthy, 0, 1)
+		}
+	} else {
+		th.fails = 0
+		th.passes++
+		if th.passes >= hc.healthyThreshold() {
+			return atomic.CompareAndSwapInt32(&th.unhealthy, 1, 0)
+		}
+	}
+	return false
+}
+
+// healthChecker periodically checks each of a server's targets.
+type healthChecker struct {
+	srvr   *Server
+	hc     HealthCheck
+	client *http.Client
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newHealthChecker(s *Server) *healthChecker {
+	hc := *s.HealthCheck
+	return &healthChecker{
+		srvr: s,
+		hc:   hc,
+		client: &http.Client{
+			Transport: s.transport,
+			// Checks shouldn't follow redirects so they can be checked for
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		done: make(chan struct{}),
+	}
+}
+
+func (h *healthChecker) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	h.cancel = cancel
+	go h.run(ctx)
+}
+
+func (h *healthChecker) stop() {
+	// Servers that were never added to a router were never started
+	if h.cancel == nil {
+		return
+	}
+	h.cancel()
+	<-h.done
+}
+
+func (h *healthChecker) run(ctx context.Context) {
+	defer close(h.done)
+	ticker := time.NewTicker(h.hc.interval())
+	defer ticker.Stop()
+	for {
+		h.checkAll(ctx)
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (h *healthChecker) checkAll(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, t := range h.srvr.pool.getTargets() {
+		wg.Add(1)
+		go func(t *Target) {
+			defer wg.Done()
+			err := h.check(ctx, t)
+			if ctx.Err() != nil {
+				return
+			}
+			if t.health.record(&h.hc, err) {
+				if t.Healthy() {
+					Logger.Printf("target %s of %s is now healthy", t.Addr, h.srvr.Path)
+				} else {
+					Logger.Printf(
+						"target %s of %s is now unhealthy: %v",
+						t.Addr, h.srvr.Path, err,
+					)
+				}
+			}
+		}(t)
+	}
+	wg.Wait()
+}
+
+func (h *healthChecker) check(ctx context.Context, t *Target) error {
+	ctx, cancel := context.WithTimeout(ctx, h.hc.timeout())
+	defer cancel()
+	if h.hc.Type == "tcp" {
+		var d net.Dialer
+		c, err := d.DialContext(ctx, "tcp", targetHostPort(t.url))
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	}
+	path := h.hc.Path
+	if path == "" {
+		path = "/"
+	}
+	u := *t.url
+	u.Path, u.RawPath, u.RawQuery = singleJoiningSlash(t.url.Path, path), "", ""
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", "gory-proxy-health-check")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if h.hc.ExpectStatus != 0 {
+		if resp.StatusCode != h.hc.ExpectStatus {
+			return fmt.Errorf("expected status %d, got %d", h.hc.ExpectStatus, resp.StatusCode)
+		}
+	} else if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("got status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// targetHostPort returns the host and port of the URL, using the default
+// port for the scheme if there isn't one.
+func targetHostPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return u.Host
+	} else if u.Scheme == "https" {
+		return net.JoinHostPort(u.Hostname(), "443")
+	}
+	return net.JoinHostPort(u.Hostname(), "80")
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTargetHealthRecord(t *testing.T) {
+	tests := []struct {
+		name string
+		hc   HealthCheck
+		// Results of the checks, true for a pass
+		checks []bool
+		// Whether each check changed the target's health
+		changed []bool
+		healthy bool
+	}{
+		{
+			name:    "passing",
+			checks:  []bool{true, true, true},
+			changed: []bool{false, false, false},
+			healthy: true,
+		},
+		{
+			name:    "fails past default threshold",
+			checks:  []bool{false, false, false, false},
+			changed: []bool{false, false, true, false},
+		},
+		{
+			name:    "pass resets fails",
+			checks:  []bool{false, false, true, false, false},
+			changed: []bool{false, false, false, false, false},
+			healthy: true,
+		},
+		{
+			name:    "recovers after default threshold",
+			checks:  []bool{false, false, false, true, true},
+			changed: []bool{false, false, true, false, true},
+			healthy: true,
+		},
+		{
+			name:    "fail resets passes",
+			checks:  []bool{false, false, false, true, false, true},
+			changed: []bool{false, false, true, false, false, false},
+		},
+		{
+			name:    "custom thresholds",
+			hc:      HealthCheck{HealthyThreshold: 1, UnhealthyThreshold: 1},
+			checks:  []bool{false, true},
+			changed: []bool{true, true},
+			healthy: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target := &Target{}
+			for i, pass := range test.checks {
+				var err error
+				if !pass {
+					err = context.DeadlineExceeded
+				}
+				if changed := target.health.record(&test.hc, err); changed != test.changed[i] {
+					t.Fatalf("check %d: got changed %v", i, changed)
+				}
+			}
+			if target.Healthy() != test.healthy {
+				t.Fatalf("got healthy %v", target.Healthy())
+			}
+		})
+	}
+}
+
+func TestHealthCheckTarget(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w RW, r Req) {
+		switch r.URL.Path {
+		case "/base/ok":
+			w.WriteHeader(http.StatusOK)
+		case "/base/redirect":
+			http.Redirect(w, r, "/elsewhere", http.StatusFound)
+		case "/base/slow":
+			time.Sleep(200 * time.Millisecond)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+	// A port nothing is listening on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := ln.Addr().String()
+	ln.Close()
+
+	tests := []struct {
+		name string
+		addr string
+		hc   HealthCheck
+		err  bool
+	}{
+		{"ok", ts.URL + "/base", HealthCheck{Path: "/ok"}, false},
+		{"redirect accepted", ts.URL + "/base", HealthCheck{Path: "/redirect"}, false},
+		{"bad status", ts.URL + "/base", HealthCheck{Path: "/down"}, true},
+		{"expected status", ts.URL + "/base", HealthCheck{Path: "/down", ExpectStatus: 503}, false},
+		{"unexpected status", ts.URL + "/base", HealthCheck{Path: "/ok", ExpectStatus: 204}, true},
+		{
+			"timeout",
+			ts.URL + "/base",
+			HealthCheck{Path: "/slow", Timeout: Duration(50 * time.Millisecond)},
+			true,
+		},
+		{"connection refused", "http://" + closedAddr, HealthCheck{}, true},
+		{"tcp", ts.URL, HealthCheck{Type: "tcp"}, false},
+		{"tcp refused", "http://" + closedAddr, HealthCheck{Type: "tcp"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			target, err := NewTarget(test.addr, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := &Server{HealthCheck: &test.hc}
+			s.transport = s.newTransport()
+			h := newHealthChecker(s)
+			if err := h.check(context.Background(), target); (err != nil) != test.err {
+				t.Fatalf("got error %v", err)
+			}
+		})
+	}
+}
+
+func TestHealthCheckerStopNotStarted(t *testing.T) {
+	s := &Server{HealthCheck: &HealthCheck{}}
+	s.transport = s.newTransport()
+	// Stopping a server never added to a router mustn't block or panic
+	newHealthChecker(s).stop()
+}
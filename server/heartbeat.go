@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+var ErrHeartbeatTimeout = fmt.Errorf("tunnel peer stopped answering heartbeats")
+
+// TunnelHeartbeat configures the pings sent over a multiplexed tunnel conn to
+// find out when the peer is gone.
+type TunnelHeartbeat struct {
+	// Interval is how often a ping is sent. Defaults to 15s.
+	Interval Duration `json:"interval,omitempty"`
+	// MaxMissed is the number of pings that can go unanswered before the peer
+	// is considered dead. Defaults to 3.
+	MaxMissed int `json:"maxMissed,omitempty"`
+}
+
+func (th *TunnelHeartbeat) validate() error {
+	if th.Interval < 0 {
+		return fmt.Errorf("heartbeat interval can't be negative")
+	} else if th.MaxMissed < 0 {
+		return fmt.Errorf("heartbeat max missed can't be negative")
+	}
+	return nil
+}
+
+func (th *TunnelHeartbeat) interval() time.Duration {
+	return th.Interval.Or(15 * time.Second)
+}
+
+func (th *TunnelHeartbeat) maxMissed() int {
+	if th.MaxMissed <= 0 {
+		return 3
+	}
+	return th.MaxMissed
+}
+
+// SetTunnelHeartbeat sets the heartbeat used for tunnels registered
+// afterwards.
+func (router *Router) SetTunnelHeartbeat(th TunnelHeartbeat) error {
+	if err := th.validate(); err != nil {
+		return err
+	}
+	router.tunnelHeartbeat.Store(&th)
+	return nil
+}
+
+func (router *Router) tunnelHeartbeatCfg() TunnelHeartbeat {
+	if th := router.tunnelHeartbeat.Load(); th != nil {
+		return *th
+	}
+	return TunnelHeartbeat{}
+}
+
+// heartbeat pings the peer until the session is closed, closing it if the
+// peer stops answering. If the peer didn't negotiate heartbeats, it's only
+// timed out once it's shown it supports them (by answering or sending a
+// ping) so that sessions with older peers aren't closed.
+func (ms *muxSession) heartbeat(th TunnelHeartbeat, negotiated bool) {
+	if negotiated {
+		atomic.StoreInt32(&ms.peerPings, 1)
+	}
+	ticker := time.NewTicker(th.interval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ms.closed:
+			return
+		case <-ticker.C:
+		}
+		missed := atomic.AddInt32(&ms.missed, 1)
+		if atomic.LoadInt32(&ms.peerPings) == 1 && int(missed) > th.maxMissed() {
+			ms.closeWithError(ErrHeartbeatTimeout)
+			return
+		}
+		// Don't pile up pings if writing is blocked
+		if atomic.CompareAndSwapInt32(&ms.pinging, 0, 1) {
+			go func() {
+				ms.writeFrame(framePing, 0, nil)
+				atomic.StoreInt32(&ms.pinging, 0)
+			}()
+		}
+	}
+}
+
+// gotHeartbeat records that the peer sent a ping or pong.
+func (ms *muxSession) gotHeartbeat(pong bool) {
+	atomic.StoreInt32(&ms.peerPings, 1)
+	if pong {
+		atomic.StoreInt32(&ms.missed, 0)
+	}
+}
+
+// watchTunnel waits for the tunnel server's conn to close and then removes
+// the server, unless it's already been removed.
+func (router *Router) watchTunnel(s *Server) {
+	var err error
+	if s.tunnelMux != nil {
+		<-s.tunnelMux.Done()
+		err = s.tunnelMux.Err()
+	} else {
+		// Nothing is sent by the tunnel on the conn so this only returns once
+		// it's closed
+		if _, err = io.Copy(io.Discard, s.tunnelConn); err == nil {
+			err = io.EOF
+		}
+	}
+	if !router.unroute(s) {
+		return
+	}
+	Logger.Printf("tunnel for %s disconnected: %v", s.Path, err)
+	router.drainServer(context.Background(), s)
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HedgePolicy configures hedged requests: if a response hasn't come back
+// within a delay, the same request is sent to another target and the first
+// response is used. Only requests with safe methods (GET, HEAD, OPTIONS and
+// TRACE) without bodies are hedged.
+type HedgePolicy struct {
+	// Delay is how long to wait for a response before hedging. If 0, the
+	// Percentile of the observed latency is used.
+	Delay Duration `json:"delay,omitempty"`
+	// Percentile is the percentile (0-100) of observed latency used as the
+	// delay if Delay is 0. Defaults to 95.
+	Percentile float64 `json:"percentile,omitempty"`
+	// MinDelay is the lowest delay used when it comes from observed latency.
+	// Defaults to 5ms.
+	MinDelay Duration `json:"minDelay,omitempty"`
+	// MaxHedges is the max number of hedged requests sent for each request.
+	// Defaults to 1.
+	MaxHedges int `json:"maxHedges,omitempty"`
+}
+
+func (hp *HedgePolicy) validate() error {
+	if hp.Delay < 0 || hp.MinDelay < 0 {
+		return fmt.Errorf("hedge delays can't be negative")
+	} else if hp.Percentile < 0 || hp.Percentile > 100 {
+		return fmt.Errorf("hedge percentile must be between 0 and 100")
+	} else if hp.MaxHedges < 0 {
+		return fmt.Errorf("max hedges can't be negative")
+	}
+	return nil
+}
+
+func (hp *HedgePolicy) percentile() float64 {
+	if hp.Percentile == 0 {
+		return 95
+	}
+	return hp.Percentile
+}
+
+func (hp *HedgePolicy) minDelay() time.Duration {
+	return hp.MinDelay.Or(5 * time.Millisecond)
+}
+
+func (hp *HedgePolicy) maxHedges() int {
+	if hp.MaxHedges <= 0 {
+		return 1
+	}
+	return hp.MaxHedges
+}
+
+// canHedge returns whether the request can be hedged.
+func canHedge(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+	default:
+		return false
+	}
+	return (r.Body == nil || r.Body == http.NoBody) && r.Header.Get("Upgrade") == ""
+}
+
+const (
+	// Number of latency samples kept
+	latencyRingLen = 256
+	// Number of samples needed before the observed latency is used
+	latencyMinSamples = 20
+	// Number of samples added between recalculating the percentile
+	latencyRecalcEvery = 16
+)
+
+// latencyRing holds the most recent latencies of a server's responses.
+type latencyRing struct {
+	percentile float64
+
+	mtx       sync.Mutex
+	samples   [latencyRingLen]time.Duration
+	n, next   int
+	sinceCalc int
+	cached    time.Duration
+}
+
+func (lr *latencyRing) add(d time.Duration) {
+	lr.mtx.Lock()
+	defer lr.mtx.Unlock()
+	lr.samples[lr.next] = d
+	lr.next = (lr.next + 1) % latencyRingLen
+	if lr.n < latencyRingLen {
+		lr.n++
+	}
+	lr.sinceCalc++
+}
+
+// get returns the percentile of the samples, or false if there aren't enough.
+func (lr *latencyRing) get() (time.Duration, bool) {
+	lr.mtx.Lock()
+	defer lr.mtx.Unlock()
+	if lr.n < latencyMinSamples {
+		return 0, false
+	}
+	if lr.cached == 0 || lr.sinceCalc >= latencyRecalcEvery {
+		sorted := make([]time.Duration, lr.n)
+		copy(sorted, lr.samples[:lr.n])
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		i := int(float64(lr.n-1) * lr.percentile / 100)
+		lr.cached, lr.sinceCalc = sorted[i], 0
+	}
+	return lr.cached, true
+}
+
+// hedger hedges requests to a server's targets.
+type hedger struct {
+	cfg       HedgePolicy
+	latencies *latencyRing
+
+	// Number of hedged requests sent and number that won
+	hedges, wins int64
+	// Number of requests sent to another target right away because an
+	// attempt failed, which aren't counted as hedges
+	failovers int64
+}
+
+func newHedger(cfg HedgePolicy) *hedger {
+	return &hedger{cfg: cfg, latencies: &latencyRing{percentile: cfg.percentile()}}
+}
+
+// delay returns how long to wait before hedging, or false if it isn't known
+// yet.
+func (h *hedger) delay() (time.Duration, bool) {
+	if h.cfg.Delay > 0 {
+		return h.cfg.Delay.Std(), true
+	}
+	d, ok := h.latencies.get()
+	if !ok {
+		return 0, false
+	}
+	if min := h.cfg.minDelay(); d < min {
+		d = min
+	}
+	return d, true
+}
+
+type hedgeResult struct {
+	t     *Target
+	resp  *http.Response
+	err   error
+	hedge bool
+	start time.Time
+}
+
+// roundTripHedged sends the request, hedging it if a response doesn't come
+// back in time.
+func (pt *poolTransport) roundTripHedged(req *http.Request) (*http.Response, error) {
+	s, h := pt.srvr, pt.srvr.hedger
+	ps := getProxyState(req.Context())
+	results := make(chan hedgeResult, h.cfg.maxHedges()+1)
+	var tried []*Target
+	cancels := make(map[*Target]context.CancelFunc)
+	send := func(hedge bool) bool {
+		t := pt.pool.pickExcluding(req, tried)
+		if t == nil || cancels[t] != nil {
+			// Only hedge to a different target
+			return false
+		}
+		tried = append(tried, t)
+		ctx, cancel := context.WithCancel(req.Context())
+		cancels[t] = cancel
+		start := time.Now()
+		go func() {
+			resp, err := t.roundTrip(pt.base, req.WithContext(ctx))
+			results <- hedgeResult{t, resp, err, hedge, start}
+		}()
+		return true
+	}
+	if !send(false) {
+		return nil, ErrNoTargets
+	}
+	pending, hedges := 1, 0
+	hedge := func(failover bool) {
+		if hedges < h.cfg.maxHedges() && send(!failover) {
+			pending++
+			hedges++
+			if failover {
+				atomic.AddInt64(&h.failovers, 1)
+			} else {
+				atomic.AddInt64(&h.hedges, 1)
+			}
+		}
+	}
+	var timerC <-chan time.Time
+	if d, ok := h.delay(); ok {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timerC = timer.C
+	}
+	var last hedgeResult
+	for pending > 0 {
+		select {
+		case <-timerC:
+			hedge(false)
+			timerC = nil
+			if d, ok := h.delay(); ok && hedges < h.cfg.maxHedges() {
+				timerC = time.After(d)
+			}
+			continue
+		case last = <-results:
+		}
+		pending--
+		if last.err == nil {
+			break
+		}
+		cancels[last.t]()
+		if req.Context().Err() != nil {
+			break
+		}
+		// Try another target right away since the request failed
+		hedge(true)
+		if pending > 0 {
+			// The final error is recorded by the proxy's error handler
+			s.recordResult(last.t, true)
+		}
+	}
+	if ps != nil {
+		ps.target = last.t
+	}
+	if pending > 0 {
+		// Cancel the losers and clean up after them
+		for t, cancel := range cancels {
+			if t != last.t {
+				cancel()
+			}
+		}
+		go func(pending int) {
+			for ; pending > 0; pending-- {
+				if res := <-results; res.resp != nil {
+					res.resp.Body.Close()
+				}
+			}
+		}(pending)
+	}
+	if last.err != nil {
+		return nil, last.err
+	}
+	h.latencies.add(time.Since(last.start))
+	if last.hedge {
+		atomic.AddInt64(&h.wins, 1)
+	}
+	last.resp.Body = wrapBodyDone(last.resp.Body, cancels[last.t])
+	return last.resp, nil
+}
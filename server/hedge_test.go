@@ -0,0 +1,138 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCanHedge(t *testing.T) {
+	tests := []struct {
+		method  string
+		body    string
+		upgrade string
+		want    bool
+	}{
+		{http.MethodGet, "", "", true},
+		{http.MethodHead, "", "", true},
+		{http.MethodOptions, "", "", true},
+		{http.MethodPost, "", "", false},
+		{http.MethodPut, "", "", false},
+		{http.MethodGet, "body", "", false},
+		{http.MethodGet, "", "websocket", false},
+	}
+	for _, test := range tests {
+		t.Run(test.method+" "+test.body+" "+test.upgrade, func(t *testing.T) {
+			var r Req
+			if test.body != "" {
+				r = httptest.NewRequest(test.method, "/", strings.NewReader(test.body))
+			} else {
+				r = httptest.NewRequest(test.method, "/", nil)
+			}
+			if test.upgrade != "" {
+				r.Header.Set("Upgrade", test.upgrade)
+			}
+			if got := canHedge(r); got != test.want {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHedgerDelay(t *testing.T) {
+	const ms = time.Millisecond
+	tests := []struct {
+		name    string
+		cfg     HedgePolicy
+		samples int
+		want    time.Duration
+		ok      bool
+	}{
+		{"fixed", HedgePolicy{Delay: Duration(7 * ms)}, 0, 7 * ms, true},
+		{"too few samples", HedgePolicy{}, latencyMinSamples - 1, 0, false},
+		// Samples are 1ms, 2ms, ..., 100ms
+		{"default percentile", HedgePolicy{}, 100, 95 * ms, true},
+		{"percentile", HedgePolicy{Percentile: 50}, 100, 50 * ms, true},
+		{"min delay", HedgePolicy{Percentile: 1, MinDelay: Duration(10 * ms)}, 100, 10 * ms, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := newHedger(test.cfg)
+			for i := 1; i <= test.samples; i++ {
+				h.latencies.add(time.Duration(i) * ms)
+			}
+			if got, ok := h.delay(); got != test.want || ok != test.ok {
+				t.Fatalf("got %s, %v, want %s, %v", got, ok, test.want, test.ok)
+			}
+		})
+	}
+}
+
+func TestHedge(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		// How long the first and later requests to the targets take
+		first, rest time.Duration
+		// Whether the first request fails without a response
+		failFirst bool
+		hedges    int64
+		wins      int64
+		failovers int64
+	}{
+		{"fast", http.MethodGet, 0, 0, false, 0, 0, 0},
+		{"hedge wins", http.MethodGet, time.Second, 0, false, 1, 1, 0},
+		{"hedge loses", http.MethodGet, 100 * time.Millisecond, time.Second, false, 1, 0, 0},
+		{"unsafe method", http.MethodPost, 100 * time.Millisecond, 0, false, 0, 0, 0},
+		// Sending to another target after a failure isn't a hedge
+		{"failover", http.MethodGet, 0, 0, true, 0, 0, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var n int32
+			handler := http.HandlerFunc(func(w RW, r Req) {
+				d := test.rest
+				if atomic.AddInt32(&n, 1) == 1 {
+					if test.failFirst {
+						c, _, _ := w.(http.Hijacker).Hijack()
+						c.Close()
+						return
+					}
+					d = test.first
+				}
+				select {
+				case <-time.After(d):
+				case <-r.Context().Done():
+				}
+			})
+			ts1, ts2 := httptest.NewServer(handler), httptest.NewServer(handler)
+			defer ts1.Close()
+			defer ts2.Close()
+			s := &Server{
+				Path:    "s",
+				Targets: []*Target{{Addr: ts1.URL}, {Addr: ts2.URL}},
+				Hedge:   &HedgePolicy{Delay: Duration(20 * time.Millisecond)},
+			}
+			if err := s.AddTargetsProxy(); err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, httptest.NewRequest(test.method, "/", nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d", w.Code)
+			} else if took := time.Since(start); took >= 500*time.Millisecond {
+				t.Fatalf("took %s", took)
+			}
+			hedges, wins := atomic.LoadInt64(&s.hedger.hedges), atomic.LoadInt64(&s.hedger.wins)
+			if hedges != test.hedges || wins != test.wins {
+				t.Fatalf("got %d hedges and %d wins, want %d and %d", hedges, wins, test.hedges, test.wins)
+			} else if n := atomic.LoadInt64(&s.hedger.failovers); n != test.failovers {
+				t.Fatalf("got %d failovers, want %d", n, test.failovers)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConcurrencyLimit caps the number of requests a server handles at once.
+// Requests over the limit wait in a FIFO queue.
+type ConcurrencyLimit struct {
+	// MaxInFlight is the max number of requests handled at once
+	MaxInFlight int `json:"maxInFlight"`
+	// MaxQueue is the max number of requests waiting for a slot. Requests are
+	// rejected as soon as the limit is hit if 0.
+	MaxQueue int `json:"maxQueue,omitempty"`
+	// QueueTimeout is how long a request can wait in the queue. Defaults to
+	// 5s.
+	QueueTimeout Duration `json:"queueTimeout,omitempty"`
+}
+
+func (cl *ConcurrencyLimit) validate() error {
+	if cl.MaxInFlight <= 0 {
+		return fmt.Errorf("max in-flight requests must be positive")
+	} else if cl.MaxQueue < 0 {
+		return fmt.Errorf("max queue can't be negative")
+	} else if cl.QueueTimeout < 0 {
+		return fmt.Errorf("queue timeout can't be negative")
+	}
+	return nil
+}
+
+func (cl *ConcurrencyLimit) queueTimeout() time.Duration {
+	return cl.QueueTimeout.Or(5 * time.Second)
+}
+
+// limiter enforces a ConcurrencyLimit.
+type limiter struct {
+	cfg ConcurrencyLimit
+
+	// Number of requests rejected because the queue was full and because they
+	// waited too long
+	rejectedFull, rejectedTimeout int64
+
+	mtx      sync.Mutex
+	inFlight int
+	// Holds the chan of each waiting request, which is closed when the request
+	// is given a slot
+	queue *list.List
+}
+
+func newLimiter(cfg ConcurrencyLimit) *limiter {
+	return &limiter{cfg: cfg, queue: list.New()}
+}
+
+// acquire waits for a slot for the request, returning false if the request
+// is rejected. If true is returned, release must be called once the request
+// is done.
+func (l *limiter) acquire(ctx context.Context) bool {
+	l.mtx.Lock()
+	if l.inFlight < l.cfg.MaxInFlight {
+		l.inFlight++
+		l.mtx.Unlock()
+		return true
+	} else if l.queue.Len() >= l.cfg.MaxQueue {
+		l.mtx.Unlock()
+		atomic.AddInt64(&l.rejectedFull, 1)
+		return false
+	}
+	ch := make(chan struct{})
+	elem := l.queue.PushBack(ch)
+	l.mtx.Unlock()
+
+	timer := time.NewTimer(l.cfg.queueTimeout())
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return true
+	case <-timer.C:
+		atomic.AddInt64(&l.rejectedTimeout, 1)
+	case <-ctx.Done():
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	select {
+	case <-ch:
+		// Given a slot while giving up so pass it on
+		l.releaseLocked()
+	default:
+		l.queue.Remove(elem)
+	}
+	return false
+}
+
+func (l *limiter) release() {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.releaseLocked()
+}
+
+// Must be called with the lock held
+func (l *limiter) releaseLocked() {
+	if front := l.queue.Front(); front != nil {
+		// Hand the slot straight to the next in line
+		close(l.queue.Remove(front).(chan struct{}))
+		return
+	}
+	l.inFlight--
+}
+
+// LimiterStatus is the status of a server's concurrency limiter.
+type LimiterStatus struct {
+	InFlight        int   `json:"inFlight"`
+	Queued          int   `json:"queued"`
+	RejectedFull    int64 `json:"rejectedFull"`
+	RejectedTimeout int64 `json:"rejectedTimeout"`
+}
+
+func (l *limiter) status() LimiterStatus {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return LimiterStatus{
+		InFlight:        l.inFlight,
+		Queued:          l.queue.Len(),
+		RejectedFull:    atomic.LoadInt64(&l.rejectedFull),
+		RejectedTimeout: atomic.LoadInt64(&l.rejectedTimeout),
+	}
+}
+
+// LimiterStatus returns the status of the server's concurrency limiter.
+// False is returned if the server doesn't have one.
+func (s *Server) LimiterStatus() (LimiterStatus, bool) {
+	if s.limiter == nil {
+		return LimiterStatus{}, false
+	}
+	return s.limiter.status(), true
+}
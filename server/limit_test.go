@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  ConcurrencyLimit
+		// Number of requests holding a slot when the one being tested arrives
+		held int
+		want bool
+		// Status once the request has given up or got a slot
+		status LimiterStatus
+	}{
+		{
+			name:   "under the limit",
+			cfg:    ConcurrencyLimit{MaxInFlight: 2},
+			held:   1,
+			want:   true,
+			status: LimiterStatus{InFlight: 2},
+		},
+		{
+			name:   "full without a queue",
+			cfg:    ConcurrencyLimit{MaxInFlight: 1},
+			held:   1,
+			want:   false,
+			status: LimiterStatus{InFlight: 1, RejectedFull: 1},
+		},
+		{
+			name: "times out in the queue",
+			cfg: ConcurrencyLimit{
+				MaxInFlight:  1,
+				MaxQueue:     1,
+				QueueTimeout: Duration(10 * time.Millisecond),
+			},
+			held:   1,
+			want:   false,
+			status: LimiterStatus{InFlight: 1, RejectedTimeout: 1},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := newLimiter(test.cfg)
+			for i := 0; i < test.held; i++ {
+				if !l.acquire(context.Background()) {
+					t.Fatalf("request %d rejected", i)
+				}
+			}
+			if got := l.acquire(context.Background()); got != test.want {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+			if status := l.status(); status != test.status {
+				t.Fatalf("got status %+v, want %+v", status, test.status)
+			}
+		})
+	}
+}
+
+func TestLimiterQueueOrder(t *testing.T) {
+	l := newLimiter(ConcurrencyLimit{MaxInFlight: 1, MaxQueue: 3})
+	if !l.acquire(context.Background()) {
+		t.Fatal("first request rejected")
+	}
+	order := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			if l.acquire(context.Background()) {
+				order <- i
+			}
+		}(i)
+		// Wait for it to be queued so the order is known
+		for l.status().Queued != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		l.release()
+		if got := <-order; got != i {
+			t.Fatalf("request %d got a slot before request %d", got, i)
+		}
+	}
+	l.release()
+	if status := l.status(); status.InFlight != 0 || status.Queued != 0 {
+		t.Fatalf("got status %+v after releasing all slots", status)
+	}
+}
+
+func TestLimiterCancelled(t *testing.T) {
+	l := newLimiter(ConcurrencyLimit{MaxInFlight: 1, MaxQueue: 1})
+	l.acquire(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if l.acquire(ctx) {
+		t.Fatal("cancelled request got a slot")
+	}
+	// The cancelled request left the queue so the slot isn't handed to it
+	l.release()
+	if status := l.status(); status.InFlight != 0 || status.Queued != 0 {
+		t.Fatalf("got status %+v", status)
+	}
+}
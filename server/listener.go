@@ -0,0 +1,264 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// ListenerConfig describes a listener a Router accepts connections on.
+type ListenerConfig struct {
+	// Name is used to refer to the listener. Defaults to the network and
+	// address (e.g., "tcp://127.0.0.1:8000").
+	Name string `json:"name,omitempty"`
+	// Network is the network passed to net.Listen. Defaults to "tcp".
+	Network string `json:"network,omitempty"`
+	Addr    string `json:"addr,omitempty"`
+	// CertFile and KeyFile are used to serve TLS on the listener
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+	// ClientCAFile holds the CAs used to verify client certs, which are
+	// optional. Only used with TLS.
+	ClientCAFile string `json:"clientCAFile,omitempty"`
+	// Routes holds the paths of the only routes visible on the listener. All
+	// routes are visible if empty.
+	Routes []string `json:"routes,omitempty"`
+	// NoAdmin hides the home page, log, and admin API on the listener. Tunnels
+	// can't connect over it either since they add routes.
+	NoAdmin bool `json:"noAdmin,omitempty"`
+	// NoTunnels keeps tunnels from connecting over the listener
+	NoTunnels bool `json:"noTunnels,omitempty"`
+
+	// TLSConfig is used instead of loading CertFile and KeyFile if set
+	TLSConfig *tls.Config `json:"-"`
+	// Filter, if set, is called to check if a route is visible on the
+	// listener (after Routes is checked).
+	Filter func(*Server) bool `json:"-"`
+}
+
+// ParseListenerSpec parses a listener in the form
+// [network://]addr[?cert=file&key=file&clientca=file&routes=path1,path2&name=name&noadmin&notunnels].
+// The "tls" network is the same as "tcp" but requires cert and key.
+func ParseListenerSpec(spec string) (ListenerConfig, error) {
+	cfg := ListenerConfig{}
+	if !strings.Contains(spec, "://") {
+		spec = "tcp://" + spec
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return cfg, err
+	}
+	cfg.Network, cfg.Addr = u.Scheme, u.Host+u.Path
+	q := u.Query()
+	cfg.Name = q.Get("name")
+	cfg.CertFile, cfg.KeyFile = q.Get("cert"), q.Get("key")
+	cfg.ClientCAFile = q.Get("clientca")
+	if routes := q.Get("routes"); routes != "" {
+		cfg.Routes = strings.Split(routes, ",")
+	}
+	cfg.NoAdmin = q.Has("noadmin")
+	cfg.NoTunnels = q.Has("notunnels")
+	if cfg.Network == "tls" {
+		cfg.Network = "tcp"
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return cfg, fmt.Errorf("tls listener must have cert and key")
+		}
+	}
+	return cfg, nil
+}
+
+// Listener is a listener being accepted on by a Router.
+type Listener struct {
+	cfg       ListenerConfig
+	ln        net.Listener
+	tlsConfig *tls.Config
+}
+
+func newListener(cfg ListenerConfig) (*Listener, error) {
+	if cfg.Network == "" {
+		cfg.Network = "tcp"
+	}
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return nil, fmt.Errorf("must have both cert and key file")
+	}
+	l := &Listener{cfg: cfg, tlsConfig: cfg.TLSConfig}
+	if l.tlsConfig == nil && cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		l.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	if l.tlsConfig != nil {
+		l.tlsConfig = l.tlsConfig.Clone()
+		if len(l.tlsConfig.NextProtos) == 0 {
+			l.tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+		}
+		// Allow tunnels to connect over the listener
+		hasTunnel := false
+		for _, proto := range l.tlsConfig.NextProtos {
+			hasTunnel = hasTunnel || proto == TunnelALPN
+		}
+		if !hasTunnel {
+			l.tlsConfig.NextProtos = append(l.tlsConfig.NextProtos, TunnelALPN)
+		}
+		if cfg.ClientCAFile != "" {
+			pool, err := loadClientCAs(cfg.ClientCAFile)
+			if err != nil {
+				return nil, err
+			}
+			l.tlsConfig.ClientCAs = pool
+			l.tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	ln, err := net.Listen(cfg.Network, cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	l.ln = ln
+	if l.cfg.Name == "" {
+		l.cfg.Name = cfg.Network + "://" + ln.Addr().String()
+	}
+	return l, nil
+}
+
+// Name returns the name of the listener.
+func (l *Listener) Name() string {
+	return l.cfg.Name
+}
+
+// Config returns the config the listener was created with.
+func (l *Listener) Config() ListenerConfig {
+	cfg := l.cfg
+	cfg.Routes = append([]string(nil), cfg.Routes...)
+	return cfg
+}
+
+// Addr returns the address being listened on.
+func (l *Listener) Addr() net.Addr {
+	return l.ln.Addr()
+}
+
+// IsTLS returns whether the listener serves TLS.
+func (l *Listener) IsTLS() bool {
+	return l.tlsConfig != nil
+}
+
+// Close stops the listener. Connections already accepted aren't closed.
+func (l *Listener) Close() error {
+	return l.ln.Close()
+}
+
+func (l *Listener) allows(s *Server) bool {
+	if l == nil {
+		return true
+	}
+	if len(l.cfg.Routes) != 0 {
+		found := false
+		for _, p := range l.cfg.Routes {
+			if p == s.Path {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return l.cfg.Filter == nil || l.cfg.Filter(s)
+}
+
+func (l *Listener) allowsAdmin() bool {
+	return l == nil || !l.cfg.NoAdmin
+}
+
+func (l *Listener) allowsTunnels() bool {
+	return l.allowsAdmin() && (l == nil || !l.cfg.NoTunnels)
+}
+
+// listenerConn is a conn accepted on a Listener.
+type listenerConn struct {
+	net.Conn
+	l *Listener
+}
+
+// connListener gets the listener a conn was accepted on, if any.
+func connListener(c net.Conn) *Listener {
+	for {
+		switch conn := c.(type) {
+		case listenerConn:
+			return conn.l
+		case *listenerConn:
+			return conn.l
+		case BufConn:
+			c = conn.Conn
+		case *replayConn:
+			c = conn.Conn
+		case *tls.Conn:
+			c = conn.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+type listenerCtxKey struct{}
+
+// ConnContext should be set as the ConnContext of the http.Server serving the
+// router so that the listener and connection of each request can be found.
+func (router *Router) ConnContext(ctx context.Context, c net.Conn) context.Context {
+	ctx = context.WithValue(ctx, connCtxKey{}, c)
+	if l := connListener(c); l != nil {
+		ctx = context.WithValue(ctx, listenerCtxKey{}, l)
+	}
+	return ctx
+}
+
+func reqListener(r Req) *Listener {
+	l, _ := r.Context().Value(listenerCtxKey{}).(*Listener)
+	return l
+}
+
+var (
+	ErrListenerExists   = fmt.Errorf("listener already exists")
+	ErrListenerNotExist = fmt.Errorf("listener does not exist")
+)
+
+// AddListener starts listening using the given config.
+func (router *Router) AddListener(cfg ListenerConfig) (*Listener, error) {
+	if router.IsHandlerOnly() {
+		return nil, fmt.Errorf("router is handler only")
+	}
+	l, err := newListener(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if _, loaded := router.listeners.LoadOrStore(l.Name(), l); loaded {
+		l.Close()
+		return nil, ErrListenerExists
+	}
+	go router.listen(l)
+	return l, nil
+}
+
+// RemoveListener stops and removes the listener with the given name.
+func (router *Router) RemoveListener(name string) error {
+	l, ok := router.listeners.LoadAndDelete(name)
+	if !ok {
+		return ErrListenerNotExist
+	}
+	return l.Close()
+}
+
+// Listeners returns the router's current listeners.
+func (router *Router) Listeners() []*Listener {
+	var lns []*Listener
+	router.listeners.Range(func(_ string, l *Listener) bool {
+		lns = append(lns, l)
+		return true
+	})
+	return lns
+}
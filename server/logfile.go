@@ -0,0 +1,307 @@
+package server
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogFileOptions holds the rotation settings for a LogFile. Zero values
+// disable the respective setting.
+type LogFileOptions struct {
+	// MaxSize is the size in bytes the file can grow to before being rotated
+	MaxSize int64
+	// MaxAge is how long a file is written to before being rotated
+	MaxAge time.Duration
+	// MaxBackups is the number of rotated files to keep
+	MaxBackups int
+	// Compress is whether rotated files should be gzipped
+	Compress bool
+}
+
+// Rotated files are named after the file with the time they were rotated
+// appended, followed by "-N" if a file was already rotated at that time.
+const logBackupTimeFormat = "20060102-150405.000"
+
+// LogFile is an io.Writer that appends to a file, rotating it according to
+// its options. The file is always written at the same path, so it can be
+// served while it's being written to.
+type LogFile struct {
+	path string
+	opts LogFileOptions
+
+	mtx      sync.Mutex
+	f        *os.File
+	size     int64
+	openedAt time.Time
+
+	// Held while rotated files are being compressed or removed
+	cleanupMtx sync.Mutex
+}
+
+// OpenLogFile opens (or creates) the log file at the given path.
+func OpenLogFile(path string, opts LogFileOptions) (*LogFile, error) {
+	lf := &LogFile{path: path, opts: opts}
+	if err := lf.open(); err != nil {
+		return nil, err
+	}
+	return lf, nil
+}
+
+// Path returns the path of the file currently being written to.
+func (lf *LogFile) Path() string {
+	return lf.path
+}
+
+func (lf *LogFile) Write(p []byte) (int, error) {
+	lf.mtx.Lock()
+	defer lf.mtx.Unlock()
+	if lf.f == nil {
+		return 0, os.ErrClosed
+	}
+	if lf.shouldRotate(int64(len(p))) {
+		if err := lf.rotate(); err != nil {
+			// Keep writing to the old file rather than losing the message
+			fmt.Fprintf(os.Stderr, "error rotating log file: %v\n", err)
+		}
+	}
+	n, err := lf.f.Write(p)
+	lf.size += int64(n)
+	return n, err
+}
+
+// Rotate moves the current file aside and starts a new one.
+func (lf *LogFile) Rotate() error {
+	lf.mtx.Lock()
+	defer lf.mtx.Unlock()
+	if lf.f == nil {
+		return os.ErrClosed
+	}
+	return lf.rotate()
+}
+
+// Reopen closes and reopens the file at its path. This is used when the file
+// has been moved by something else (e.g., logrotate). If the file can't be
+// opened, the old one is kept.
+func (lf *LogFile) Reopen() error {
+	lf.mtx.Lock()
+	defer lf.mtx.Unlock()
+	f, size, err := lf.openFile()
+	if err != nil {
+		return err
+	}
+	if lf.f != nil {
+		lf.f.Close()
+	}
+	lf.f, lf.size, lf.openedAt = f, size, time.Now()
+	return nil
+}
+
+func (lf *LogFile) Close() error {
+	lf.mtx.Lock()
+	defer lf.mtx.Unlock()
+	if lf.f == nil {
+		return nil
+	}
+	err := lf.f.Close()
+	lf.f = nil
+	return err
+}
+
+// Must be called with the lock held
+func (lf *LogFile) shouldRotate(n int64) bool {
+	if lf.opts.MaxSize > 0 && lf.size > 0 && lf.size+n > lf.opts.MaxSize {
+		return true
+	}
+	return lf.opts.MaxAge > 0 && time.Since(lf.openedAt) >= lf.opts.MaxAge
+}
+
+// Must be called with the lock held
+func (lf *LogFile) open() error {
+	f, size, err := lf.openFile()
+	if err != nil {
+		return err
+	}
+	// The age of an existing file is counted from when it's opened since the
+	// creation time isn't portably available
+	lf.f, lf.size, lf.openedAt = f, size, time.Now()
+	return nil
+}
+
+// openFile opens the file at the path for appending, returning its size.
+func (lf *LogFile) openFile() (*os.File, int64, error) {
+	f, err := os.OpenFile(lf.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+// backupPath returns the path the file is moved to when rotated at the time.
+// A suffix is added if a file was already rotated at the same time.
+func (lf *LogFile) backupPath(t time.Time) string {
+	backup := lf.path + "." + t.Format(logBackupTimeFormat)
+	for n := 1; ; n++ {
+		if !fileExists(backup) && !fileExists(backup+".gz") {
+			return backup
+		}
+		backup = fmt.Sprintf("%s.%s-%d", lf.path, t.Format(logBackupTimeFormat), n)
+	}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// Must be called with the lock held
+func (lf *LogFile) rotate() error {
+	backup := lf.backupPath(time.Now())
+	if err := lf.f.Close(); err != nil {
+		return err
+	}
+	lf.f = nil
+	if err := os.Rename(lf.path, backup); err != nil {
+		// Try to keep writing to the original file
+		if oerr := lf.open(); oerr != nil {
+			return fmt.Errorf("%w (error reopening: %v)", err, oerr)
+		}
+		return err
+	}
+	if err := lf.open(); err != nil {
+		return err
+	}
+	go lf.cleanup(backup)
+	return nil
+}
+
+// cleanup compresses the newly rotated file (if enabled) and removes backups
+// past the retention count.
+func (lf *LogFile) cleanup(backup string) {
+	lf.cleanupMtx.Lock()
+	defer lf.cleanupMtx.Unlock()
+	if lf.opts.Compress {
+		if err := gzipFile(backup); err != nil {
+			fmt.Fprintf(os.Stderr, "error compressing log file: %v\n", err)
+		}
+	}
+	if lf.opts.MaxBackups <= 0 {
+		return
+	}
+	backups, err := lf.backups()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error listing log files: %v\n", err)
+		return
+	}
+	for len(backups) > lf.opts.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "error removing old log file: %v\n", err)
+		}
+		backups = backups[1:]
+	}
+}
+
+// backups returns the rotated files, oldest first.
+func (lf *LogFile) backups() ([]string, error) {
+	dir, base := filepath.Split(lf.path)
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	prefix := base + "."
+	type backup struct {
+		path string
+		t    time.Time
+		n    int
+	}
+	var found []backup
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		t, n, ok := parseBackupSuffix(strings.TrimSuffix(name[len(prefix):], ".gz"))
+		if !ok {
+			continue
+		}
+		found = append(found, backup{filepath.Join(dir, name), t, n})
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if !found[i].t.Equal(found[j].t) {
+			return found[i].t.Before(found[j].t)
+		}
+		return found[i].n < found[j].n
+	})
+	backups := make([]string, len(found))
+	for i, b := range found {
+		backups[i] = b.path
+	}
+	return backups, nil
+}
+
+// parseBackupSuffix parses the time a file was rotated at and the number of
+// files rotated before it at the same time from what's appended to its name.
+func parseBackupSuffix(s string) (time.Time, int, bool) {
+	if len(s) < len(logBackupTimeFormat) {
+		return time.Time{}, 0, false
+	}
+	t, err := time.Parse(logBackupTimeFormat, s[:len(logBackupTimeFormat)])
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	rest := s[len(logBackupTimeFormat):]
+	if rest == "" {
+		return t, 0, true
+	} else if rest[0] != '-' {
+		return time.Time{}, 0, false
+	}
+	n, err := strconv.Atoi(rest[1:])
+	if err != nil || n < 1 {
+		return time.Time{}, 0, false
+	}
+	return t, n, true
+}
+
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	if _, err := io.Copy(zw, src); err != nil {
+		zw.Close()
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
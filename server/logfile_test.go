@@ -0,0 +1,214 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitFor fails the test if cond isn't true within a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestLogFileRotateOnSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		maxSize int64
+		writes  []string
+		// Contents of the current file after the writes
+		want    string
+		backups int
+	}{
+		{"under max", 10, []string{"abc", "def"}, "abcdef", 0},
+		{"at max", 6, []string{"abc", "def"}, "abcdef", 0},
+		{"over max", 5, []string{"abc", "def"}, "def", 1},
+		{"single write over max", 2, []string{"abcdef"}, "abcdef", 0},
+		{"no max", 0, []string{"abc", "def"}, "abcdef", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "log")
+			lf, err := OpenLogFile(path, LogFileOptions{MaxSize: test.maxSize})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer lf.Close()
+			for _, w := range test.writes {
+				if _, err := lf.Write([]byte(w)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got, err := os.ReadFile(path); err != nil {
+				t.Fatal(err)
+			} else if string(got) != test.want {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+			if backups, err := lf.backups(); err != nil {
+				t.Fatal(err)
+			} else if len(backups) != test.backups {
+				t.Fatalf("got backups %v, want %d", backups, test.backups)
+			}
+		})
+	}
+}
+
+func TestLogFileRetention(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxBackups int
+		compress   bool
+		rotations  int
+		want       int
+	}{
+		{"keeps all", 0, false, 3, 3},
+		{"removes oldest", 2, false, 4, 2},
+		{"compresses", 2, true, 4, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "log")
+			lf, err := OpenLogFile(path, LogFileOptions{
+				MaxBackups: test.maxBackups,
+				Compress:   test.compress,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer lf.Close()
+			for i := 0; i < test.rotations; i++ {
+				lf.Write([]byte{'0' + byte(i)})
+				if err := lf.Rotate(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var backups []string
+			waitFor(t, "cleanup", func() bool {
+				lf.cleanupMtx.Lock()
+				defer lf.cleanupMtx.Unlock()
+				backups, _ = lf.backups()
+				if len(backups) != test.want {
+					return false
+				}
+				for _, b := range backups {
+					if strings.HasSuffix(b, ".gz") != test.compress {
+						return false
+					}
+				}
+				return true
+			})
+			if test.compress {
+				return
+			}
+			// The newest backups are the ones kept
+			if got, err := os.ReadFile(backups[len(backups)-1]); err != nil {
+				t.Fatal(err)
+			} else if want := string('0' + byte(test.rotations-1)); string(got) != want {
+				t.Fatalf("newest backup has %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestLogFileReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "log")
+	lf, err := OpenLogFile(path, LogFileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lf.Close()
+	lf.Write([]byte("old"))
+	// Moved by something like logrotate
+	if err := os.Rename(path, path+".moved"); err != nil {
+		t.Fatal(err)
+	} else if err := lf.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	lf.Write([]byte("new"))
+	if got, _ := os.ReadFile(path); string(got) != "new" {
+		t.Fatalf("reopened file has %q", got)
+	} else if got, _ := os.ReadFile(path + ".moved"); string(got) != "old" {
+		t.Fatalf("moved file has %q", got)
+	}
+}
+
+func TestLogFileReopenFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	lf, err := OpenLogFile(path, LogFileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lf.Close()
+	lf.Write([]byte("old"))
+	// Nothing can be opened at the path once it's a directory
+	if err := os.Rename(path, path+".moved"); err != nil {
+		t.Fatal(err)
+	} else if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatal(err)
+	} else if err := lf.Reopen(); err == nil {
+		t.Fatal("reopened a directory")
+	}
+	// The old file is still written to
+	if _, err := lf.Write([]byte("new")); err != nil {
+		t.Fatal(err)
+	} else if got, _ := os.ReadFile(path + ".moved"); string(got) != "oldnew" {
+		t.Fatalf("old file has %q", got)
+	}
+}
+
+func TestLogFileRotateSameTime(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	lf, err := OpenLogFile(path, LogFileOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lf.Close()
+	now := time.Now()
+	var want []string
+	for i := 0; i < 12; i++ {
+		backup := lf.backupPath(now)
+		if err := os.WriteFile(backup, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, backup)
+	}
+	// Ordered by when they were rotated, not by name
+	if got, err := lf.backups(); err != nil {
+		t.Fatal(err)
+	} else if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("got backups %v, want %v", got, want)
+	}
+}
+
+func TestParseBackupSuffix(t *testing.T) {
+	tests := []struct {
+		in string
+		n  int
+		ok bool
+	}{
+		{"20240102-030405.678", 0, true},
+		{"20240102-030405.678-1", 1, true},
+		{"20240102-030405.678-12", 12, true},
+		{"20240102-030405.678-0", 0, false},
+		{"20240102-030405.678-", 0, false},
+		{"20240102-030405.678x", 0, false},
+		{"20240102-030405", 0, false},
+		{"moved", 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			if _, n, ok := parseBackupSuffix(test.in); n != test.n || ok != test.ok {
+				t.Fatalf("got %d, %v, want %d, %v", n, ok, test.n, test.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// metricsWriter collects metrics and writes them in the Prometheus text
+// format.
+type metricsWriter struct {
+	families map[string]*metricFamily
+	order    []string
+}
+
+type metricFamily struct {
+	name, help, typ string
+	samples         []metricSample
+}
+
+type metricSample struct {
+	labels string
+	value  float64
+}
+
+func newMetricsWriter() *metricsWriter {
+	return &metricsWriter{families: make(map[string]*metricFamily)}
+}
+
+// gauge adds a gauge sample. Labels are given as name, value pairs.
+func (mw *metricsWriter) gauge(name, help string, value float64, labels ...string) {
+	mw.add(name, help, "gauge", value, labels)
+}
+
+// counter adds a counter sample. Labels are given as name, value pairs.
+func (mw *metricsWriter) counter(name, help string, value float64, labels ...string) {
+	mw.add(name, help, "counter", value, labels)
+}
+
+func (mw *metricsWriter) add(name, help, typ string, value float64, labels []string) {
+	name = "gory_proxy_" + name
+	fam, ok := mw.families[name]
+	if !ok {
+		fam = &metricFamily{name: name, help: help, typ: typ}
+		mw.families[name] = fam
+		mw.order = append(mw.order, name)
+	}
+	fam.samples = append(fam.samples, metricSample{
+		labels: formatLabels(labels),
+		value:  value,
+	})
+}
+
+func (mw *metricsWriter) writeTo(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, name := range mw.order {
+		fam := mw.families[name]
+		fmt.Fprintf(bw, "# HELP %s %s\n", fam.name, fam.help)
+		fmt.Fprintf(bw, "# TYPE %s %s\n", fam.name, fam.typ)
+		for _, s := range fam.samples {
+			fmt.Fprintf(bw, "%s%s %s\n", fam.name, s.labels, formatMetricValue(s.value))
+		}
+	}
+	return bw.Flush()
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i != 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(labels[i])
+		sb.WriteString(`="`)
+		sb.WriteString(escapeLabel(labels[i+1]))
+		sb.WriteByte('"')
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func formatMetricValue(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// MetricsPath is the path the router's metrics are served on. It's in the
+// router's reserved route so it can't shadow a server's.
+const MetricsPath = "/" + reservedRoute + "/metrics"
+
+// serveMetrics serves the router's metrics in the Prometheus text format.
+func (router *Router) serveMetrics(w RW, r Req) {
+	mw := newMetricsWriter()
+	var srvrs []*Server
+	router.routes.Range(func(_ string, srvr *Server) bool {
+		srvrs = append(srvrs, srvr)
+		return true
+	})
+	sort.Slice(srvrs, func(i, j int) bool {
+		return srvrs[i].Path < srvrs[j].Path
+	})
+	for _, srvr := range srvrs {
+		srvr.writeMetrics(mw)
+	}
+	router.writeTunnelMetrics(mw)
+	router.pendingConns.writeMetrics(mw)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := mw.writeTo(w); err != nil {
+		Logger.Println(err)
+	}
+}
+
+func (s *Server) writeMetrics(mw *metricsWriter) {
+	mw.gauge(
+		"server_active_requests",
+		"Number of requests the server is handling",
+		float64(s.ActiveRequests()), "server", s.Path,
+	)
+	if bs, ok := s.BreakerStatus(); ok {
+		for _, state := range []BreakerState{BreakerClosed, BreakerOpen, BreakerHalfOpen} {
+			mw.gauge(
+				"breaker_state",
+				"State of the server's circuit breaker",
+				boolMetric(bs.State == state), "server", s.Path, "state", state.String(),
+			)
+		}
+		mw.counter(
+			"breaker_rejected_total",
+			"Number of requests rejected by the server's circuit breaker",
+			float64(bs.Rejected), "server", s.Path,
+		)
+		mw.counter(
+			"breaker_opens_total",
+			"Number of times the server's circuit breaker has opened",
+			float64(bs.Opens), "server", s.Path,
+		)
+	}
+	if ls, ok := s.LimiterStatus(); ok {
+		mw.gauge(
+			"limiter_in_flight",
+			"Number of requests holding a slot of the server's concurrency limiter",
+			float64(ls.InFlight), "server", s.Path,
+		)
+		mw.gauge(
+			"limiter_queue_depth",
+			"Number of requests waiting for a slot of the server's concurrency limiter",
+			float64(ls.Queued), "server", s.Path,
+		)
+		mw.counter(
+			"limiter_rejected_total",
+			"Number of requests rejected by the server's concurrency limiter",
+			float64(ls.RejectedFull), "server", s.Path, "reason", "queue_full",
+		)
+		mw.counter(
+			"limiter_rejected_total",
+			"Number of requests rejected by the server's concurrency limiter",
+			float64(ls.RejectedTimeout), "server", s.Path, "reason", "queue_timeout",
+		)
+	}
+	if as, ok := s.AdaptiveStatus(); ok {
+		mw.gauge(
+			"adaptive_limit",
+			"Current concurrency limit of the server's adaptive limiter",
+			float64(as.Limit), "server", s.Path,
+		)
+		mw.gauge(
+			"adaptive_in_flight",
+			"Number of requests let through by the server's adaptive limiter that haven't finished",
+			float64(as.InFlight), "server", s.Path,
+		)
+		mw.gauge(
+			"adaptive_min_latency_seconds",
+			"Lowest recent latency observed by the server's adaptive limiter",
+			as.MinLatency.Std().Seconds(), "server", s.Path,
+		)
+		mw.counter(
+			"adaptive_rejected_total",
+			"Number of requests rejected by the server's adaptive limiter",
+			float64(as.Rejected), "server", s.Path,
+		)
+	}
+	if s.retries != nil {
+		mw.counter(
+			"retries_total",
+			"Number of retries of requests to the server",
+			float64(atomic.LoadInt64(&s.retries.retries)), "server", s.Path,
+		)
+		mw.counter(
+			"retry_budget_exhausted_total",
+			"Number of retries not done because the server's retry budget was used up",
+			float64(atomic.LoadInt64(&s.retries.exhausted)), "server", s.Path,
+		)
+	}
+	if s.hedger != nil {
+		mw.counter(
+			"hedges_total",
+			"Number of hedged requests sent to the server's targets",
+			float64(atomic.LoadInt64(&s.hedger.hedges)), "server", s.Path,
+		)
+		mw.counter(
+			"hedge_wins_total",
+			"Number of hedged requests whose response was used",
+			float64(atomic.LoadInt64(&s.hedger.wins)), "server", s.Path,
+		)
+		mw.counter(
+			"hedge_failovers_total",
+			"Number of requests sent to another target right away because an attempt failed",
+			float64(atomic.LoadInt64(&s.hedger.failovers)), "server", s.Path,
+		)
+		if d, ok := s.hedger.delay(); ok {
+			mw.gauge(
+				"hedge_delay_seconds",
+				"Current delay before requests to the server are hedged",
+				d.Seconds(), "server", s.Path,
+			)
+		}
+	}
+	for _, t := range s.GetTargets() {
+		labels := []string{"server", s.Path, "target", t.Addr}
+		mw.gauge(
+			"target_outstanding_requests",
+			"Number of requests to the target that haven't finished",
+			float64(t.Outstanding()), labels...,
+		)
+		if s.health != nil {
+			mw.gauge(
+				"target_healthy",
+				"Whether the target is passing its health checks",
+				boolMetric(t.Healthy()), labels...,
+			)
+		}
+		if s.Outlier != nil {
+			mw.gauge(
+				"target_ejected",
+				"Whether the target is currently ejected by outlier detection",
+				boolMetric(t.Ejected()), labels...,
+			)
+			mw.counter(
+				"target_ejections_total",
+				"Number of times the target has been ejected by outlier detection",
+				float64(t.TotalEjections()), labels...,
+			)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsPath(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w RW, r Req) {
+		io.WriteString(w, "upstream")
+	}))
+	defer upstream.Close()
+	router, err := NewRouterWithListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+	// A server can use the path the metrics used to be served on
+	s := &Server{Name: "metrics", Path: "metrics", Addr: upstream.URL}
+	if err := s.AddTargetsProxy(); err != nil {
+		t.Fatal(err)
+	} else if err := router.AddServer(s); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		body string
+	}{
+		{"/metrics", "upstream"},
+		{MetricsPath, `server="metrics"`},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, test.path, nil))
+			if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), test.body) {
+				t.Fatalf("got %d: %q", w.Code, w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,638 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Types of frames sent over a multiplexed tunnel connection. Each frame is
+// the type (1 byte), the stream ID (4 bytes), the payload length (4 bytes)
+// and then the payload.
+const (
+	// frameOpen opens a new stream
+	frameOpen byte = iota + 1
+	// frameData carries data for a stream
+	frameData
+	// frameClose means the sender won't send any more data on the stream
+	frameClose
+	// frameReset aborts a stream
+	frameReset
+	// frameWindow lets the receiver send more data on the stream. The payload
+	// is the number of bytes as a uint32.
+	frameWindow
+	// framePing asks the peer for a pong
+	framePing
+	// framePong answers a ping
+	framePong
+	// frameControl carries a control message (tunnelControl) for the session
+	// rather than a stream. The stream ID is always 0.
+	frameControl
+	// frameDatagram carries a datagram of a UDP flow rather than stream data.
+	// The stream ID is the flow's ID and the payload is the length of the
+	// service's path (1 byte), the path and then the datagram.
+	frameDatagram
+)
+
+const (
+	muxHeaderLen = 9
+	// Max payload of a frame
+	muxMaxPayload = 16 << 10
+	// Number of bytes that can be sent on a stream before the receiver has to
+	// give more room
+	muxInitialWindow = 256 << 10
+	// Number of opened streams that can wait to be accepted
+	muxAcceptBacklog = 128
+	// Number of control messages that can wait to be handled
+	muxControlBacklog = 64
+	// Number of datagrams that can wait to be handled before more are dropped
+	muxDatagramBacklog = 1024
+	// Number of streams that can wait to be reset
+	muxMaxPendingResets = 1024
+)
+
+var (
+	ErrMuxClosed   = fmt.Errorf("tunnel session closed")
+	ErrStreamReset = fmt.Errorf("tunnel stream reset")
+)
+
+// muxSession multiplexes streams over a single tunnel connection.
+type muxSession struct {
+	conn net.Conn
+	// Whether this side made the connection, which never changes
+	client bool
+	// Only one frame can be written at a time
+	wmtx sync.Mutex
+
+	mtx     sync.Mutex
+	nextID  uint32
+	streams map[uint32]*muxStream
+
+	accepts   chan *muxStream
+	controls  chan []byte
+	datagrams chan muxDatagram
+	closed    chan struct{}
+	closeOnce sync.Once
+	err       error
+
+	// Number of pings sent since the last pong, whether the peer has sent a
+	// heartbeat, and whether a ping is being written
+	missed, peerPings, pinging int32
+
+	// Frames written in response to the peer's, which the read loop can't
+	// wait on in case the peer isn't reading. A pending pong and the resets
+	// of each stream are coalesced until the control writer gets to them.
+	ctlMtx  sync.Mutex
+	ctlWake chan struct{}
+	pong    bool
+	resets  map[uint32]bool
+}
+
+// newMuxSession starts a session over the connection. The client (the side
+// that made the connection) opens even numbered streams and the other side
+// opens odd numbered ones.
+func newMuxSession(c net.Conn, client bool) *muxSession {
+	ms := &muxSession{
+		conn:      c,
+		client:    client,
+		nextID:    1,
+		streams:   make(map[uint32]*muxStream),
+		accepts:   make(chan *muxStream, muxAcceptBacklog),
+		controls:  make(chan []byte, muxControlBacklog),
+		datagrams: make(chan muxDatagram, muxDatagramBacklog),
+		closed:    make(chan struct{}),
+		ctlWake:   make(chan struct{}, 1),
+		resets:    make(map[uint32]bool),
+	}
+	if client {
+		ms.nextID = 2
+	}
+	go ms.readLoop()
+	go ms.writeControls()
+	return ms
+}
+
+// Open opens a new stream.
+func (ms *muxSession) Open() (*muxStream, error) {
+	return ms.OpenService("")
+}
+
+// OpenService opens a new stream for the tunnel service registered with the
+// path. The tunnel's own server is used if the path is empty.
+func (ms *muxSession) OpenService(path string) (*muxStream, error) {
+	ms.mtx.Lock()
+	select {
+	case <-ms.closed:
+		ms.mtx.Unlock()
+		return nil, ErrMuxClosed
+	default:
+	}
+	id := ms.nextID
+	ms.nextID += 2
+	st := newMuxStream(ms, id)
+	st.service = path
+	ms.streams[id] = st
+	ms.mtx.Unlock()
+	if err := ms.writeFrame(frameOpen, id, []byte(path)); err != nil {
+		ms.removeStream(id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept waits for the peer to open a stream.
+func (ms *muxSession) Accept() (*muxStream, error) {
+	select {
+	case st := <-ms.accepts:
+		return st, nil
+	case <-ms.closed:
+		return nil, ms.err
+	}
+}
+
+// Control returns the chan control messages sent by the peer are passed on.
+func (ms *muxSession) Control() <-chan []byte {
+	return ms.controls
+}
+
+// muxDatagram is a datagram received from the peer.
+type muxDatagram struct {
+	flow    uint32
+	payload []byte
+}
+
+// Datagrams returns the chan datagrams sent by the peer are passed on.
+func (ms *muxSession) Datagrams() <-chan muxDatagram {
+	return ms.datagrams
+}
+
+// Done returns a chan that's closed once the session is closed.
+func (ms *muxSession) Done() <-chan struct{} {
+	return ms.closed
+}
+
+// Err returns the error the session was closed with, if it's closed.
+func (ms *muxSession) Err() error {
+	select {
+	case <-ms.closed:
+		return ms.err
+	default:
+		return nil
+	}
+}
+
+// Close closes the session and the connection, resetting all its streams.
+func (ms *muxSession) Close() error {
+	ms.closeWithError(ErrMuxClosed)
+	return nil
+}
+
+func (ms *muxSession) closeWithError(err error) {
+	ms.closeOnce.Do(func() {
+		ms.mtx.Lock()
+		ms.err = err
+		close(ms.closed)
+		streams := ms.streams
+		ms.streams = make(map[uint32]*muxStream)
+		ms.mtx.Unlock()
+		ms.conn.Close()
+		for _, st := range streams {
+			st.fail(ErrMuxClosed)
+		}
+	})
+}
+
+func (ms *muxSession) writeFrame(typ byte, id uint32, payload []byte) error {
+	buf := make([]byte, muxHeaderLen+len(payload))
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[1:5], id)
+	binary.BigEndian.PutUint32(buf[5:9], uint32(len(payload)))
+	copy(buf[muxHeaderLen:], payload)
+	ms.wmtx.Lock()
+	defer ms.wmtx.Unlock()
+	select {
+	case <-ms.closed:
+		return ErrMuxClosed
+	default:
+	}
+	if _, err := ms.conn.Write(buf); err != nil {
+		ms.closeWithError(err)
+		return err
+	}
+	return nil
+}
+
+// queuePong has the control writer answer a ping.
+func (ms *muxSession) queuePong() {
+	ms.ctlMtx.Lock()
+	ms.pong = true
+	ms.ctlMtx.Unlock()
+	ms.wakeControls()
+}
+
+// queueReset has the control writer reset the stream. An error is returned if
+// too many streams are waiting to be reset.
+func (ms *muxSession) queueReset(id uint32) error {
+	ms.ctlMtx.Lock()
+	if len(ms.resets) >= muxMaxPendingResets && !ms.resets[id] {
+		ms.ctlMtx.Unlock()
+		return fmt.Errorf("too many pending tunnel stream resets")
+	}
+	ms.resets[id] = true
+	ms.ctlMtx.Unlock()
+	ms.wakeControls()
+	return nil
+}
+
+func (ms *muxSession) wakeControls() {
+	select {
+	case ms.ctlWake <- struct{}{}:
+	default:
+	}
+}
+
+// writeControls writes the queued pong and resets until the session is
+// closed.
+func (ms *muxSession) writeControls() {
+	for {
+		select {
+		case <-ms.ctlWake:
+		case <-ms.closed:
+			return
+		}
+		ms.ctlMtx.Lock()
+		pong, resets := ms.pong, ms.resets
+		ms.pong, ms.resets = false, make(map[uint32]bool)
+		ms.ctlMtx.Unlock()
+		if pong {
+			if err := ms.writeFrame(framePong, 0, nil); err != nil {
+				return
+			}
+		}
+		for id := range resets {
+			if err := ms.writeFrame(frameReset, id, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (ms *muxSession) stream(id uint32) *muxStream {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	return ms.streams[id]
+}
+
+func (ms *muxSession) removeStream(id uint32) {
+	ms.mtx.Lock()
+	defer ms.mtx.Unlock()
+	delete(ms.streams, id)
+}
+
+func (ms *muxSession) readLoop() {
+	var hdr [muxHeaderLen]byte
+	for {
+		if _, err := io.ReadFull(ms.conn, hdr[:]); err != nil {
+			ms.closeWithError(err)
+			return
+		}
+		typ, id := hdr[0], binary.BigEndian.Uint32(hdr[1:5])
+		n := binary.BigEndian.Uint32(hdr[5:9])
+		if n > muxMaxPayload {
+			ms.closeWithError(fmt.Errorf("tunnel frame too large: %d bytes", n))
+			return
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(ms.conn, payload); err != nil {
+			ms.closeWithError(err)
+			return
+		}
+		if err := ms.handleFrame(typ, id, payload); err != nil {
+			ms.closeWithError(err)
+			return
+		}
+	}
+}
+
+func (ms *muxSession) handleFrame(typ byte, id uint32, payload []byte) error {
+	switch typ {
+	case frameOpen:
+		// The peer opens odd numbered streams if this is the client. 0 is
+		// never a stream's ID.
+		if id == 0 || (id%2 == 0) == ms.client {
+			return fmt.Errorf("peer opened stream with bad ID %d", id)
+		}
+		st := newMuxStream(ms, id)
+		st.service = string(payload)
+		ms.mtx.Lock()
+		if _, ok := ms.streams[id]; ok {
+			ms.mtx.Unlock()
+			return fmt.Errorf("peer opened existing stream %d", id)
+		}
+		ms.streams[id] = st
+		ms.mtx.Unlock()
+		select {
+		case ms.accepts <- st:
+		default:
+			// Too many streams waiting to be accepted
+			ms.removeStream(id)
+			return ms.queueReset(id)
+		}
+	case frameData:
+		st := ms.stream(id)
+		if st == nil {
+			return ms.queueReset(id)
+		}
+		return st.push(payload)
+	case frameClose:
+		if st := ms.stream(id); st != nil {
+			st.remoteClose()
+		}
+	case frameReset:
+		if st := ms.stream(id); st != nil {
+			ms.removeStream(id)
+			st.fail(ErrStreamReset)
+		}
+	case frameWindow:
+		if len(payload) != 4 {
+			return fmt.Errorf("bad window update for stream %d", id)
+		}
+		if st := ms.stream(id); st != nil {
+			st.addWindow(int(binary.BigEndian.Uint32(payload)))
+		}
+	case framePing:
+		ms.gotHeartbeat(false)
+		ms.queuePong()
+	case framePong:
+		ms.gotHeartbeat(true)
+	case frameControl:
+		select {
+		case ms.controls <- payload:
+		default:
+			return fmt.Errorf("too many unhandled tunnel control messages")
+		}
+	case frameDatagram:
+		select {
+		case ms.datagrams <- muxDatagram{flow: id, payload: payload}:
+		default:
+			// Datagrams can be dropped
+		}
+	}
+	// Unknown frame types are ignored
+	return nil
+}
+
+// muxStream is a stream of a muxSession. It implements net.Conn.
+type muxStream struct {
+	sess *muxSession
+	id   uint32
+	// Path of the tunnel service the stream is for, if any
+	service string
+
+	mtx sync.Mutex
+	buf bytes.Buffer
+	// Number of bytes the peer can still send and the number read but not
+	// yet given back to the peer
+	recvWindow, unacked int
+	sendWindow          int
+	// Whether the peer has sent a close, this side has sent a close, and if
+	// Close has been called
+	remoteClosed, localClosed, closed bool
+	err                               error
+	readDeadline, writeDeadline       time.Time
+	// Signaled when something a blocked Read or Write is waiting on changes
+	readCh, writeCh chan struct{}
+}
+
+func newMuxStream(ms *muxSession, id uint32) *muxStream {
+	return &muxStream{
+		sess:       ms,
+		id:         id,
+		recvWindow: muxInitialWindow,
+		sendWindow: muxInitialWindow,
+		readCh:     make(chan struct{}, 1),
+		writeCh:    make(chan struct{}, 1),
+	}
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// waitSignal waits for the chan to be signaled or the deadline to pass.
+func waitSignal(ch chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func (st *muxStream) Read(p []byte) (int, error) {
+	for {
+		st.mtx.Lock()
+		if st.closed {
+			st.mtx.Unlock()
+			return 0, net.ErrClosed
+		} else if st.err != nil {
+			st.mtx.Unlock()
+			return 0, st.err
+		} else if st.buf.Len() != 0 {
+			n, _ := st.buf.Read(p)
+			st.unacked += n
+			inc := 0
+			if st.unacked >= muxInitialWindow/2 && !st.remoteClosed {
+				inc, st.unacked = st.unacked, 0
+				st.recvWindow += inc
+			}
+			st.mtx.Unlock()
+			if inc != 0 {
+				var b [4]byte
+				binary.BigEndian.PutUint32(b[:], uint32(inc))
+				st.sess.writeFrame(frameWindow, st.id, b[:])
+			}
+			return n, nil
+		} else if st.remoteClosed {
+			st.mtx.Unlock()
+			return 0, io.EOF
+		}
+		deadline := st.readDeadline
+		st.mtx.Unlock()
+		if err := waitSignal(st.readCh, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (st *muxStream) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) != 0 {
+		st.mtx.Lock()
+		if st.closed || st.localClosed {
+			st.mtx.Unlock()
+			return total, net.ErrClosed
+		} else if st.err != nil {
+			st.mtx.Unlock()
+			return total, st.err
+		} else if !st.writeDeadline.IsZero() && !time.Now().Before(st.writeDeadline) {
+			st.mtx.Unlock()
+			return total, os.ErrDeadlineExceeded
+		} else if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.mtx.Unlock()
+			if err := waitSignal(st.writeCh, deadline); err != nil {
+				return total, err
+			}
+			continue
+		}
+		n := len(p)
+		if n > st.sendWindow {
+			n = st.sendWindow
+		}
+		if n > muxMaxPayload {
+			n = muxMaxPayload
+		}
+		st.sendWindow -= n
+		st.mtx.Unlock()
+		if err := st.sess.writeFrame(frameData, st.id, p[:n]); err != nil {
+			return total, err
+		}
+		total += n
+		p = p[n:]
+	}
+	return total, nil
+}
+
+// CloseWrite tells the peer no more data will be written.
+func (st *muxStream) CloseWrite() error {
+	st.mtx.Lock()
+	if st.closed || st.localClosed || st.err != nil {
+		st.mtx.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	done := st.remoteClosed
+	st.mtx.Unlock()
+	if done {
+		st.sess.removeStream(st.id)
+	}
+	return st.sess.writeFrame(frameClose, st.id, nil)
+}
+
+// Close closes the stream. Data the peer sends afterwards gets the stream
+// reset.
+func (st *muxStream) Close() error {
+	st.mtx.Lock()
+	if st.closed {
+		st.mtx.Unlock()
+		return nil
+	}
+	st.closed = true
+	sendClose := !st.localClosed && st.err == nil
+	st.localClosed = true
+	st.mtx.Unlock()
+	signal(st.readCh)
+	signal(st.writeCh)
+	st.sess.removeStream(st.id)
+	if sendClose {
+		return st.sess.writeFrame(frameClose, st.id, nil)
+	}
+	return nil
+}
+
+// push adds data received from the peer.
+func (st *muxStream) push(p []byte) error {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	if len(p) > st.recvWindow {
+		return fmt.Errorf("peer exceeded window of stream %d", st.id)
+	}
+	st.recvWindow -= len(p)
+	if st.closed || st.err != nil {
+		return nil
+	}
+	st.buf.Write(p)
+	signal(st.readCh)
+	return nil
+}
+
+func (st *muxStream) remoteClose() {
+	st.mtx.Lock()
+	st.remoteClosed = true
+	done := st.localClosed
+	st.mtx.Unlock()
+	signal(st.readCh)
+	if done {
+		st.sess.removeStream(st.id)
+	}
+}
+
+func (st *muxStream) addWindow(n int) {
+	st.mtx.Lock()
+	st.sendWindow += n
+	st.mtx.Unlock()
+	signal(st.writeCh)
+}
+
+// fail fails all future reads and writes with the error.
+func (st *muxStream) fail(err error) {
+	st.mtx.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.mtx.Unlock()
+	signal(st.readCh)
+	signal(st.writeCh)
+}
+
+func (st *muxStream) LocalAddr() net.Addr {
+	return st.sess.conn.LocalAddr()
+}
+
+func (st *muxStream) RemoteAddr() net.Addr {
+	return st.sess.conn.RemoteAddr()
+}
+
+func (st *muxStream) SetDeadline(t time.Time) error {
+	st.mtx.Lock()
+	st.readDeadline, st.writeDeadline = t, t
+	st.mtx.Unlock()
+	signal(st.readCh)
+	signal(st.writeCh)
+	return nil
+}
+
+func (st *muxStream) SetReadDeadline(t time.Time) error {
+	st.mtx.Lock()
+	st.readDeadline = t
+	st.mtx.Unlock()
+	signal(st.readCh)
+	return nil
+}
+
+func (st *muxStream) SetWriteDeadline(t time.Time) error {
+	st.mtx.Lock()
+	st.writeDeadline = t
+	st.mtx.Unlock()
+	signal(st.writeCh)
+	return nil
+}
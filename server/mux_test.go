@@ -0,0 +1,311 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// muxPair returns a client and server session connected to each other.
+func muxPair(t *testing.T) (client, server *muxSession) {
+	c1, c2 := net.Pipe()
+	client, server = newMuxSession(c1, true), newMuxSession(c2, false)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// muxFrame encodes a frame the way a peer would send it.
+func muxFrame(typ byte, id uint32, payload []byte) []byte {
+	buf := make([]byte, muxHeaderLen+len(payload))
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[1:5], id)
+	binary.BigEndian.PutUint32(buf[5:9], uint32(len(payload)))
+	copy(buf[muxHeaderLen:], payload)
+	return buf
+}
+
+func TestMuxStreams(t *testing.T) {
+	client, server := muxPair(t)
+	tests := []struct {
+		name    string
+		opener  *muxSession
+		accepts *muxSession
+		service string
+		// Parity of the IDs of the opener's streams
+		odd bool
+	}{
+		{"client opens", client, server, "", false},
+		{"client opens service", client, server, "svc", false},
+		{"server opens", server, client, "", true},
+		{"server opens service", server, client, "svc", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			st, err := test.opener.OpenService(test.service)
+			if err != nil {
+				t.Fatal(err)
+			} else if (st.id%2 == 1) != test.odd {
+				t.Fatalf("opened stream with ID %d", st.id)
+			}
+			peer, err := test.accepts.Accept()
+			if err != nil {
+				t.Fatal(err)
+			} else if peer.id != st.id || peer.service != test.service {
+				t.Fatalf("accepted stream %d for %q, want %d for %q", peer.id, peer.service, st.id, test.service)
+			}
+			go func() {
+				st.Write([]byte("ping"))
+				st.CloseWrite()
+			}()
+			got, err := io.ReadAll(peer)
+			if err != nil || string(got) != "ping" {
+				t.Fatalf("got %q, %v", got, err)
+			}
+			go func() {
+				peer.Write([]byte("pong"))
+				peer.Close()
+			}()
+			if got, err = io.ReadAll(st); err != nil || string(got) != "pong" {
+				t.Fatalf("got %q, %v", got, err)
+			}
+			st.Close()
+		})
+	}
+}
+
+func TestMuxFlowControl(t *testing.T) {
+	client, server := muxPair(t)
+	st, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing is read so writing stops once the window is used up
+	data := bytes.Repeat([]byte("0123456789abcdef"), muxInitialWindow/8)
+	st.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := st.Write(data)
+	if n != muxInitialWindow || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("wrote %d bytes with %v, want %d bytes", n, err, muxInitialWindow)
+	}
+	// Reading gives the window back
+	st.SetWriteDeadline(time.Time{})
+	go func() {
+		st.Write(data[n:])
+		st.Close()
+	}()
+	got, err := io.ReadAll(peer)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes that don't match the %d written", len(got), len(data))
+	}
+}
+
+func TestMuxOpenConcurrently(t *testing.T) {
+	client, server := muxPair(t)
+	const n = 16
+	errs := make(chan error, 2*n)
+	for _, ms := range []*muxSession{client, server} {
+		go func(ms *muxSession) {
+			for i := 0; i < n; i++ {
+				_, err := ms.Open()
+				errs <- err
+			}
+		}(ms)
+		go func(ms *muxSession) {
+			for i := 0; i < n; i++ {
+				ms.Accept()
+			}
+		}(ms)
+	}
+	for i := 0; i < 2*n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Streams opened by each side while the other opened its own weren't
+	// taken as having the wrong parity
+	if err := client.Err(); err != nil {
+		t.Fatal(err)
+	} else if err := server.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMuxControlsCoalesced(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	ms := newMuxSession(c1, true)
+	defer ms.Close()
+	// Nothing is read until all the frames are sent so the pongs and resets
+	// they get back pile up
+	const n = 100
+	for i := 0; i < n; i++ {
+		c2.Write(muxFrame(framePing, 0, nil))
+		c2.Write(muxFrame(frameData, 7, nil))
+	}
+	var pongs, resets int
+	hdr := make([]byte, muxHeaderLen)
+	for {
+		c2.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		if _, err := io.ReadFull(c2, hdr); err != nil {
+			break
+		}
+		switch hdr[0] {
+		case framePong:
+			pongs++
+		case frameReset:
+			resets++
+		}
+	}
+	// One of each is written while the other frames pile up, give or take
+	// the batches written as the last frames are handled
+	if pongs == 0 || pongs > 3 || resets == 0 || resets > 3 {
+		t.Fatalf("got %d pongs and %d resets for %d pings and data frames", pongs, resets, n)
+	}
+}
+
+func TestMuxBadFrames(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames [][]byte
+		err    string
+		// Whether the session the frames are sent to is the server's
+		server bool
+	}{
+		{
+			name:   "stream opened with the client's parity",
+			frames: [][]byte{muxFrame(frameOpen, 2, nil)},
+			err:    "bad ID",
+		},
+		{
+			name:   "stream 0 opened",
+			frames: [][]byte{muxFrame(frameOpen, 0, nil)},
+			err:    "bad ID",
+			server: true,
+		},
+		{
+			name:   "stream opened twice",
+			frames: [][]byte{muxFrame(frameOpen, 1, nil), muxFrame(frameOpen, 1, nil)},
+			err:    "existing stream",
+		},
+		{
+			name:   "frame too large",
+			frames: [][]byte{muxFrame(frameData, 1, make([]byte, muxMaxPayload+1))},
+			err:    "too large",
+		},
+		{
+			name:   "bad window update",
+			frames: [][]byte{muxFrame(frameWindow, 1, []byte{1})},
+			err:    "bad window",
+		},
+		{
+			name: "window exceeded",
+			frames: func() [][]byte {
+				frames := [][]byte{muxFrame(frameOpen, 1, nil)}
+				for i := 0; i <= muxInitialWindow/muxMaxPayload; i++ {
+					frames = append(frames, muxFrame(frameData, 1, make([]byte, muxMaxPayload)))
+				}
+				return frames
+			}(),
+			err: "exceeded window",
+		},
+		{
+			// The peer doesn't read the resets, and a batch of them may already
+			// be being written
+			name: "too many resets",
+			frames: func() [][]byte {
+				var frames [][]byte
+				for id := uint32(1); id <= 4*muxMaxPendingResets; id++ {
+					frames = append(frames, muxFrame(frameData, id, nil))
+				}
+				return frames
+			}(),
+			err: "pending tunnel stream resets",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c1, c2 := net.Pipe()
+			defer c2.Close()
+			ms := newMuxSession(c1, !test.server)
+			defer ms.Close()
+			go func() {
+				for _, f := range test.frames {
+					if _, err := c2.Write(f); err != nil {
+						return
+					}
+				}
+			}()
+			select {
+			case <-ms.Done():
+			case <-time.After(time.Second):
+				t.Fatal("session wasn't closed")
+			}
+			if err := ms.Err(); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("got error %v, want one containing %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestMuxUnknownStream(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	ms := newMuxSession(c1, false)
+	defer ms.Close()
+	go c2.Write(muxFrame(frameData, 7, []byte("x")))
+	var hdr [muxHeaderLen]byte
+	c2.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(c2, hdr[:]); err != nil {
+		t.Fatal(err)
+	} else if hdr[0] != frameReset || binary.BigEndian.Uint32(hdr[1:5]) != 7 {
+		t.Fatalf("got frame type %d for stream %d, want a reset of 7", hdr[0], binary.BigEndian.Uint32(hdr[1:5]))
+	}
+}
+
+func TestMuxDatagrams(t *testing.T) {
+	client, server := muxPair(t)
+	payload := encodeDatagram("svc", []byte("hello"))
+	if err := client.writeFrame(frameDatagram, 3, payload); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case dg := <-server.Datagrams():
+		if dg.flow != 3 || !bytes.Equal(dg.payload, payload) {
+			t.Fatalf("got datagram %+v", dg)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("datagram not received")
+	}
+}
+
+func TestMuxClose(t *testing.T) {
+	client, server := muxPair(t)
+	st, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+	if _, err := st.Read(make([]byte, 1)); err != ErrMuxClosed {
+		t.Fatalf("read from stream of closed session got %v", err)
+	}
+	if _, err := client.Open(); err != ErrMuxClosed {
+		t.Fatalf("open on closed session got %v", err)
+	}
+}
@@ -0,0 +1,312 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OutlierDetection configures passive ejection of targets based on the
+// results of proxied requests. Errors are failures to get a response (e.g.,
+// dial errors) and 5xx responses.
+type OutlierDetection struct {
+	// ConsecutiveErrors is the number of errors in a row that gets a target
+	// ejected. Defaults to 5. Negative disables.
+	ConsecutiveErrors int `json:"consecutiveErrors,omitempty"`
+	// ErrorRate is the fraction (0-1) of requests in a window that must be
+	// errors for a target to be ejected. 0 disables.
+	ErrorRate float64 `json:"errorRate,omitempty"`
+	// MinRequests is the number of requests a window must have for the error
+	// rate to be checked. Defaults to 20.
+	MinRequests int `json:"minRequests,omitempty"`
+	// Window is the length of the window the error rate is calculated over.
+	// Defaults to 30s.
+	Window Duration `json:"window,omitempty"`
+	// BaseEjection is how long a target is ejected for the first time. It's
+	// doubled for each ejection that happens soon after the previous.
+	// Defaults to 30s.
+	BaseEjection Duration `json:"baseEjection,omitempty"`
+	// MaxEjection is the longest a target is ejected for. Defaults to 5m.
+	MaxEjection Duration `json:"maxEjection,omitempty"`
+	// MaxEjectionPercent is the percentage (0-100) of the server's targets
+	// that can be ejected at once. Defaults to 50. One target can be ejected
+	// even if that's over the percentage, but at least one is always left.
+	MaxEjectionPercent int `json:"maxEjectionPercent,omitempty"`
+}
+
+func (od *OutlierDetection) validate() error {
+	if od.ErrorRate < 0 || od.ErrorRate > 1 {
+		return fmt.Errorf("outlier error rate must be between 0 and 1")
+	} else if od.Window < 0 || od.BaseEjection < 0 || od.MaxEjection < 0 {
+		return fmt.Errorf("outlier durations can't be negative")
+	} else if od.MaxEjectionPercent < 0 || od.MaxEjectionPercent > 100 {
+		return fmt.Errorf("outlier max ejection percent must be between 0 and 100")
+	}
+	return nil
+}
+
+func (od *OutlierDetection) consecutiveErrors() int {
+	if od.ConsecutiveErrors == 0 {
+		return 5
+	}
+	return od.ConsecutiveErrors
+}
+
+func (od *OutlierDetection) minRequests() int {
+	if od.MinRequests <= 0 {
+		return 20
+	}
+	return od.MinRequests
+}
+
+func (od *OutlierDetection) window() time.Duration {
+	return od.Window.Or(30 * time.Second)
+}
+
+func (od *OutlierDetection) baseEjection() time.Duration {
+	return od.BaseEjection.Or(30 * time.Second)
+}
+
+func (od *OutlierDetection) maxEjection() time.Duration {
+	return od.MaxEjection.Or(5 * time.Minute)
+}
+
+func (od *OutlierDetection) maxEjectionPercent() int {
+	if od.MaxEjectionPercent == 0 {
+		return 50
+	}
+	return od.MaxEjectionPercent
+}
+
+// maxEjected returns the number of targets out of total that can be ejected
+// at once.
+func (od *OutlierDetection) maxEjected(total int) int {
+	n := total * od.maxEjectionPercent() / 100
+	if n < 1 {
+		n = 1
+	}
+	if n > total-1 {
+		n = total - 1
+	}
+	return n
+}
+
+// outlierState tracks the results of requests to a target.
+type outlierState struct {
+	// Unix nano time the current ejection ends
+	ejectedUntil int64
+	// Total number of times the target has been ejected
+	totalEjections int64
+
+	mtx         sync.Mutex
+	consecutive int
+	windowStart time.Time
+	requests    int
+	errors      int
+	// Number of ejections that have happened close together, used to back
+	// off the ejection time
+	ejections int
+}
+
+// Ejected returns whether the target has been ejected due to errors.
+func (t *Target) Ejected() bool {
+	return time.Now().UnixNano() < atomic.LoadInt64(&t.outlier.ejectedUntil)
+}
+
+// EjectedUntil returns the time the target's current (or last) ejection ends.
+func (t *Target) EjectedUntil() time.Time {
+	if until := atomic.LoadInt64(&t.outlier.ejectedUntil); until != 0 {
+		return time.Unix(0, until)
+	}
+	return time.Time{}
+}
+
+// TotalEjections returns the number of times the target has been ejected.
+func (t *Target) TotalEjections() int64 {
+	return atomic.LoadInt64(&t.outlier.totalEjections)
+}
+
+// EjectionEvent records a target being ejected.
+type EjectionEvent struct {
+	Target string    `json:"target"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+	Until  time.Time `json:"until"`
+}
+
+// Number of ejection events each server keeps
+const ejectionLogLen = 32
+
+// ejectionLog holds a server's most recent ejection events.
+type ejectionLog struct {
+	mtx    sync.Mutex
+	events []EjectionEvent
+	// Held while checking if a target can be ejected and ejecting it so
+	// concurrent ejections can't go over the max
+	ejectMtx sync.Mutex
+}
+
+func (el *ejectionLog) add(ev EjectionEvent) {
+	el.mtx.Lock()
+	defer el.mtx.Unlock()
+	if len(el.events) == ejectionLogLen {
+		copy(el.events, el.events[1:])
+		el.events = el.events[:len(el.events)-1]
+	}
+	el.events = append(el.events, ev)
+}
+
+func (el *ejectionLog) get() []EjectionEvent {
+	el.mtx.Lock()
+	defer el.mtx.Unlock()
+	return append([]EjectionEvent(nil), el.events...)
+}
+
+// RecentEjections returns the server's most recent ejection events, oldest
+// first.
+func (s *Server) RecentEjections() []EjectionEvent {
+	if s.ejections == nil {
+		return nil
+	}
+	return s.ejections.get()
+}
+
+// recordResult records the result of a request to a target, ejecting it if
+// needed.
+func (s *Server) recordResult(t *Target, failed bool) {
+	od := s.Outlier
+	if od == nil {
+		return
+	}
+	st := &t.outlier
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	now := time.Now()
+	if now.Sub(st.windowStart) >= od.window() {
+		st.windowStart, st.requests, st.errors = now, 0, 0
+	}
+	st.requests++
+	if !failed {
+		st.consecutive = 0
+		return
+	}
+	st.errors++
+	st.consecutive++
+	var reason string
+	if n := od.consecutiveErrors(); n > 0 && st.consecutive >= n {
+		reason = fmt.Sprintf("%d consecutive errors", st.consecutive)
+	} else if od.ErrorRate > 0 && st.requests >= od.minRequests() {
+		if rate := float64(st.errors) / float64(st.requests); rate >= od.ErrorRate {
+			reason = fmt.Sprintf(
+				"error rate %.2f (%d/%d requests)", rate, st.errors, st.requests,
+			)
+		}
+	}
+	if reason == "" || t.Ejected() {
+		return
+	}
+	s.ejections.ejectMtx.Lock()
+	defer s.ejections.ejectMtx.Unlock()
+	if !s.canEject() {
+		return
+	}
+	// Reset the backoff if the last ejection was a while ago
+	if now.Sub(t.EjectedUntil()) > od.maxEjection() {
+		st.ejections = 0
+	}
+	dur := od.baseEjection() << st.ejections
+	if dur > od.maxEjection() || dur <= 0 {
+		dur = od.maxEjection()
+	} else {
+		st.ejections++
+	}
+	until := now.Add(dur)
+	atomic.StoreInt64(&st.ejectedUntil, until.UnixNano())
+	atomic.AddInt64(&st.totalEjections, 1)
+	st.consecutive, st.windowStart, st.requests, st.errors = 0, now, 0, 0
+	s.ejections.add(EjectionEvent{Target: t.Addr, Reason: reason, Time: now, Until: until})
+	Logger.Printf("ejected target %s of %s for %s: %s", t.Addr, s.Path, dur, reason)
+}
+
+// canEject returns whether another of the server's targets can be ejected.
+func (s *Server) canEject() bool {
+	if s.pool == nil {
+		return false
+	}
+	targets := s.pool.getTargets()
+	ejected := 0
+	for _, t := range targets {
+		if t.Ejected() {
+			ejected++
+		}
+	}
+	return ejected < s.Outlier.maxEjected(len(targets))
+}
+
+// proxyState holds the state of a request being proxied by a Server.
+type proxyState struct {
+	// The target the request was sent to
+	target *Target
+	// Whether the result of the request is known and if it failed
+	known, failed bool
+}
+
+type proxyStateKey struct{}
+
+func withProxyState(r Req) (Req, *proxyState) {
+	ps := &proxyState{}
+	return r.WithContext(context.WithValue(r.Context(), proxyStateKey{}, ps)), ps
+}
+
+func getProxyState(ctx context.Context) *proxyState {
+	ps, _ := ctx.Value(proxyStateKey{}).(*proxyState)
+	return ps
+}
+
+// recordProxyError records an error from the server's proxy against the
+// target the request was sent to.
+func (s *Server) recordProxyError(r Req, err error) {
+	ps := getProxyState(r.Context())
+	if ps == nil {
+		return
+	}
+	// Errors from the client going away aren't the server's fault
+	if errors.Is(err, context.Canceled) && r.Context().Err() != nil {
+		return
+	}
+	ps.known, ps.failed = true, true
+	if ps.target != nil {
+		s.recordResult(ps.target, true)
+	}
+}
+
+// handleProxyError is the ErrorHandler of the server's proxy if one isn't
+// set.
+func (s *Server) handleProxyError(w RW, r Req, err error) {
+	s.recordProxyError(r, err)
+	Logger.Printf("proxy error for %s: %v", s.Path, err)
+	if errors.Is(err, ErrNoTargets) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	} else if errors.Is(err, context.DeadlineExceeded) {
+		w.WriteHeader(http.StatusGatewayTimeout)
+	} else {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+}
+
+// handleProxyResponse is called from the ModifyResponse of the server's
+// proxy.
+func (s *Server) handleProxyResponse(resp *http.Response) {
+	ps := getProxyState(resp.Request.Context())
+	if ps == nil {
+		return
+	}
+	ps.known, ps.failed = true, resp.StatusCode >= 500
+	if ps.target != nil {
+		s.recordResult(ps.target, ps.failed)
+	}
+}
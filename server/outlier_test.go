@@ -0,0 +1,144 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+// outlierServer returns a server with outlier detection and n targets.
+func outlierServer(t *testing.T, od *OutlierDetection, n int) *Server {
+	weights := make([]int, n)
+	for i := range weights {
+		weights[i] = 1
+	}
+	targets := testTargets(t, weights...)
+	pool, err := newTargetPool(&roundRobinBalancer{}, targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Server{Path: "s", Outlier: od, Targets: targets, pool: pool, ejections: &ejectionLog{}}
+}
+
+func TestOutlierEjection(t *testing.T) {
+	tests := []struct {
+		name string
+		od   OutlierDetection
+		// Results of the requests, true for a failure
+		failed  []bool
+		ejected bool
+	}{
+		{
+			name:    "consecutive errors",
+			failed:  []bool{true, true, true, true, true},
+			ejected: true,
+		},
+		{
+			name:   "success resets consecutive errors",
+			failed: []bool{true, true, true, true, false, true},
+		},
+		{
+			name:    "custom consecutive errors",
+			od:      OutlierDetection{ConsecutiveErrors: 2},
+			failed:  []bool{true, true},
+			ejected: true,
+		},
+		{
+			name:   "consecutive errors disabled",
+			od:     OutlierDetection{ConsecutiveErrors: -1},
+			failed: []bool{true, true, true, true, true, true},
+		},
+		{
+			name:    "error rate",
+			od:      OutlierDetection{ConsecutiveErrors: -1, ErrorRate: 0.5, MinRequests: 4},
+			failed:  []bool{false, true, false, true},
+			ejected: true,
+		},
+		{
+			name:   "error rate under min requests",
+			od:     OutlierDetection{ConsecutiveErrors: -1, ErrorRate: 0.5, MinRequests: 5},
+			failed: []bool{true, false, true, false},
+		},
+		{
+			name:   "error rate under threshold",
+			od:     OutlierDetection{ConsecutiveErrors: -1, ErrorRate: 0.5, MinRequests: 4},
+			failed: []bool{true, false, false, false, true},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := outlierServer(t, &test.od, 2)
+			target := s.Targets[0]
+			for _, failed := range test.failed {
+				s.recordResult(target, failed)
+			}
+			if target.Ejected() != test.ejected {
+				t.Fatalf("got ejected %v", target.Ejected())
+			}
+			if events := s.RecentEjections(); (len(events) == 1) != test.ejected {
+				t.Fatalf("got ejection events %+v", events)
+			} else if test.ejected && events[0].Target != target.Addr {
+				t.Fatalf("got ejection of %s", events[0].Target)
+			}
+		})
+	}
+}
+
+func TestOutlierEjectionBackoff(t *testing.T) {
+	const base = time.Minute
+	s := outlierServer(t, &OutlierDetection{
+		ConsecutiveErrors: 1,
+		BaseEjection:      Duration(base),
+		MaxEjection:       Duration(5 * base),
+	}, 2)
+	target := s.Targets[0]
+	for i, want := range []time.Duration{base, 2 * base, 4 * base, 5 * base, 5 * base} {
+		start := time.Now()
+		s.recordResult(target, true)
+		if got := target.EjectedUntil().Sub(start); got < want || got > want+time.Second {
+			t.Fatalf("ejection %d: ejected for %s, want %s", i, got, want)
+		}
+		// End the ejection as if it had run out
+		target.outlier.ejectedUntil = time.Now().UnixNano()
+	}
+	if n := target.TotalEjections(); n != 5 {
+		t.Fatalf("got %d total ejections", n)
+	}
+}
+
+func TestOutlierMaxEjection(t *testing.T) {
+	tests := []struct {
+		name    string
+		percent int
+		targets int
+		// Number of targets that fail, in order
+		failing int
+		ejected int
+	}{
+		{"single target never ejected", 0, 1, 1, 0},
+		{"default half", 0, 4, 4, 2},
+		{"one of two", 0, 2, 2, 1},
+		{"percent", 25, 8, 8, 2},
+		{"at least one", 10, 3, 3, 1},
+		{"always one left", 100, 3, 3, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := outlierServer(t, &OutlierDetection{
+				ConsecutiveErrors:  1,
+				MaxEjectionPercent: test.percent,
+			}, test.targets)
+			for _, target := range s.Targets[:test.failing] {
+				s.recordResult(target, true)
+			}
+			ejected := 0
+			for _, target := range s.Targets {
+				if target.Ejected() {
+					ejected++
+				}
+			}
+			if ejected != test.ejected {
+				t.Fatalf("got %d ejected, want %d", ejected, test.ejected)
+			}
+		})
+	}
+}
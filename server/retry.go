@@ -0,0 +1,323 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Conditions a RetryPolicy can retry on
+const (
+	// RetryOnConnectError retries when a connection to the target can't be
+	// made
+	RetryOnConnectError = "connect-error"
+	// RetryOnTimeout retries when the per-try timeout is hit
+	RetryOnTimeout = "timeout"
+	// RetryOn5xx retries on any 5xx status
+	RetryOn5xx = "5xx"
+)
+
+// RetryPolicy configures retrying failed requests to a server's targets.
+type RetryPolicy struct {
+	// MaxAttempts is the max number of attempts, including the first.
+	// Defaults to 2.
+	MaxAttempts int `json:"maxAttempts,omitempty"`
+	// PerTryTimeout is how long each attempt has to get a response (headers).
+	// No timeout if 0.
+	PerTryTimeout Duration `json:"perTryTimeout,omitempty"`
+	// RetryOn holds the conditions to retry on (see the RetryOn constants).
+	// Defaults to ["connect-error"].
+	RetryOn []string `json:"retryOn,omitempty"`
+	// RetryStatuses holds specific statuses to retry on
+	RetryStatuses []int `json:"retryStatuses,omitempty"`
+	// NonIdempotent allows requests with non-idempotent methods (e.g., POST)
+	// to be retried.
+	NonIdempotent bool `json:"nonIdempotent,omitempty"`
+	// BudgetPercent caps retries to the percentage of requests over the last
+	// 10 seconds. Defaults to 20.
+	BudgetPercent float64 `json:"budgetPercent,omitempty"`
+	// MinRetries is the number of retries allowed every 10 seconds regardless
+	// of the budget. Defaults to 3.
+	MinRetries int `json:"minRetries,omitempty"`
+	// MaxBodyBuffer is the max size of a request body buffered so it can be
+	// replayed. Requests with larger bodies aren't retried. Defaults to 64KB.
+	MaxBodyBuffer int64 `json:"maxBodyBuffer,omitempty"`
+}
+
+func (rp *RetryPolicy) validate() error {
+	if rp.MaxAttempts < 0 || rp.MinRetries < 0 || rp.MaxBodyBuffer < 0 {
+		return fmt.Errorf("retry policy values can't be negative")
+	} else if rp.PerTryTimeout < 0 {
+		return fmt.Errorf("retry per-try timeout can't be negative")
+	} else if rp.BudgetPercent < 0 || rp.BudgetPercent > 100 {
+		return fmt.Errorf("retry budget percent must be between 0 and 100")
+	}
+	for _, on := range rp.RetryOn {
+		switch on {
+		case RetryOnConnectError, RetryOnTimeout, RetryOn5xx:
+		default:
+			return fmt.Errorf("invalid retry on condition: %s", on)
+		}
+	}
+	return nil
+}
+
+func (rp *RetryPolicy) maxAttempts() int {
+	if rp.MaxAttempts <= 0 {
+		return 2
+	}
+	return rp.MaxAttempts
+}
+
+func (rp *RetryPolicy) budgetPercent() float64 {
+	if rp.BudgetPercent <= 0 {
+		return 20
+	}
+	return rp.BudgetPercent
+}
+
+func (rp *RetryPolicy) minRetries() int {
+	if rp.MinRetries <= 0 {
+		return 3
+	}
+	return rp.MinRetries
+}
+
+func (rp *RetryPolicy) maxBodyBuffer() int64 {
+	if rp.MaxBodyBuffer <= 0 {
+		return 64 << 10
+	}
+	return rp.MaxBodyBuffer
+}
+
+func (rp *RetryPolicy) retriesOn(cond string) bool {
+	if len(rp.RetryOn) == 0 {
+		return cond == RetryOnConnectError
+	}
+	for _, on := range rp.RetryOn {
+		if on == cond {
+			return true
+		}
+	}
+	return false
+}
+
+func (rp *RetryPolicy) retriesStatus(status int) bool {
+	if status >= 500 && rp.retriesOn(RetryOn5xx) {
+		return true
+	}
+	for _, s := range rp.RetryStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// canRetry returns whether the request can be retried based on its method.
+func (rp *RetryPolicy) canRetry(r *http.Request) bool {
+	if rp.NonIdempotent {
+		return true
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace,
+		http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// Length of each window of the retry budget
+const retryBudgetWindow = 10 * time.Second
+
+// retryBudget limits the number of retries to a percentage of requests.
+// Counts are kept for the current and previous windows, with the previous
+// window weighted by how much of it overlaps the last 10 seconds.
+type retryBudget struct {
+	percent    float64
+	minRetries int
+
+	// Total retries and number of retries not done due to the budget
+	retries, exhausted int64
+
+	mtx                       sync.Mutex
+	windowStart               time.Time
+	requests, windowRetries   int
+	prevRequests, prevRetries int
+}
+
+func newRetryBudget(rp *RetryPolicy) *retryBudget {
+	return &retryBudget{
+		percent:     rp.budgetPercent(),
+		minRetries:  rp.minRetries(),
+		windowStart: time.Now(),
+	}
+}
+
+// Must be called with the lock held
+func (rb *retryBudget) rotate(now time.Time) float64 {
+	elapsed := now.Sub(rb.windowStart)
+	if elapsed >= 2*retryBudgetWindow {
+		rb.prevRequests, rb.prevRetries = 0, 0
+		rb.requests, rb.windowRetries = 0, 0
+		rb.windowStart, elapsed = now, 0
+	} else if elapsed >= retryBudgetWindow {
+		rb.prevRequests, rb.prevRetries = rb.requests, rb.windowRetries
+		rb.requests, rb.windowRetries = 0, 0
+		rb.windowStart = rb.windowStart.Add(retryBudgetWindow)
+		elapsed -= retryBudgetWindow
+	}
+	// The weight of the previous window
+	return 1 - float64(elapsed)/float64(retryBudgetWindow)
+}
+
+func (rb *retryBudget) request() {
+	rb.mtx.Lock()
+	defer rb.mtx.Unlock()
+	rb.rotate(time.Now())
+	rb.requests++
+}
+
+// tryRetry returns whether a retry is allowed, counting it if so.
+func (rb *retryBudget) tryRetry() bool {
+	rb.mtx.Lock()
+	defer rb.mtx.Unlock()
+	prevWeight := rb.rotate(time.Now())
+	requests := float64(rb.requests) + float64(rb.prevRequests)*prevWeight
+	retries := float64(rb.windowRetries) + float64(rb.prevRetries)*prevWeight
+	if retries+1 > requests*rb.percent/100 && rb.windowRetries >= rb.minRetries {
+		atomic.AddInt64(&rb.exhausted, 1)
+		return false
+	}
+	rb.windowRetries++
+	atomic.AddInt64(&rb.retries, 1)
+	return true
+}
+
+// replayableBody buffers the request body so the request can be sent more
+// than once. False is returned if the body is too large, in which case the
+// request body is replaced with one that reads what was buffered and the
+// rest of the original.
+func replayableBody(req *http.Request, max int64) ([]byte, bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true, nil
+	}
+	buf, err := io.ReadAll(io.LimitReader(req.Body, max+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(buf)) > max {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}
+		return nil, false, nil
+	}
+	req.Body.Close()
+	return buf, true, nil
+}
+
+func isConnectError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// errPerTryTimeout is returned when an attempt hits the per-try timeout
+var errPerTryTimeout = fmt.Errorf("per-try timeout exceeded")
+
+// attempt sends the request to the target, enforcing the per-try timeout for
+// getting a response.
+func (pt *poolTransport) attempt(
+	t *Target, req *http.Request, body []byte, timeout time.Duration,
+) (*http.Response, error) {
+	if body != nil {
+		req = req.Clone(req.Context())
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+	if timeout <= 0 {
+		return t.roundTrip(pt.base, req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	var timedOut int32
+	timer := time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		cancel()
+	})
+	resp, err := t.roundTrip(pt.base, req.WithContext(ctx))
+	timer.Stop()
+	if err != nil {
+		cancel()
+		if atomic.LoadInt32(&timedOut) == 1 {
+			return nil, fmt.Errorf("%w: %v", errPerTryTimeout, err)
+		}
+		return nil, err
+	}
+	// Keep the context alive until the body is done being read
+	resp.Body = wrapBodyDone(resp.Body, cancel)
+	return resp, nil
+}
+
+// roundTripRetry sends the request, retrying according to the server's
+// policy.
+func (pt *poolTransport) roundTripRetry(req *http.Request) (*http.Response, error) {
+	s, rp := pt.srvr, pt.srvr.Retry
+	ps := getProxyState(req.Context())
+	s.retries.request()
+	attempts := rp.maxAttempts()
+	if !rp.canRetry(req) {
+		attempts = 1
+	}
+	var body []byte
+	if attempts > 1 {
+		var ok bool
+		var err error
+		if body, ok, err = replayableBody(req, rp.maxBodyBuffer()); err != nil {
+			return nil, err
+		} else if !ok {
+			attempts = 1
+		}
+	}
+	var tried []*Target
+	for i := 1; ; i++ {
+		t := pt.pool.pickExcluding(req, tried)
+		if t == nil {
+			if req.Body != nil && body == nil {
+				req.Body.Close()
+			}
+			return nil, ErrNoTargets
+		}
+		tried = append(tried, t)
+		if ps != nil {
+			ps.target = t
+		}
+		resp, err := pt.attempt(t, req, body, rp.PerTryTimeout.Std())
+		last := i >= attempts || req.Context().Err() != nil
+		if err != nil {
+			retryable := (rp.retriesOn(RetryOnConnectError) && isConnectError(err)) ||
+				(rp.retriesOn(RetryOnTimeout) && errors.Is(err, errPerTryTimeout))
+			if last || !retryable || !s.retries.tryRetry() {
+				return nil, err
+			}
+			s.recordResult(t, true)
+			Logger.Printf("retrying request to %s after error: %v", s.Path, err)
+			continue
+		}
+		if last || !rp.retriesStatus(resp.StatusCode) || !s.retries.tryRetry() {
+			return resp, nil
+		}
+		s.recordResult(t, resp.StatusCode >= 500)
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		Logger.Printf("retrying request to %s after status %d", s.Path, resp.StatusCode)
+	}
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRetryBudget(t *testing.T) {
+	tests := []struct {
+		name     string
+		rp       RetryPolicy
+		requests int
+		tries    int
+		allowed  int
+	}{
+		{"min retries without requests", RetryPolicy{}, 0, 5, 3},
+		{"percent of requests", RetryPolicy{BudgetPercent: 50, MinRetries: 1}, 10, 10, 5},
+		{"min retries over percent", RetryPolicy{BudgetPercent: 10, MinRetries: 4}, 10, 10, 4},
+		{"all allowed", RetryPolicy{BudgetPercent: 100, MinRetries: 1}, 4, 4, 4},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rb := newRetryBudget(&test.rp)
+			for i := 0; i < test.requests; i++ {
+				rb.request()
+			}
+			allowed := 0
+			for i := 0; i < test.tries; i++ {
+				if rb.tryRetry() {
+					allowed++
+				}
+			}
+			if allowed != test.allowed {
+				t.Fatalf("allowed %d retries, want %d", allowed, test.allowed)
+			} else if rb.retries != int64(test.allowed) || rb.exhausted != int64(test.tries-test.allowed) {
+				t.Fatalf("counted %d retries and %d exhausted", rb.retries, rb.exhausted)
+			}
+		})
+	}
+}
+
+func TestPickExcluding(t *testing.T) {
+	tests := []struct {
+		name    string
+		exclude []int
+		down    []int
+		// Indexes of the targets that can be picked
+		want []int
+	}{
+		{"nothing excluded", nil, nil, []int{0, 1, 2}},
+		{"excluded", []int{0}, nil, []int{1, 2}},
+		{"excluded and down", []int{0}, []int{1}, []int{2}},
+		{"all excluded", []int{0, 1, 2}, nil, []int{0, 1, 2}},
+		{"rest down", []int{0}, []int{1, 2}, []int{0}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			targets := testTargets(t, 1, 1, 1)
+			pool, _ := newTargetPool(&roundRobinBalancer{}, targets)
+			for _, i := range test.down {
+				targets[i].health.unhealthy = 1
+			}
+			var exclude []*Target
+			for _, i := range test.exclude {
+				exclude = append(exclude, targets[i])
+			}
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			for i := 0; i < 6; i++ {
+				got := pool.pickExcluding(r, exclude)
+				ok := false
+				for _, j := range test.want {
+					ok = ok || got == targets[j]
+				}
+				if !ok {
+					t.Fatalf("picked %v", got)
+				}
+			}
+		})
+	}
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		name     string
+		rp       RetryPolicy
+		method   string
+		status   int
+		requests int
+		// Total requests the target gets
+		hits int
+	}{
+		{"5xx retried", RetryPolicy{MaxAttempts: 3, RetryOn: []string{RetryOn5xx}}, "GET", 503, 1, 3},
+		{"5xx not retried by default", RetryPolicy{MaxAttempts: 3}, "GET", 503, 1, 1},
+		{"status retried", RetryPolicy{MaxAttempts: 3, RetryStatuses: []int{429}}, "GET", 429, 1, 3},
+		{"success not retried", RetryPolicy{MaxAttempts: 3, RetryOn: []string{RetryOn5xx}}, "GET", 200, 1, 1},
+		{"post not retried", RetryPolicy{MaxAttempts: 3, RetryOn: []string{RetryOn5xx}}, "POST", 503, 1, 1},
+		{
+			"post retried if allowed",
+			RetryPolicy{MaxAttempts: 3, RetryOn: []string{RetryOn5xx}, NonIdempotent: true},
+			"POST", 503, 1, 3,
+		},
+		// 2 retries for the first request, then 1 before the budget's used up
+		{"budget", RetryPolicy{MaxAttempts: 3, RetryOn: []string{RetryOn5xx}}, "GET", 503, 2, 5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var hits int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w RW, r Req) {
+				atomic.AddInt32(&hits, 1)
+				// The body is replayed for each attempt
+				if r.Method == http.MethodPost {
+					if buf, _ := io.ReadAll(r.Body); string(buf) != "body" {
+						t.Errorf("got body %q", buf)
+					}
+				}
+				w.WriteHeader(test.status)
+			}))
+			defer ts.Close()
+			s := &Server{Path: "s", Addr: ts.URL, Retry: &test.rp}
+			if err := s.AddTargetsProxy(); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < test.requests; i++ {
+				w := httptest.NewRecorder()
+				s.ServeHTTP(w, httptest.NewRequest(test.method, "/", strings.NewReader("body")))
+				if w.Code != test.status {
+					t.Fatalf("got status %d, want %d", w.Code, test.status)
+				}
+			}
+			if hits := atomic.LoadInt32(&hits); hits != int32(test.hits) {
+				t.Fatalf("target got %d requests, want %d", hits, test.hits)
+			}
+		})
+	}
+}
+
+func TestRetryConnectError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	s := &Server{Path: "s", Addr: "http://" + addr, Retry: &RetryPolicy{MaxAttempts: 3}}
+	if err := s.AddTargetsProxy(); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("got status %d", w.Code)
+	} else if s.retries.retries != 2 {
+		t.Fatalf("got %d retries, want 2", s.retries.retries)
+	}
+}
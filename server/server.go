@@ -3,10 +3,13 @@ package server
 import (
 	"bufio"
 	"context"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"html/template"
+	"io"
 	"log"
 	"net"
 	"net/http"
@@ -16,6 +19,7 @@ import (
 	"path"
 	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -25,26 +29,94 @@ import (
 type RW = http.ResponseWriter
 type Req = *http.Request
 
-const tunnelQueueLen uint32 = 1000
-
 var (
 	Logger      = log.New(os.Stderr, "", log.LstdFlags|log.Lshortfile)
 	LogFilePath string
 )
 
 type Router struct {
-	ln         net.Listener
+	listeners  jtutils.SyncMap[string, *Listener]
 	acceptChan chan net.Conn
-	lnErr      error
+	closed     chan struct{}
+	closeOnce  sync.Once
+	// Whether listeners can be changed over the admin API
+	adminListeners atomic.Bool
 
 	routes jtutils.SyncMap[string, *Server]
+	// Servers removed from routes that are being drained
+	draining jtutils.SyncMap[string, *Server]
 
-	tunnelQueue [tunnelQueueLen]chan net.Conn
-	tunnelID    uint32
+	// Requests waiting for tunnels to dial back conns
+	pendingConns pendingTunnelConns
+	tunnelID     uint32
+	tunnelAuth   atomic.Pointer[TunnelAuth]
+	// Heartbeat used for multiplexed tunnels registered with the router
+	tunnelHeartbeat atomic.Pointer[TunnelHeartbeat]
 
-	tunnelAddr   string
-	tunnelConn   net.Conn
+	tunnelCfg    TunnelConfig
+	tunnelMtx    sync.Mutex
+	tunnel       *tunnelLink
 	tunnelServer *Server
+	tunnelStatus TunnelStatus
+	// Services registered over the tunnel, by path, and the streams for them
+	tunnelServices jtutils.SyncMap[string, *tunnelService]
+	serviceConns   chan net.Conn
+
+	// TCP services registered by tunnels, by path and by server name for
+	// those routed by SNI
+	tunnelTCP      atomic.Pointer[TunnelTCP]
+	tcpServices    jtutils.SyncMap[string, *tcpService]
+	sniServices    jtutils.SyncMap[string, *tcpService]
+	numSNIServices int32
+
+	// UDP services registered by tunnels, by path
+	tunnelUDP   atomic.Pointer[TunnelUDP]
+	udpServices jtutils.SyncMap[string, *udpService]
+}
+
+// tunnelDataConn is a conn dialed back by a tunnel for a request, along with
+// the session secret it was sent with.
+type tunnelDataConn struct {
+	net.Conn
+	secret []byte
+}
+
+// TunnelConfig configures the connection of a tunnel.
+type TunnelConfig struct {
+	// Addr is the address of the proxy to tunnel to
+	Addr string
+	// CredentialID identifies the credential to register with, if the proxy
+	// requires it
+	CredentialID string
+	// Token is the pre-shared token to register with
+	Token string
+	// Secret is the key used to answer the proxy's HMAC challenge if Token
+	// isn't set
+	Secret string
+	// TLS is used to connect to the proxy over TLS, if set. The proxy's
+	// listener must serve TLS.
+	TLS *tls.Config
+	// Heartbeat is used to find out when the proxy is gone if requests are
+	// multiplexed over the tunnel's conn
+	Heartbeat TunnelHeartbeat
+	// Reconnect configures reconnecting once the tunnel is disconnected
+	Reconnect TunnelReconnect
+	// OnStateChange is called with the tunnel's status whenever its state
+	// changes, if set. It must not block.
+	OnStateChange func(TunnelStatus)
+	// Transport is how the tunnel's conns are sent: TunnelTransportTCP
+	// (default), TunnelTransportUpgrade or TunnelTransportWebSocket. The
+	// latter two go through HTTP proxies and L7 load balancers.
+	Transport string
+	// Proxy returns the URL of the HTTP proxy conns to the tunneled-to proxy
+	// are made through with CONNECT, if set (e.g., http.ProxyFromEnvironment).
+	// No proxy is used if it returns nil.
+	Proxy func(*http.Request) (*url.URL, error)
+	// Handler serves the requests sent through the tunnel for its server, if
+	// set, rather than their conns being passed to Accept. This allows
+	// exposing a local app (see NewUpstreamHandler) without routing it through
+	// the router.
+	Handler http.Handler
 }
 
 func NewRouterHandler() *Router {
@@ -52,38 +124,75 @@ func NewRouterHandler() *Router {
 }
 
 func NewRouter(addr string) (*Router, error) {
-	ln, err := net.Listen("tcp", addr)
-	if err != nil {
-		return nil, err
+	return NewRouterWithListeners(ListenerConfig{Addr: addr})
+}
+
+// NewRouterWithListeners creates a router accepting on each of the given
+// listeners. More can be added later with AddListener.
+func NewRouterWithListeners(cfgs ...ListenerConfig) (*Router, error) {
+	r := &Router{
+		acceptChan: make(chan net.Conn, 5),
+		closed:     make(chan struct{}),
 	}
-	r := &Router{ln: ln, acceptChan: make(chan net.Conn, 5)}
-	for i := uint32(0); i < tunnelQueueLen; i++ {
-		r.tunnelQueue[i] = make(chan net.Conn)
+	for _, cfg := range cfgs {
+		if _, err := r.AddListener(cfg); err != nil {
+			r.Close()
+			return nil, err
+		}
 	}
-	go r.listen()
 	return r, nil
 }
 
 func NewTunneledRouter(addr, tunnelAddr string, s *Server) (*Router, error) {
+	return NewTunneledRouterWithListeners(tunnelAddr, s, ListenerConfig{Addr: addr})
+}
+
+// NewTunneledRouterWithListeners is the same as NewTunneledRouter but accepts
+// on each of the given listeners.
+func NewTunneledRouterWithListeners(
+	tunnelAddr string, s *Server, cfgs ...ListenerConfig,
+) (*Router, error) {
+	return NewTunneledRouterWithConfig(TunnelConfig{Addr: tunnelAddr}, s, cfgs...)
+}
+
+// NewTunneledRouterWithConfig is the same as NewTunneledRouterWithListeners
+// but takes the full config of the tunnel.
+func NewTunneledRouterWithConfig(
+	tc TunnelConfig, s *Server, cfgs ...ListenerConfig,
+) (*Router, error) {
+	if err := tc.Heartbeat.validate(); err != nil {
+		return nil, err
+	} else if err := tc.Reconnect.validate(); err != nil {
+		return nil, err
+	} else if err := tc.validateTransport(); err != nil {
+		return nil, err
+	}
 	// Connect to the tunnel
 	s.Addr = "tunnel"
-	c, err := connectTunnel(tunnelAddr, s)
+	if tc.OnStateChange != nil {
+		tc.OnStateChange(TunnelStatus{State: TunnelConnecting, Since: time.Now()})
+	}
+	link, err := dialTunnel(tc, s, nil)
 	if err != nil {
 		return nil, err
 	}
 	// Create the router
-	r, err := NewRouter(addr)
-	if err == nil {
-		r.tunnelAddr = tunnelAddr
-		r.tunnelConn = c
+	r, err := NewRouterWithListeners(cfgs...)
+	if err != nil {
+		link.conn.Close()
+	} else {
+		r.tunnelCfg = tc
 		r.tunnelServer = s
+		r.setTunnelState(TunnelConnected, link, nil)
+		r.serviceConns = make(chan net.Conn)
 		go r.listenTunnel()
+		go r.serveTunnelServices()
 	}
 	return r, err
 }
 
 func (r *Router) IsHandlerOnly() bool {
-	return r.ln == nil && r.acceptChan == nil
+	return r.acceptChan == nil
 }
 
 func (router *Router) ServeHTTP(w RW, r Req) {
@@ -98,7 +207,12 @@ func (router *Router) ServeHTTP(w RW, r Req) {
 	} else {
 		baseSlug = r.URL.Path[1:]
 	}
-	if !router.IsHandlerOnly() {
+	l := reqListener(r)
+	if r.URL.Path == TunnelUpgradePath && !router.IsHandlerOnly() && l.allowsTunnels() {
+		router.serveTunnelUpgrade(w, r)
+		return
+	}
+	if !router.IsHandlerOnly() && l.allowsAdmin() {
 		if baseSlug == "" {
 			switch r.Method {
 			case http.MethodPost:
@@ -112,20 +226,34 @@ func (router *Router) ServeHTTP(w RW, r Req) {
 		} else if baseSlug == "log" {
 			router.serveLog(w, r)
 			return
+		} else if underPath(r.URL.Path, AdminPath) {
+			router.serveAdmin(w, r)
+			return
+		} else if r.URL.Path == MetricsPath {
+			router.serveMetrics(w, r)
+			return
 		}
 	}
-	if server, ok := router.routes.Load(baseSlug); ok {
+	if server, ok := router.routes.Load(baseSlug); ok && l.allows(server) {
 		// TODO: Set "Forwarded" header
 		if r.URL.Path[0] == '/' {
 			baseSlug = "/" + baseSlug
 		}
 		r.URL.Path = strings.Replace(r.URL.Path, baseSlug, "", 1)
-		server.proxy.ServeHTTP(w, r)
+		server.ServeHTTP(w, r)
+		return
+	} else if server, ok := router.draining.Load(baseSlug); ok && l.allows(server) {
+		router.serveDraining(w, server)
 		return
 	}
 	w.WriteHeader(http.StatusNotFound)
 }
 
+// underPath returns whether the path is p or a path under it.
+func underPath(path, p string) bool {
+	return path == p || strings.HasPrefix(path, p+"/")
+}
+
 var (
 	ErrServerExists  = fmt.Errorf("server already exists")
 	ErrNoServerProxy = fmt.Errorf("server must have proxy")
@@ -136,14 +264,21 @@ func (router *Router) AddServer(srvr *Server) error {
 		return fmt.Errorf("must have server name and path")
 	} else if srvr.proxy == nil {
 		return ErrNoServerProxy
-	} else if _, loaded := router.routes.LoadOrStore(srvr.Path, srvr.Clone()); loaded {
+	}
+	srvr = srvr.Clone()
+	if err := srvr.prepare(); err != nil {
+		return err
+	}
+	if _, loaded := router.routes.LoadOrStore(srvr.Path, srvr); loaded {
 		return ErrServerExists
 	}
+	srvr.start()
 	return nil
 }
 
 var (
 	ErrServerNotExist = fmt.Errorf("server does not exist")
+	ErrReservedPath   = fmt.Errorf("path is reserved")
 	ErrMismatchAddr   = fmt.Errorf("mistmatch addresses")
 )
 
@@ -153,8 +288,10 @@ func (router *Router) DeleteServer(srvr *Server) error {
 		return ErrServerNotExist
 	} else if srvr.Addr != s.Addr {
 		return ErrMismatchAddr
+	} else if !router.unroute(s) {
+		return ErrServerNotExist
 	}
-	router.routes.Delete(srvr.Path)
+	go router.drainServer(context.Background(), s)
 	return nil
 }
 
@@ -174,23 +311,22 @@ func (router *Router) addServer(w RW, r Req) {
 		http.Error(w, "Bad json", http.StatusBadRequest)
 		return
 	}
-	u, err := url.Parse(srvr.Addr)
-	if err != nil {
-		http.Error(w, "Bad server address", http.StatusBadRequest)
+	if srvr.Path == "" || srvr.Name == "" {
+		http.Error(w, "Must include path and name", http.StatusBadRequest)
 		return
-	} else if u.Scheme != "http" && u.Scheme != "https" {
-		http.Error(w, "Invalid proto", http.StatusBadRequest)
+	} else if err := srvr.AddTargetsProxy(); err != nil {
+		http.Error(w, "Bad server: "+err.Error(), http.StatusBadRequest)
 		return
-	} else if srvr.Path == "" || srvr.Name == "" {
-		http.Error(w, "Must include path and name", http.StatusBadRequest)
+	} else if err := srvr.prepare(); err != nil {
+		http.Error(w, "Bad server: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	srvr.AddProxy(httputil.NewSingleHostReverseProxy(u))
 	if _, loaded := router.routes.LoadOrStore(srvr.Path, srvr); loaded {
 		// TODO: Send different error w/ message
 		http.Error(w, "Server already exists", http.StatusBadRequest)
 		return
 	}
+	srvr.start()
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -209,11 +345,12 @@ func (router *Router) deleteServer(w RW, r Req) {
 	if srvr.Addr != s.Addr {
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
+	} else if !router.unroute(s) {
+		http.Error(w, "Server does not exist", http.StatusNotFound)
+		return
 	}
-	router.routes.Delete(srvr.Path)
-	if s.isTunnel {
-		s.tunnelConn.Close()
-	}
+	// The server is stopped once it's drained
+	go router.drainServer(context.Background(), s)
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -225,9 +362,10 @@ func (router *Router) serveHome(w RW, r Req) {
 		return
 	}
 	parts := r.Header.Values("Gory-Proxy-Path")
+	l := reqListener(r)
 	var data []pageData
 	router.routes.Range(func(_ string, srvr *Server) bool {
-		if !srvr.Hidden {
+		if !srvr.Hidden && l.allows(srvr) {
 			data = append(data, srvr.ToPageData(parts))
 		}
 		return true
@@ -241,24 +379,29 @@ func (router *Router) serveHome(w RW, r Req) {
 }
 
 func (router *Router) serveLog(w RW, r Req) {
+	if LogFilePath == "" {
+		http.Error(w, "Log not written to file", http.StatusNotFound)
+		return
+	}
 	http.ServeFile(w, r, LogFilePath)
 }
 
-func (router *Router) listen() {
+func (router *Router) listen(l *Listener) {
 	for {
-		c, err := router.ln.Accept()
+		c, err := l.ln.Accept()
 		if err != nil {
-			router.lnErr = err
-			Logger.Println(err)
-			// TODO
-			//close(router.acceptChan)
+			// Don't log if the listener was removed
+			if cur, ok := router.listeners.Load(l.Name()); ok && cur == l {
+				Logger.Printf("error accepting on listener %s: %v", l.Name(), err)
+				router.listeners.Delete(l.Name())
+			}
 			return
 		}
-		go router.handleConn(c)
+		go router.handleConn(listenerConn{Conn: c, l: l})
 	}
 }
 
-func (router *Router) handleConn(c net.Conn) {
+func (router *Router) handleConn(c listenerConn) {
 	// Check the error?
 	c.SetReadDeadline(time.Now().Add(time.Second * 30))
 	// Convert the conn into a buf conn and check for a tunnel req header
@@ -269,159 +412,393 @@ func (router *Router) handleConn(c net.Conn) {
 		bc.Close()
 		return
 	}
-	if header := getHeader(h); header == HeaderConnect {
-		// Read 8 bytes: 4 for the header still in the buffer and 4 for the id
-		h = make([]byte, 8)
-		if n, err := bc.Read(h); err != nil {
-			// TODO: Log error?
+	var conn net.Conn = bc
+	// Tunnels must use TLS on TLS listeners, sending their header after the
+	// handshake
+	if header := getHeader(h); isTunnelHeader(header) && c.l.tlsConfig == nil {
+		if !c.l.allowsTunnels() {
 			bc.Close()
 			return
-		} else if n != 8 {
-			// TODO: Log someting?
-			bc.Close()
+		}
+		router.handleTunnel(bc, header)
+		return
+	} else if h[0] == recordTypeHandshake && atomic.LoadInt32(&router.numSNIServices) != 0 {
+		// TLS conns may be for a TCP service routed by SNI
+		var ok bool
+		if conn, ok = router.handleSNI(bc); ok {
 			return
 		}
-		bc.SetReadDeadline(time.Time{})
-		index := binary.BigEndian.Uint32(h[4:]) % tunnelQueueLen
-		select {
-		case router.tunnelQueue[index] <- bc:
-		default:
-			// The one requesting the conn is no longer waiting for it
+	}
+	if c.l.tlsConfig == nil {
+		conn.SetReadDeadline(time.Time{})
+		router.accepted(conn)
+		return
+	}
+	tc := tls.Server(conn, c.l.tlsConfig)
+	if err := tc.Handshake(); err != nil {
+		tc.Close()
+		return
+	}
+	if tc.ConnectionState().NegotiatedProtocol != TunnelALPN {
+		tc.SetReadDeadline(time.Time{})
+		router.accepted(tc)
+		return
+	}
+	// Tunnels sharing the TLS listener send their header after the handshake
+	bc = NewBufConn(tc)
+	if !c.l.allowsTunnels() {
+		bc.Close()
+		return
+	} else if h, err = bc.Peek(4); err != nil || !isTunnelHeader(getHeader(h)) {
+		bc.Close()
+		return
+	}
+	router.handleTunnel(bc, getHeader(h))
+}
+
+// isTunnelHeader returns whether the header starts a conn used by a tunnel.
+func isTunnelHeader(header uint32) bool {
+	switch header {
+	case HeaderConnect, HeaderTunnel, HeaderTunnelMux, HeaderHello:
+		return true
+	}
+	return false
+}
+
+// handleTunnel handles a conn starting with a tunnel header, either
+// registering a tunnel or passing a tunnel's data conn to the request waiting
+// for it.
+func (router *Router) handleTunnel(bc BufConn, header uint32) {
+	if header == HeaderConnect {
+		// Read 8 bytes: 4 for the header still in the buffer and 4 for the id
+		h := make([]byte, 8)
+		if _, err := io.ReadFull(bc, h); err != nil {
 			bc.Close()
+			return
+		}
+		id := binary.BigEndian.Uint32(h[4:])
+		var secret []byte
+		if router.pendingConns.expectsSecret(id) {
+			// Tunnels registered with auth send the secret of their session
+			secret = make([]byte, tunnelSecretLen)
+			if _, err := io.ReadFull(bc, secret); err != nil {
+				bc.Close()
+				return
+			}
 		}
-	} else if header == HeaderTunnel {
-		buf := make([]byte, 256)
-		n, err := bc.Read(buf)
+		bc.SetReadDeadline(time.Time{})
+		router.pendingConns.deliver(id, tunnelDataConn{bc, secret}, atomic.LoadUint32(&router.tunnelID))
+	} else if header == HeaderHello {
+		router.handleHello(bc)
+	} else {
+		router.handleLegacyTunnel(bc, header == HeaderTunnelMux)
+	}
+}
+
+// handleLegacyTunnel handles a tunnel registering with the handshake used
+// before the protocol was versioned.
+func (router *Router) handleLegacyTunnel(bc BufConn, mux bool) {
+	// Get rid of the header still in the buffer
+	if _, err := io.ReadFull(bc, make([]byte, 4)); err != nil {
+		bc.Close()
+		return
+	}
+	var sent Server
+	d := json.NewDecoder(io.LimitReader(bc, hsMaxPayload))
+	if err := d.Decode(&sent); err != nil || sent.Name == "" || sent.Path == "" {
 		if err != nil {
-			// TODO: Do something with error (or delete logging)
 			Logger.Printf("error reading from connecting tunnel proxy: %v", err)
-			bc.Close()
-			return
 		}
-		bc.SetReadDeadline(time.Time{})
-		s := &Server{}
-		// Start from 4 to get rid of the header bytes that were still in the buffer
-		if err := json.Unmarshal(buf[4:n], &s); err != nil || s.Name == "" || s.Path == "" {
-			if err != nil {
-				Logger.Println(err)
-			}
-			// TODO: Do something with error?
-			bc.Write(headerBadMessageBytes)
-			bc.Close()
-			return
+		bc.Write(headerBadMessageBytes)
+		bc.Close()
+		return
+	}
+	s := tunneledServer(&sent)
+	secret, cred, err := router.authTunnel(s.Path, legacyAuthExchange(bc))
+	if err != nil {
+		if err == errTunnelUnauthorized {
+			bc.Write(headerUnauthorizedBytes)
 		}
-		s.AddProxy(router.newTunnelProxy(bc))
-		s.isTunnel = true
-		s.tunnelConn = bc
-		if _, loaded := router.routes.LoadOrStore(s.Path, s); loaded {
+		bc.Close()
+		return
+	}
+	bc.SetReadDeadline(time.Time{})
+	s.tunnelCred = cred
+	var caps []string
+	if mux {
+		caps = []string{capMux}
+	}
+	router.registerTunnel(bc, s, secret, caps, nil, func(err error) {
+		if err == errTunnelExists {
 			bc.Write(headerAlreadyExistsBytes)
-			bc.Close()
+		} else if err != nil {
+			bc.Write(headerBadMessageBytes)
+		} else {
+			bc.Write(append(headerSuccessBytes, secret...))
 		}
-		bc.Write(headerSuccessBytes)
-	} else {
-		bc.SetReadDeadline(time.Time{})
-		router.acceptChan <- bc
+	})
+}
+
+// registerTunnel adds the server of a tunnel connected over bc. If the path
+// is taken by a previous session of the tunnel and takeover is its token, the
+// previous session is replaced. reply is called with the result, before any
+// requests can be sent through the tunnel. If there's an error, bc is closed
+// afterwards.
+func (router *Router) registerTunnel(
+	bc BufConn, s *Server, secret []byte, caps []string, takeover []byte, reply func(error),
+) {
+	if hasCap(caps, capMux) {
+		// Requests are sent over streams on this conn rather than over conns
+		// the tunnel dials back
+		s.tunnelMux = newMuxSession(bc, false)
+		// Keep requests from being sent until the reply is written
+		s.tunnelMux.wmtx.Lock()
+	}
+	s.AddProxy(router.newTunnelProxy(s, bc))
+	s.isTunnel = true
+	s.tunnelConn = bc
+	s.tunnelSecret = secret
+	err := s.prepare()
+	if err != nil {
+		Logger.Println(err)
+	} else if cur, loaded := router.routes.LoadOrStore(s.Path, s); loaded {
+		err = errTunnelExists
+		if router.takeOverTunnel(cur, takeover) {
+			if _, loaded := router.routes.LoadOrStore(s.Path, s); !loaded {
+				err = nil
+			}
+		}
+	}
+	reply(err)
+	if s.tunnelMux != nil {
+		s.tunnelMux.wmtx.Unlock()
+	}
+	if err != nil {
+		bc.Close()
+		return
+	}
+	if s.tunnelMux != nil {
+		go s.tunnelMux.heartbeat(router.tunnelHeartbeatCfg(), hasCap(caps, capHeartbeat))
+		if hasCap(caps, capServices) {
+			go router.serveTunnelControl(s)
+		}
+		if hasCap(caps, capUDP) {
+			go router.serveTunnelDatagrams(s)
+		}
+	}
+	go router.watchTunnel(s)
+}
+
+// takeOverTunnel removes the registration of the tunnel server and its
+// services if the takeover token proves the new session belongs to the same
+// tunnel. Returns whether it was removed.
+func (router *Router) takeOverTunnel(cur *Server, takeover []byte) bool {
+	if !cur.isTunnel || cur.tunnelService != "" || len(cur.tunnelTakeover) == 0 ||
+		subtle.ConstantTimeCompare(cur.tunnelTakeover, takeover) != 1 {
+		return false
+	}
+	Logger.Printf("tunnel for %s reconnected, replacing previous session", cur.Path)
+	var old []*Server
+	router.routes.Range(func(path string, s *Server) bool {
+		if s == cur || (cur.tunnelMux != nil && s.tunnelMux == cur.tunnelMux) {
+			router.routes.Delete(path)
+			old = append(old, s)
+		}
+		return true
+	})
+	cur.tunnelConn.Close()
+	if cur.tunnelMux != nil {
+		router.removeTunnelTCPServices(cur.tunnelMux)
+		router.removeTunnelUDPServices(cur.tunnelMux)
+	}
+	for _, s := range old {
+		go router.drainServer(context.Background(), s)
+	}
+	return true
+}
+
+// accepted passes the conn to Accept.
+func (router *Router) accepted(c net.Conn) {
+	select {
+	case router.acceptChan <- c:
+	case <-router.closed:
+		c.Close()
 	}
 }
 
 // Accept should only be called by the http package server
 func (router *Router) Accept() (net.Conn, error) {
-	c := <-router.acceptChan
-	if c == nil {
-		return nil, router.lnErr
+	select {
+	case c := <-router.acceptChan:
+		return c, nil
+	case <-router.closed:
+		return nil, net.ErrClosed
 	}
-	return c, nil
 }
 
+// Close closes all the router's listeners.
 func (router *Router) Close() error {
-	if router.tunnelConn != nil {
-		router.tunnelConn.Close()
+	var err error
+	router.closeOnce.Do(func() {
+		close(router.closed)
+		router.listeners.Range(func(name string, l *Listener) bool {
+			router.listeners.Delete(name)
+			if e := l.Close(); e != nil && err == nil {
+				err = e
+			}
+			return true
+		})
+	})
+	if link := router.currentTunnel(); link != nil {
+		link.conn.Close()
 	}
-	return router.ln.Close()
+	return err
 }
 
+// Addr returns the address of one of the router's listeners (the only one if
+// there is only one).
 func (router *Router) Addr() net.Addr {
-	return router.ln.Addr()
+	var addr net.Addr = &net.TCPAddr{}
+	router.listeners.Range(func(_ string, l *Listener) bool {
+		addr = l.Addr()
+		return false
+	})
+	return addr
 }
 
 var tunnelURL = mustValue(url.Parse("http://0.0.0.0:0"))
 
-func (router *Router) newTunnelProxy(c net.Conn) *httputil.ReverseProxy {
+// newTunnelProxy returns a proxy for the tunnel server, setting its transport
+// to one that gets connections through the tunnel.
+func (router *Router) newTunnelProxy(s *Server, c net.Conn) *httputil.ReverseProxy {
 	p := httputil.NewSingleHostReverseProxy(tunnelURL)
-	transport := http.DefaultTransport.(*http.Transport)
+	transport := s.newTransport()
+	transport.Proxy = nil
 	transport.DialContext = func(ctx context.Context, _ string, _ string) (net.Conn, error) {
-		id := router.nextID()
-		index := id % tunnelQueueLen
-		// Remove an old conn if one exists
-		select {
-		case old := <-router.tunnelQueue[index]:
-			old.Close()
-		default:
+		if s.tunnelMux != nil {
+			return s.tunnelMux.OpenService(s.tunnelService)
 		}
+		id := router.nextID()
+		pc := router.pendingConns.add(id, s)
+		defer router.pendingConns.remove(pc)
 		// TODO: Do something more with the error?
 		if _, err := c.Write(append(headerConnectBytes, put4(id)...)); err != nil {
 			// TODO: Remove the tunnel if it was disconnected?
 			return nil, fmt.Errorf("error getting tunnel connection: %w", err)
 		}
+		timer := time.NewTimer(pc.timeout())
+		defer timer.Stop()
 		select {
+		case tc := <-pc.ch:
+			return tc.Conn, nil
 		case <-ctx.Done():
 			return nil, ctx.Err()
-		case tc := <-router.tunnelQueue[index]:
-			return tc, nil
+		case <-timer.C:
+			return nil, fmt.Errorf("timed out waiting for tunnel connection %d", id)
 		}
 	}
+	s.transport = transport
 	p.Transport = transport
 	return p
 }
 
+// listenTunnel serves requests sent through the tunnel, reconnecting whenever
+// it's disconnected until the router is closed or reconnecting fails.
 func (router *Router) listenTunnel() {
-	// TODO: Do something to signify the tunnel has been closed
-tunnelLoop:
 	for {
-		var buf [8]byte
-		// TODO: Log error?
-		if n, err := router.tunnelConn.Read(buf[:]); err != nil {
-			log.Println("tunnel disconnected")
-			for {
-				// TODO: Do more with error
-				c, err := connectTunnel(router.tunnelAddr, router.tunnelServer)
-				if err != nil {
-					// Return if the tunnel has been replaced on the tunneled-to server
-					if te, ok := err.(*TunnelError); ok && te.header == HeaderAlreadyExists {
-						return
-					}
-				} else {
-					router.tunnelConn = c
-					continue tunnelLoop
-				}
-				time.Sleep(time.Minute)
+		link := router.currentTunnel()
+		if link.mux != nil {
+			if hasCap(link.caps, capUDP) {
+				go router.serveServiceDatagrams(link.mux)
 			}
+			router.serveTunnelMux(link.mux)
+		} else {
+			router.serveTunnelLegacy(link)
+		}
+		// Services can't be registered until it's reconnected
+		router.dropTunnel(link)
+		select {
+		case <-router.closed:
 			return
-		} else if n != 8 {
-			// TODO: Something?
+		default:
+		}
+		if link.mux != nil && link.mux.Err() != nil {
+			Logger.Printf("tunnel disconnected: %v", link.mux.Err())
+		} else {
+			Logger.Print("tunnel disconnected")
+		}
+		if !router.reconnectTunnel(link) {
+			return
+		}
+	}
+}
+
+// serveTunnelMux accepts streams opened by the tunneled-to server until the
+// session is closed.
+func (router *Router) serveTunnelMux(ms *muxSession) {
+	for {
+		st, err := ms.Accept()
+		if err != nil {
+			return
+		}
+		if st.service == "" {
+			router.acceptedTunnel(st)
+			continue
+		} else if svc, ok := router.tunnelServices.Load(st.service); ok && svc.cfg.isTCP() {
+			go serveTunnelTCP(st, svc.cfg.Target)
 			continue
 		}
-		go router.handleTunnelConn(buf)
+		select {
+		case router.serviceConns <- st:
+		case <-router.closed:
+			st.Close()
+		}
 	}
 }
 
-func (router *Router) handleTunnelConn(buf [8]byte) {
+// serveTunnelLegacy reads connect messages from the tunneled-to server,
+// dialing back a conn for each, until the tunnel conn is closed.
+func (router *Router) serveTunnelLegacy(link *tunnelLink) {
+	for {
+		var buf [8]byte
+		if _, err := io.ReadFull(link.conn, buf[:]); err != nil {
+			return
+		}
+		go router.handleTunnelConn(link, buf)
+	}
+}
+
+func (router *Router) handleTunnelConn(link *tunnelLink, buf [8]byte) {
 	if getHeader(buf[:]) != HeaderConnect {
 		return
 	}
 	id := binary.BigEndian.Uint32(buf[4:])
 	// TODO: Log error?
-	// TODO: Dial with server dial options (or something)?
-	c, err := net.Dial("tcp", router.tunnelAddr)
+	c, err := router.tunnelCfg.dial()
 	if err != nil {
 		return
 	}
-	if _, err := c.Write(append(headerConnectBytes, put4(id)...)); err != nil {
+	msg := append(append(headerConnectBytes, put4(id)...), link.secret...)
+	if _, err := c.Write(msg); err != nil {
 		c.Close()
 		return
 	}
 	// TODO: Do something if tunnel closed
-	router.acceptChan <- c
+	router.acceptedTunnel(c)
+}
+
+// acceptedTunnel passes a conn sent through the tunnel for its server to the
+// tunnel's handler or to Accept if it has none.
+func (router *Router) acceptedTunnel(c net.Conn) {
+	if router.tunnelCfg.Handler == nil {
+		router.accepted(c)
+		return
+	}
+	select {
+	case router.serviceConns <- c:
+	case <-router.closed:
+		c.Close()
+	}
 }
 
 func (router *Router) nextID() uint32 {
@@ -441,39 +818,110 @@ func (e *TunnelError) Error() string {
 	return e.msg
 }
 
-func connectTunnel(addr string, s *Server) (net.Conn, error) {
-	c, err := net.Dial("tcp", addr)
+// dialTunnel connects to the tunnel, negotiating the protocol with the
+// tunneled-to server. If the server is too old for the framed handshake, the
+// legacy one is used.
+func dialTunnel(tc TunnelConfig, s *Server, takeover []byte) (*tunnelLink, error) {
+	link, err := helloTunnel(tc, s, takeover)
+	if err == errHandshakeUnsupported {
+		link, err = legacyDialTunnel(tc, s)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if hasCap(link.caps, capMux) {
+		link.mux = newMuxSession(link.conn, true)
+		go link.mux.heartbeat(tc.Heartbeat, hasCap(link.caps, capHeartbeat))
+		if hasCap(link.caps, capServices) {
+			go link.serveControl()
+		}
+	}
+	return link, nil
+}
+
+// legacyDialTunnel connects to the tunnel using the handshake from before
+// the protocol was versioned, multiplexing requests over the conn if the
+// server supports it. Otherwise, the conn is used to request a new conn be
+// dialed back for each request.
+func legacyDialTunnel(tc TunnelConfig, s *Server) (*tunnelLink, error) {
+	link := &tunnelLink{version: 1, caps: []string{capMux}}
+	c, secret, err := connectTunnel(tc, s, true)
+	if te, ok := err.(*TunnelError); ok && te.header == HeaderNothing {
+		// Older servers treat the header as the start of an HTTP request
+		link.caps = nil
+		c, secret, err = connectTunnel(tc, s, false)
+	}
 	if err != nil {
 		return nil, err
 	}
+	link.conn, link.secret = c, secret
+	return link, nil
+}
+
+func connectTunnel(tc TunnelConfig, s *Server, mux bool) (net.Conn, []byte, error) {
+	c, err := tc.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+	c.SetDeadline(time.Now().Add(tunnelHandshakeTimeout))
+	secret, err := legacyHandshake(c, tc, s, mux)
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	c.SetDeadline(time.Time{})
+	return c, secret, nil
+}
+
+func legacyHandshake(c net.Conn, tc TunnelConfig, s *Server, mux bool) ([]byte, error) {
 	// Marshal and the send the server data, then wait for a response
 	buf, err := json.Marshal(s)
 	if err != nil {
-		c.Close()
 		return nil, err
 	}
-	if _, err := c.Write(append(headerTunnelBytes, buf...)); err != nil {
-		c.Close()
+	msg := append(headerTunnelBytes, buf...)
+	if mux {
+		// Older servers will see this as a malformed HTTP request line and
+		// respond right away
+		msg = append(append(headerTunnelMuxBytes, buf...), '\n')
+	}
+	// Only read the header since frames may follow it
+	var reply [4]byte
+	if _, err := c.Write(msg); err != nil {
 		return nil, fmt.Errorf("error writing when connecting: %w", err)
-	} else if _, err := c.Read(buf); err != nil { // TODO: Use deadline?
-		c.Close()
+	} else if _, err := io.ReadFull(c, reply[:]); err != nil {
 		return nil, fmt.Errorf("error reading when connecting: %w", err)
 	}
+	var secret []byte
+	if getHeader(reply[:]) == HeaderChallenge {
+		nonce := make([]byte, tunnelNonceLen)
+		if _, err := io.ReadFull(c, nonce); err != nil {
+			return nil, fmt.Errorf("error reading when connecting: %w", err)
+		} else if err := tc.answerChallenge(c, nonce, s.Path); err != nil {
+			return nil, err
+		} else if _, err := io.ReadFull(c, reply[:]); err != nil {
+			return nil, fmt.Errorf("error reading when connecting: %w", err)
+		}
+		if getHeader(reply[:]) == HeaderSuccess {
+			secret = make([]byte, tunnelSecretLen)
+			if _, err := io.ReadFull(c, secret); err != nil {
+				return nil, fmt.Errorf("error reading when connecting: %w", err)
+			}
+		}
+	}
 	// Check the response
-	switch getHeader(buf) {
+	switch getHeader(reply[:]) {
 	case HeaderSuccess:
+		return secret, nil
 	case HeaderBadMessage:
-		c.Close()
 		return nil, newTunnelError(HeaderBadMessage, "bad name or path")
 	case HeaderAlreadyExists:
-		c.Close()
-		return nil, newTunnelError(
-			HeaderAlreadyExists, "name or path already exists on tunneled-to server")
+		return nil, newTunnelError(HeaderAlreadyExists, errTunnelExists.Error())
+	case HeaderUnauthorized:
+		return nil, newTunnelError(HeaderUnauthorized, errTunnelUnauthorized.Error())
 	default:
-		c.Close()
 		return nil, newTunnelError(HeaderNothing, "an error occurred")
 	}
-	return c, nil
 }
 
 type Server struct {
@@ -483,34 +931,288 @@ type Server struct {
 	// Hold whether the server should be displayed on the site or not
 	Hidden bool `json:"hidden,omitempty"`
 
-	proxy *httputil.ReverseProxy
+	// Targets are the upstreams requests are balanced between. Addr is used as
+	// the only target if there are none.
+	Targets []*Target `json:"targets,omitempty"`
+	// Balance is the load balancing strategy (see the Balance constants).
+	// Defaults to round robin.
+	Balance string `json:"balance,omitempty"`
+	// HashOn is what's hashed by the hash strategy: "ip" (default) or
+	// "header:<Header-Name>"
+	HashOn string `json:"hashOn,omitempty"`
+	// HealthCheck configures active health checks of the targets, if set
+	HealthCheck *HealthCheck `json:"healthCheck,omitempty"`
+	// Outlier configures ejecting targets based on request errors, if set
+	Outlier *OutlierDetection `json:"outlierDetection,omitempty"`
+	// Breaker configures a circuit breaker for the server, if set
+	Breaker *CircuitBreaker `json:"circuitBreaker,omitempty"`
+	// Retry configures retrying failed requests, if set
+	Retry *RetryPolicy `json:"retry,omitempty"`
+	// Hedge configures hedging requests with safe methods, if set. Hedged
+	// requests aren't retried.
+	Hedge *HedgePolicy `json:"hedge,omitempty"`
+	// Timeouts configures the timeouts of proxied requests, if set
+	Timeouts *Timeouts `json:"timeouts,omitempty"`
+	// Transport configures the connections to the targets, if set
+	Transport *TransportConfig `json:"transport,omitempty"`
+	// DrainTimeout is how long in-flight requests have to finish once the
+	// server is deleted before they're cancelled. Defaults to 30s.
+	DrainTimeout Duration `json:"drainTimeout,omitempty"`
+	// Concurrency caps the number of requests handled at once, if set
+	Concurrency *ConcurrencyLimit `json:"concurrency,omitempty"`
+	// Adaptive configures a concurrency limit adjusted from latency, if set
+	Adaptive *AdaptiveConcurrency `json:"adaptiveConcurrency,omitempty"`
+
+	proxy     *httputil.ReverseProxy
+	pool      *targetPool
+	health    *healthChecker
+	ejections *ejectionLog
+	breaker   *breaker
+	retries   *retryBudget
+	hedger    *hedger
+	transport *http.Transport
+	drain     *drainState
+	limiter   *limiter
+	adaptive  *adaptiveLimiter
 
 	isTunnel   bool
 	tunnelConn net.Conn
+	tunnelMux  *muxSession
+	// Secret the tunnel's data conns must send, if it was authenticated
+	tunnelSecret []byte
+	// Credential the tunnel was authenticated with, if any
+	tunnelCred *TunnelCredential
+	// Token a new session of the tunnel can send to replace this one
+	tunnelTakeover []byte
+	// Path the tunnel's service is registered with, if the server is one of
+	// the tunnel's services rather than its own server
+	tunnelService string
 }
 
 func (s *Server) Clone() *Server {
+	targets := s.Targets
+	if s.pool != nil {
+		targets = s.pool.getTargets()
+	}
 	return &Server{
-		Name:     s.Name,
-		Path:     s.Path,
-		Addr:     s.Addr,
-		Hidden:   s.Hidden,
-		proxy:    s.proxy,
-		isTunnel: s.isTunnel,
+		Name:         s.Name,
+		Path:         s.Path,
+		Addr:         s.Addr,
+		Hidden:       s.Hidden,
+		Targets:      append([]*Target(nil), targets...),
+		Balance:      s.Balance,
+		HashOn:       s.HashOn,
+		HealthCheck:  s.HealthCheck,
+		Outlier:      s.Outlier,
+		Breaker:      s.Breaker,
+		Retry:        s.Retry,
+		Hedge:        s.Hedge,
+		Timeouts:     s.Timeouts,
+		Transport:    s.Transport,
+		DrainTimeout: s.DrainTimeout,
+		Concurrency:  s.Concurrency,
+		Adaptive:     s.Adaptive,
+		proxy:        s.proxy,
+		pool:         s.pool,
+		health:       s.health,
+		ejections:    s.ejections,
+		breaker:      s.breaker,
+		retries:      s.retries,
+		hedger:       s.hedger,
+		transport:    s.transport,
+		drain:        s.drain,
+		limiter:      s.limiter,
+		adaptive:     s.adaptive,
+		isTunnel:     s.isTunnel,
+	}
+}
+
+// prepare validates the server's config and sets up what's needed to serve
+// it. It's called before the server is added to a router.
+func (s *Server) prepare() error {
+	if s.Path == reservedRoute || strings.HasPrefix(s.Path, reservedRoute+"/") {
+		return ErrReservedPath
+	} else if s.DrainTimeout < 0 {
+		return fmt.Errorf("drain timeout can't be negative")
+	}
+	if s.drain == nil {
+		s.drain = newDrainState()
+	}
+	if s.Breaker != nil && s.breaker == nil {
+		if err := s.Breaker.validate(); err != nil {
+			return err
+		}
+		s.breaker = newBreaker(*s.Breaker, s.Path)
+	}
+	if s.Concurrency != nil && s.limiter == nil {
+		if err := s.Concurrency.validate(); err != nil {
+			return err
+		}
+		s.limiter = newLimiter(*s.Concurrency)
+	}
+	if s.Adaptive != nil && s.adaptive == nil {
+		if err := s.Adaptive.validate(); err != nil {
+			return err
+		}
+		s.adaptive = newAdaptiveLimiter(*s.Adaptive, s.proxy)
+	}
+	return nil
+}
+
+// start starts the server's background tasks (e.g., health checks). It's
+// called once the server has been added to a router.
+func (s *Server) start() {
+	if s.health != nil {
+		s.health.start()
+	}
+}
+
+// stop stops everything started by start and closes the server's idle
+// connections. It's called once the server has been removed from a router.
+func (s *Server) stop() {
+	if s.health != nil {
+		s.health.stop()
+	}
+	if s.transport != nil {
+		s.transport.CloseIdleConnections()
+	}
+}
+
+func (s *Server) ServeHTTP(w RW, r Req) {
+	if s.isStreaming() {
+		clearConnDeadlines(r)
+	}
+	if s.drain != nil {
+		var leave func()
+		var ok bool
+		if r, leave, ok = s.drain.enter(r); !ok {
+			writeRetryAfter(w, s.drain.retryAfter(), "Server draining")
+			return
+		}
+		defer leave()
+	}
+	r, cancel := s.withRequestTimeout(r)
+	defer cancel()
+	if s.limiter != nil {
+		if !s.limiter.acquire(r.Context()) {
+			writeRetryAfter(w, time.Second, "Too many requests")
+			return
+		}
+		defer s.limiter.release()
+	}
+	r, ps := withProxyState(r)
+	if s.breaker != nil {
+		ok, probe, retryAfter := s.breaker.allow()
+		if !ok {
+			writeRetryAfter(w, retryAfter, "Circuit open")
+			return
+		}
+		defer func() {
+			s.breaker.done(probe, ps.known, ps.failed)
+		}()
+	}
+	if s.adaptive != nil {
+		s.adaptive.ServeHTTP(w, r)
+	} else {
+		s.proxy.ServeHTTP(w, r)
 	}
 }
 
 func (s *Server) AddNewProxy(addr string) error {
-	u, err := url.Parse(addr)
+	t, err := NewTarget(addr, 0)
 	if err != nil {
 		return err
 	}
-	s.AddNewProxyWithURL(u)
-	return nil
+	s.Targets = []*Target{t}
+	return s.AddTargetsProxy()
 }
 
 func (s *Server) AddNewProxyWithURL(u *url.URL) {
-	s.AddProxy(httputil.NewSingleHostReverseProxy(u))
+	s.Targets = []*Target{{Addr: u.String(), url: u}}
+	// There's only one target so the strategy doesn't matter
+	pool, _ := newTargetPool(&roundRobinBalancer{}, s.Targets)
+	s.pool = pool
+	s.transport = s.newTransport()
+	s.AddProxy(newPoolProxy(s))
+}
+
+// AddTargetsProxy adds a proxy balancing between the server's targets (or
+// Addr if there are no targets).
+func (s *Server) AddTargetsProxy() error {
+	b, err := newBalancer(s.Balance, s.HashOn)
+	if err != nil {
+		return err
+	}
+	if s.HealthCheck != nil {
+		if err := s.HealthCheck.validate(); err != nil {
+			return err
+		}
+	}
+	if s.Outlier != nil {
+		if err := s.Outlier.validate(); err != nil {
+			return err
+		}
+	}
+	if s.Retry != nil {
+		if err := s.Retry.validate(); err != nil {
+			return err
+		}
+	}
+	if s.Hedge != nil {
+		if err := s.Hedge.validate(); err != nil {
+			return err
+		}
+	}
+	if s.Timeouts != nil {
+		if err := s.Timeouts.validate(); err != nil {
+			return err
+		}
+	}
+	if s.Transport != nil {
+		if err := s.Transport.validate(); err != nil {
+			return err
+		}
+	}
+	targets := s.Targets
+	if len(targets) == 0 {
+		if s.Addr == "" {
+			return fmt.Errorf("must have addr or targets")
+		}
+		targets = []*Target{{Addr: s.Addr}}
+	}
+	for i, t := range targets {
+		if targets[i], err = NewTarget(t.Addr, t.Weight); err != nil {
+			return err
+		}
+	}
+	pool, err := newTargetPool(b, targets)
+	if err != nil {
+		return err
+	}
+	s.Targets, s.pool = targets, pool
+	s.transport = s.newTransport()
+	if s.HealthCheck != nil {
+		s.health = newHealthChecker(s)
+	}
+	if s.Outlier != nil {
+		s.ejections = &ejectionLog{}
+	}
+	if s.Retry != nil {
+		s.retries = newRetryBudget(s.Retry)
+	}
+	if s.Hedge != nil {
+		s.hedger = newHedger(*s.Hedge)
+	}
+	s.AddProxy(newPoolProxy(s))
+	return nil
+}
+
+// GetTargets returns the server's current targets.
+func (s *Server) GetTargets() []*Target {
+	if s.pool == nil {
+		return nil
+	}
+	return s.pool.getTargets()
 }
 
 func (s *Server) Proxy() *httputil.ReverseProxy {
@@ -536,18 +1238,72 @@ func (s *Server) AddProxy(p *httputil.ReverseProxy) {
 	    return nil
 	  }
 	*/
+	// Watch the results of requests for outlier detection
+	if eh := p.ErrorHandler; eh == nil {
+		p.ErrorHandler = s.handleProxyError
+	} else {
+		p.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			s.recordProxyError(r, err)
+			eh(w, r, err)
+		}
+	}
+	if mr := p.ModifyResponse; mr == nil {
+		p.ModifyResponse = func(resp *http.Response) error {
+			s.handleProxyResponse(resp)
+			return nil
+		}
+	} else {
+		p.ModifyResponse = func(resp *http.Response) error {
+			s.handleProxyResponse(resp)
+			return mr(resp)
+		}
+	}
 	s.proxy = p
 }
 
 type pageData struct {
 	Name, Path string
+	// Health is a summary of the health of the server's targets. Empty if the
+	// server isn't health checked.
+	Health string
+	// Circuit is the state of the server's circuit breaker if it's not closed
+	Circuit string
 }
 
 func (s *Server) ToPageData(parts []string) pageData {
 	return pageData{
-		Name: s.Name,
-		Path: path.Join(path.Join(parts...), s.Path),
+		Name:    s.Name,
+		Path:    path.Join(path.Join(parts...), s.Path),
+		Health:  s.healthSummary(),
+		Circuit: s.circuitSummary(),
+	}
+}
+
+func (s *Server) circuitSummary() string {
+	if bs, ok := s.BreakerStatus(); ok && bs.State != BreakerClosed {
+		return "circuit " + bs.State.String()
+	}
+	return ""
+}
+
+func (s *Server) healthSummary() string {
+	if s.health == nil {
+		return ""
+	}
+	targets := s.pool.getTargets()
+	healthy := 0
+	for _, t := range targets {
+		if t.Healthy() {
+			healthy++
+		}
+	}
+	switch healthy {
+	case len(targets):
+		return "healthy"
+	case 0:
+		return "unhealthy"
 	}
+	return fmt.Sprintf("%d/%d healthy", healthy, len(targets))
 }
 
 type BufConn struct {
@@ -579,7 +1335,17 @@ const (
 	// HeaderBadMessage represents a bad message send
 	HeaderBadMessage uint32 = 0xFFFFFFFC
 	// HeaderAlreadyExists means the server already exists
-	HeaderAlreadyExists uint32 = 0xFFFFFFB
+	HeaderAlreadyExists uint32 = 0xFFFFFFFB
+	// HeaderTunnelMux is the header used to create a new tunnel with requests
+	// multiplexed over the tunnel's conn
+	HeaderTunnelMux uint32 = 0xFFFFFFFA
+	// HeaderChallenge is followed by a nonce the tunnel must answer with its
+	// credentials
+	HeaderChallenge uint32 = 0xFFFFFFF9
+	// HeaderUnauthorized means the tunnel's credentials were rejected
+	HeaderUnauthorized uint32 = 0xFFFFFFF8
+	// HeaderHello starts the framed, versioned tunnel handshake
+	HeaderHello uint32 = 0xFFFFFFF7
 )
 
 var (
@@ -588,6 +1354,9 @@ var (
 	headerSuccessBytes       = put4(HeaderSuccess)
 	headerBadMessageBytes    = put4(HeaderBadMessage)
 	headerAlreadyExistsBytes = put4(HeaderAlreadyExists)
+	headerTunnelMuxBytes     = put4(HeaderTunnelMux)
+	headerUnauthorizedBytes  = put4(HeaderUnauthorized)
+	headerHelloBytes         = put4(HeaderHello)
 )
 
 func getHeader(p []byte) uint32 {
@@ -606,6 +1375,14 @@ func getHeader(p []byte) uint32 {
 			return HeaderBadMessage
 		case 0xFB:
 			return HeaderAlreadyExists
+		case 0xFA:
+			return HeaderTunnelMux
+		case 0xF9:
+			return HeaderChallenge
+		case 0xF8:
+			return HeaderUnauthorized
+		case 0xF7:
+			return HeaderHello
 		}
 	}
 	return HeaderNothing
@@ -0,0 +1,300 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Target is one of the upstreams a Server proxies to.
+type Target struct {
+	Addr string `json:"addr"`
+	// Weight is used by the weighted and hash strategies. Defaults to 1.
+	Weight int `json:"weight,omitempty"`
+
+	url         *url.URL
+	outstanding int64
+	health      targetHealth
+	outlier     outlierState
+}
+
+// NewTarget creates a new target with the given address and weight.
+func NewTarget(addr string, weight int) (*Target, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("bad target address %q: %w", addr, err)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid proto for target %q", addr)
+	} else if weight < 0 {
+		return nil, fmt.Errorf("invalid weight for target %q", addr)
+	}
+	return &Target{Addr: addr, Weight: weight, url: u}, nil
+}
+
+// URL returns the parsed address of the target.
+func (t *Target) URL() *url.URL {
+	return t.url
+}
+
+// Outstanding returns the number of requests to the target that haven't
+// finished.
+func (t *Target) Outstanding() int64 {
+	return atomic.LoadInt64(&t.outstanding)
+}
+
+// available returns whether the target can be sent requests.
+func (t *Target) available() bool {
+	return t.Healthy() && !t.Ejected()
+}
+
+func (t *Target) weight() int {
+	if t.Weight <= 0 {
+		return 1
+	}
+	return t.Weight
+}
+
+// roundTrip sends the request to the target using the given transport. The
+// request is cloned before its URL is rewritten.
+func (t *Target) roundTrip(rt http.RoundTripper, req *http.Request) (*http.Response, error) {
+	outreq := req.Clone(req.Context())
+	rewriteURL(outreq.URL, t.url)
+	atomic.AddInt64(&t.outstanding, 1)
+	resp, err := rt.RoundTrip(outreq)
+	if err != nil {
+		atomic.AddInt64(&t.outstanding, -1)
+		return nil, err
+	}
+	// The request is outstanding until the body has been closed
+	resp.Body = wrapBodyDone(resp.Body, func() { atomic.AddInt64(&t.outstanding, -1) })
+	return resp, nil
+}
+
+// wrapBodyDone wraps the body so done is called once it's closed.
+func wrapBodyDone(body io.ReadCloser, done func()) io.ReadCloser {
+	if rwc, ok := body.(io.ReadWriteCloser); ok {
+		// Keep the body writable for upgraded connections
+		return &doneReadWriteCloser{ReadWriteCloser: rwc, done: done}
+	}
+	return &doneReadCloser{ReadCloser: body, done: done}
+}
+
+type doneReadCloser struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (rc *doneReadCloser) Close() error {
+	err := rc.ReadCloser.Close()
+	rc.once.Do(rc.done)
+	return err
+}
+
+type doneReadWriteCloser struct {
+	io.ReadWriteCloser
+	once sync.Once
+	done func()
+}
+
+func (rwc *doneReadWriteCloser) Close() error {
+	err := rwc.ReadWriteCloser.Close()
+	rwc.once.Do(rwc.done)
+	return err
+}
+
+// rewriteURL points the u at the target, the same way the director from
+// httputil.NewSingleHostReverseProxy does.
+func rewriteURL(u, target *url.URL) {
+	u.Scheme = target.Scheme
+	u.Host = target.Host
+	u.Path, u.RawPath = joinURLPath(target, u)
+	if target.RawQuery == "" || u.RawQuery == "" {
+		u.RawQuery = target.RawQuery + u.RawQuery
+	} else {
+		u.RawQuery = target.RawQuery + "&" + u.RawQuery
+	}
+}
+
+func joinURLPath(a, b *url.URL) (path, rawpath string) {
+	if a.RawPath == "" && b.RawPath == "" {
+		return singleJoiningSlash(a.Path, b.Path), ""
+	}
+	apath, bpath := a.EscapedPath(), b.EscapedPath()
+	aslash, bslash := strings.HasSuffix(apath, "/"), strings.HasPrefix(bpath, "/")
+	switch {
+	case aslash && bslash:
+		return a.Path + b.Path[1:], apath + bpath[1:]
+	case !aslash && !bslash:
+		return a.Path + "/" + b.Path, apath + "/" + bpath
+	}
+	return a.Path + b.Path, apath + bpath
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash, bslash := strings.HasSuffix(a, "/"), strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+var (
+	ErrTargetExists   = fmt.Errorf("target already exists")
+	ErrTargetNotExist = fmt.Errorf("target does not exist")
+	ErrNoTargets      = fmt.Errorf("no targets available")
+	ErrNoTargetPool   = fmt.Errorf("server does not have targets")
+)
+
+// targetPool holds the targets of a server. The targets slice is never
+// modified in place so it can be used after being loaded without the lock.
+type targetPool struct {
+	mtx      sync.RWMutex
+	targets  []*Target
+	balancer balancer
+}
+
+func newTargetPool(b balancer, targets []*Target) (*targetPool, error) {
+	p := &targetPool{balancer: b}
+	for _, t := range targets {
+		if err := p.add(t); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (p *targetPool) getTargets() []*Target {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+	return p.targets
+}
+
+func (p *targetPool) add(t *Target) error {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for _, other := range p.targets {
+		if other.Addr == t.Addr {
+			return ErrTargetExists
+		}
+	}
+	targets := make([]*Target, len(p.targets), len(p.targets)+1)
+	copy(targets, p.targets)
+	p.targets = append(targets, t)
+	return nil
+}
+
+func (p *targetPool) remove(addr string) (*Target, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for i, t := range p.targets {
+		if t.Addr == addr {
+			targets := make([]*Target, 0, len(p.targets)-1)
+			targets = append(targets, p.targets[:i]...)
+			p.targets = append(targets, p.targets[i+1:]...)
+			return t, nil
+		}
+	}
+	return nil, ErrTargetNotExist
+}
+
+// pick picks a target for the request, returning nil if there are none
+// available.
+func (p *targetPool) pick(r Req) *Target {
+	return p.balancer.pick(r, p.getTargets(), (*Target).available)
+}
+
+// pickExcluding picks a target for the request other than the ones given.
+// If all the available targets are excluded, one of them is picked.
+func (p *targetPool) pickExcluding(r Req, exclude []*Target) *Target {
+	if len(exclude) == 0 {
+		return p.pick(r)
+	}
+	t := p.balancer.pick(r, p.getTargets(), func(t *Target) bool {
+		if !t.available() {
+			return false
+		}
+		for _, other := range exclude {
+			if t == other {
+				return false
+			}
+		}
+		return true
+	})
+	if t == nil {
+		return p.pick(r)
+	}
+	return t
+}
+
+// poolTransport sends each request to a target picked from the server's
+// pool.
+type poolTransport struct {
+	srvr *Server
+	pool *targetPool
+	base http.RoundTripper
+}
+
+func (pt *poolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if pt.srvr.hedger != nil && canHedge(req) {
+		return pt.roundTripHedged(req)
+	} else if pt.srvr.retries != nil {
+		return pt.roundTripRetry(req)
+	}
+	t := pt.pool.pick(req)
+	if t == nil {
+		return nil, ErrNoTargets
+	}
+	if ps := getProxyState(req.Context()); ps != nil {
+		ps.target = t
+	}
+	return t.roundTrip(pt.base, req)
+}
+
+func newPoolProxy(s *Server) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		// The URL is set by the transport once the target is picked
+		Director: func(*http.Request) {},
+		Transport: &poolTransport{
+			srvr: s,
+			pool: s.pool,
+			base: s.transport,
+		},
+	}
+}
+
+// AddTarget adds a target to the server with the given path.
+func (router *Router) AddTarget(path string, t *Target) error {
+	srvr, ok := router.routes.Load(path)
+	if !ok {
+		return ErrServerNotExist
+	} else if srvr.pool == nil {
+		return ErrNoTargetPool
+	}
+	t, err := NewTarget(t.Addr, t.Weight)
+	if err != nil {
+		return err
+	}
+	return srvr.pool.add(t)
+}
+
+// RemoveTarget removes the target with the given address from the server
+// with the given path.
+func (router *Router) RemoveTarget(path, addr string) error {
+	srvr, ok := router.routes.Load(path)
+	if !ok {
+		return ErrServerNotExist
+	} else if srvr.pool == nil {
+		return ErrNoTargetPool
+	}
+	_, err := srvr.pool.remove(addr)
+	return err
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Timeouts configures the timeouts of requests proxied by a server.
+type Timeouts struct {
+	// Dial is how long connecting to a target can take. Defaults to 30s.
+	Dial Duration `json:"dial,omitempty"`
+	// TLSHandshake is how long the TLS handshake with a target can take.
+	// Defaults to 10s.
+	TLSHandshake Duration `json:"tlsHandshake,omitempty"`
+	// ResponseHeader is how long to wait for a target's response headers after
+	// the request has been written. No timeout if 0.
+	ResponseHeader Duration `json:"responseHeader,omitempty"`
+	// Idle is how long an idle connection to a target is kept open. Defaults
+	// to 90s.
+	Idle Duration `json:"idle,omitempty"`
+	// Request is how long the whole request (including reading the response
+	// body) can take. No timeout if 0.
+	Request Duration `json:"request,omitempty"`
+	// Streaming opts the server out of the request timeout and the read and
+	// write timeouts of the listener, for long polling and streaming.
+	Streaming bool `json:"streaming,omitempty"`
+}
+
+func (to *Timeouts) validate() error {
+	if to.Dial < 0 || to.TLSHandshake < 0 || to.ResponseHeader < 0 ||
+		to.Idle < 0 || to.Request < 0 {
+		return fmt.Errorf("timeouts can't be negative")
+	}
+	return nil
+}
+
+func (to *Timeouts) dial() time.Duration {
+	return to.Dial.Or(30 * time.Second)
+}
+
+func (to *Timeouts) tlsHandshake() time.Duration {
+	return to.TLSHandshake.Or(10 * time.Second)
+}
+
+func (to *Timeouts) idle() time.Duration {
+	return to.Idle.Or(90 * time.Second)
+}
+
+// apply sets the timeouts of the transport to the server's targets.
+func (to *Timeouts) apply(tr *http.Transport, keepAlive time.Duration) {
+	tr.DialContext = (&net.Dialer{
+		Timeout:   to.dial(),
+		KeepAlive: keepAlive,
+	}).DialContext
+	tr.TLSHandshakeTimeout = to.tlsHandshake()
+	tr.ResponseHeaderTimeout = to.ResponseHeader.Std()
+	tr.IdleConnTimeout = to.idle()
+}
+
+// requestTimeout returns the server's total request timeout, 0 meaning none.
+func (s *Server) requestTimeout() time.Duration {
+	if s.Timeouts == nil || s.Timeouts.Streaming {
+		return 0
+	}
+	return s.Timeouts.Request.Std()
+}
+
+// isStreaming returns whether the server has opted out of timeouts.
+func (s *Server) isStreaming() bool {
+	return s.Timeouts != nil && s.Timeouts.Streaming
+}
+
+type connCtxKey struct{}
+
+// clearConnDeadlines clears the read and write deadlines set on the request's
+// connection by the http.Server's timeouts. The connection is only known if
+// the router's ConnContext is used.
+func clearConnDeadlines(r Req) {
+	if c, ok := r.Context().Value(connCtxKey{}).(net.Conn); ok {
+		c.SetDeadline(time.Time{})
+	}
+}
+
+// withRequestTimeout returns the request with the server's request timeout
+// applied and the function to release its resources.
+func (s *Server) withRequestTimeout(r Req) (Req, context.CancelFunc) {
+	d := s.requestTimeout()
+	if d <= 0 {
+		return r, func() {}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), d)
+	return r.WithContext(ctx), cancel
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// TransportConfig configures the pool of connections a server keeps to its
+// targets.
+type TransportConfig struct {
+	// MaxIdleConns is the max number of idle connections across all targets.
+	// Defaults to 100.
+	MaxIdleConns int `json:"maxIdleConns,omitempty"`
+	// MaxIdleConnsPerHost is the max number of idle connections kept to each
+	// target. Defaults to 32.
+	MaxIdleConnsPerHost int `json:"maxIdleConnsPerHost,omitempty"`
+	// MaxConnsPerHost is the max number of connections to each target. No
+	// limit if 0.
+	MaxConnsPerHost int `json:"maxConnsPerHost,omitempty"`
+	// KeepAlive is the interval of TCP keep-alive probes. Defaults to 30s.
+	KeepAlive Duration `json:"keepAlive,omitempty"`
+	// DisableKeepAlives stops connections from being reused between requests
+	DisableKeepAlives bool `json:"disableKeepAlives,omitempty"`
+	// DisableHTTP2 stops HTTP/2 from being used with HTTPS targets
+	DisableHTTP2 bool `json:"disableHTTP2,omitempty"`
+	// IgnoreProxyEnv stops the HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+	// environment variables from being used
+	IgnoreProxyEnv bool `json:"ignoreProxyEnv,omitempty"`
+}
+
+func (tc *TransportConfig) validate() error {
+	if tc.MaxIdleConns < 0 || tc.MaxIdleConnsPerHost < 0 || tc.MaxConnsPerHost < 0 {
+		return fmt.Errorf("transport connection limits can't be negative")
+	} else if tc.KeepAlive < 0 {
+		return fmt.Errorf("transport keep-alive can't be negative")
+	}
+	return nil
+}
+
+func (tc *TransportConfig) maxIdleConns() int {
+	if tc.MaxIdleConns <= 0 {
+		return 100
+	}
+	return tc.MaxIdleConns
+}
+
+func (tc *TransportConfig) maxIdleConnsPerHost() int {
+	if tc.MaxIdleConnsPerHost <= 0 {
+		return 32
+	}
+	return tc.MaxIdleConnsPerHost
+}
+
+func (tc *TransportConfig) keepAlive() time.Duration {
+	return tc.KeepAlive.Or(30 * time.Second)
+}
+
+// newTransport returns a new transport for sending requests to the server's
+// targets, configured by its transport config and timeouts.
+func (s *Server) newTransport() *http.Transport {
+	tc, to := s.Transport, s.Timeouts
+	if tc == nil {
+		tc = &TransportConfig{}
+	}
+	if to == nil {
+		to = &Timeouts{}
+	}
+	tr := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ForceAttemptHTTP2:     !tc.DisableHTTP2,
+		MaxIdleConns:          tc.maxIdleConns(),
+		MaxIdleConnsPerHost:   tc.maxIdleConnsPerHost(),
+		MaxConnsPerHost:       tc.MaxConnsPerHost,
+		DisableKeepAlives:     tc.DisableKeepAlives,
+		ExpectContinueTimeout: time.Second,
+	}
+	if tc.IgnoreProxyEnv {
+		tr.Proxy = nil
+	}
+	to.apply(tr, tc.keepAlive())
+	return tr
+}
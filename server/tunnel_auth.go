@@ -0,0 +1,276 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	// Length of the nonce sent in a tunnel auth challenge
+	tunnelNonceLen = 32
+	// Length of the secret data conns of a tunnel session must send
+	tunnelSecretLen = 32
+	// Max length of a tunnel auth response
+	tunnelMaxAuthLen = 4096
+)
+
+// TunnelCredential is a credential a tunnel can register with.
+type TunnelCredential struct {
+	// ID identifies the credential. Required when Secret is used.
+	ID string `json:"id,omitempty"`
+	// Token is a pre-shared token the tunnel sends as is
+	Token string `json:"token,omitempty"`
+	// Secret is the key the tunnel uses to answer an HMAC-SHA256 challenge. It
+	// never crosses the wire.
+	Secret string `json:"secret,omitempty"`
+	// Paths are the paths the credential can register
+	Paths []string `json:"paths,omitempty"`
+	// PathPrefix allows the credential to register any path starting with it
+	PathPrefix string `json:"pathPrefix,omitempty"`
+	// ServerNames are the server names the credential can route to TCP
+	// services by TLS SNI. A name starting with "*." allows any subdomain.
+	ServerNames []string `json:"serverNames,omitempty"`
+}
+
+func (tc *TunnelCredential) validate() error {
+	if (tc.Token == "") == (tc.Secret == "") {
+		return fmt.Errorf("tunnel credential must have exactly one of token or secret")
+	} else if tc.Secret != "" && tc.ID == "" {
+		return fmt.Errorf("tunnel credential with secret must have an ID")
+	} else if len(tc.Paths) == 0 && tc.PathPrefix == "" {
+		return fmt.Errorf("tunnel credential must allow paths or a path prefix")
+	}
+	return nil
+}
+
+// allows returns whether the credential can register the path.
+func (tc *TunnelCredential) allows(path string) bool {
+	for _, p := range tc.Paths {
+		if p == path {
+			return true
+		}
+	}
+	return tc.PathPrefix != "" && strings.HasPrefix(path, tc.PathPrefix)
+}
+
+// allowsServerName returns whether the credential can route the server name to
+// a TCP service.
+func (tc *TunnelCredential) allowsServerName(name string) bool {
+	name = strings.ToLower(name)
+	for _, n := range tc.ServerNames {
+		n = strings.ToLower(n)
+		if n == name {
+			return true
+		} else if strings.HasPrefix(n, "*.") {
+			if i := strings.IndexByte(name, '.'); i > 0 && name[i:] == n[1:] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// TunnelAuth holds the credentials tunnels must register with.
+type TunnelAuth struct {
+	Credentials []TunnelCredential `json:"credentials"`
+}
+
+func (ta *TunnelAuth) validate() error {
+	ids := make(map[string]bool)
+	for i := range ta.Credentials {
+		tc := &ta.Credentials[i]
+		if err := tc.validate(); err != nil {
+			return err
+		}
+		if tc.ID != "" {
+			if ids[tc.ID] {
+				return fmt.Errorf("duplicate tunnel credential ID: %s", tc.ID)
+			}
+			ids[tc.ID] = true
+		}
+	}
+	return nil
+}
+
+// LoadTunnelAuth reads TunnelAuth from a JSON file.
+func LoadTunnelAuth(path string) (*TunnelAuth, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ta := &TunnelAuth{}
+	if err := json.NewDecoder(f).Decode(ta); err != nil {
+		return nil, fmt.Errorf("error parsing tunnel auth file: %w", err)
+	}
+	return ta, ta.validate()
+}
+
+// SetTunnelAuth sets the credentials tunnels must register with. If nil,
+// tunnels can register any free path without credentials. Tunnels already
+// registered stay registered and their conns are checked against the secret
+// they registered with, if any.
+func (router *Router) SetTunnelAuth(ta *TunnelAuth) error {
+	if ta != nil {
+		if err := ta.validate(); err != nil {
+			return err
+		}
+	}
+	router.tunnelAuth.Store(ta)
+	return nil
+}
+
+// tunnelAuthResponse is sent by the tunnel in response to a challenge.
+type tunnelAuthResponse struct {
+	ID    string `json:"id,omitempty"`
+	Token string `json:"token,omitempty"`
+	// MAC is the hex HMAC-SHA256 of the nonce followed by the path
+	MAC string `json:"mac,omitempty"`
+}
+
+func tunnelMAC(secret string, nonce []byte, path string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(nonce)
+	mac.Write([]byte(path))
+	return mac.Sum(nil)
+}
+
+// check returns the credential matching the response if it allows the path.
+func (ta *TunnelAuth) check(resp tunnelAuthResponse, nonce []byte, path string) *TunnelCredential {
+	for i := range ta.Credentials {
+		tc := &ta.Credentials[i]
+		if resp.ID != "" && tc.ID != resp.ID {
+			continue
+		}
+		var ok bool
+		if tc.Token != "" {
+			ok = resp.Token != "" &&
+				subtle.ConstantTimeCompare([]byte(tc.Token), []byte(resp.Token)) == 1
+		} else if mac, err := hex.DecodeString(resp.MAC); err == nil {
+			ok = hmac.Equal(mac, tunnelMAC(tc.Secret, nonce, path))
+		}
+		if ok && tc.allows(path) {
+			return tc
+		} else if ok {
+			return nil
+		}
+	}
+	return nil
+}
+
+var errTunnelUnauthorized = fmt.Errorf("unauthorized by tunneled-to server")
+
+// authTunnel checks the connecting tunnel has credentials allowing it to
+// register the path. exchange sends the challenge's nonce to the tunnel and
+// returns its response. If the tunnel is authenticated, a secret for the
+// session and the credential used are returned. If the router doesn't require
+// auth, nothing is returned.
+func (router *Router) authTunnel(
+	path string, exchange func(nonce []byte) (tunnelAuthResponse, error),
+) ([]byte, *TunnelCredential, error) {
+	ta := router.tunnelAuth.Load()
+	if ta == nil {
+		return nil, nil, nil
+	}
+	nonce := make([]byte, tunnelNonceLen)
+	if _, err := rand.Read(nonce); err != nil {
+		Logger.Printf("error generating tunnel nonce: %v", err)
+		return nil, nil, err
+	}
+	resp, err := exchange(nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+	cred := ta.check(resp, nonce, path)
+	if cred == nil {
+		Logger.Printf("unauthorized tunnel registration for path %s", path)
+		return nil, nil, errTunnelUnauthorized
+	}
+	secret := make([]byte, tunnelSecretLen)
+	if _, err := rand.Read(secret); err != nil {
+		Logger.Printf("error generating tunnel secret: %v", err)
+		return nil, nil, err
+	}
+	return secret, cred, nil
+}
+
+// authTunnelService returns whether the tunnel of the server can register a
+// service with the path.
+func (router *Router) authTunnelService(s *Server, path string) bool {
+	if router.tunnelAuth.Load() == nil {
+		return true
+	}
+	return s.tunnelCred != nil && s.tunnelCred.allows(path)
+}
+
+// authTunnelServerName returns whether the tunnel of the server can route the
+// server name to a TCP service.
+func (router *Router) authTunnelServerName(s *Server, name string) bool {
+	if router.tunnelAuth.Load() == nil {
+		return true
+	}
+	return s.tunnelCred != nil && s.tunnelCred.allowsServerName(name)
+}
+
+// legacyAuthExchange sends the challenge of the legacy handshake and reads the
+// response.
+func legacyAuthExchange(c io.ReadWriter) func([]byte) (tunnelAuthResponse, error) {
+	return func(nonce []byte) (tunnelAuthResponse, error) {
+		var resp tunnelAuthResponse
+		if _, err := c.Write(append(put4(HeaderChallenge), nonce...)); err != nil {
+			return resp, err
+		}
+		var lenBuf [4]byte
+		if _, err := io.ReadFull(c, lenBuf[:]); err != nil {
+			return resp, err
+		}
+		n := binary.BigEndian.Uint32(lenBuf[:])
+		if n > tunnelMaxAuthLen {
+			// An empty response fails the check
+			return resp, nil
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(c, buf); err != nil {
+			return resp, err
+		}
+		json.Unmarshal(buf, &resp)
+		return resp, nil
+	}
+}
+
+// authResponse answers a tunnel auth challenge with the config's credentials.
+func (cfg *TunnelConfig) authResponse(nonce []byte, path string) (tunnelAuthResponse, error) {
+	resp := tunnelAuthResponse{ID: cfg.CredentialID}
+	if cfg.Token != "" {
+		resp.Token = cfg.Token
+	} else if cfg.Secret != "" {
+		resp.MAC = hex.EncodeToString(tunnelMAC(cfg.Secret, nonce, path))
+	} else {
+		return resp, newTunnelError(HeaderUnauthorized, "tunneled-to server requires credentials")
+	}
+	return resp, nil
+}
+
+// answerChallenge answers a legacy tunnel auth challenge with the config's
+// credentials.
+func (cfg *TunnelConfig) answerChallenge(c io.Writer, nonce []byte, path string) error {
+	resp, err := cfg.authResponse(nonce, path)
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(append(put4(uint32(len(buf))), buf...))
+	return err
+}
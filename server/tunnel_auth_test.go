@@ -0,0 +1,157 @@
+package server
+
+import (
+	"encoding/hex"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestTunnelCredentialValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		tc   TunnelCredential
+		err  bool
+	}{
+		{"token", TunnelCredential{Token: "t", Paths: []string{"p"}}, false},
+		{"secret", TunnelCredential{ID: "id", Secret: "s", PathPrefix: "p"}, false},
+		{"neither", TunnelCredential{Paths: []string{"p"}}, true},
+		{"both", TunnelCredential{ID: "id", Token: "t", Secret: "s", Paths: []string{"p"}}, true},
+		{"secret without ID", TunnelCredential{Secret: "s", Paths: []string{"p"}}, true},
+		{"no paths", TunnelCredential{Token: "t"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.tc.validate(); (err != nil) != test.err {
+				t.Fatalf("got error %v", err)
+			}
+		})
+	}
+	dup := TunnelAuth{Credentials: []TunnelCredential{
+		{ID: "id", Token: "t1", Paths: []string{"a"}},
+		{ID: "id", Token: "t2", Paths: []string{"b"}},
+	}}
+	if err := dup.validate(); err == nil {
+		t.Fatal("duplicate credential IDs allowed")
+	}
+}
+
+func TestTunnelAuthCheck(t *testing.T) {
+	ta := &TunnelAuth{Credentials: []TunnelCredential{
+		{ID: "tok", Token: "token", Paths: []string{"a", "b"}},
+		{ID: "mac", Secret: "secret", PathPrefix: "team-"},
+	}}
+	nonce := []byte("0123456789abcdef0123456789abcdef")
+	mac := func(secret, path string) string {
+		return hex.EncodeToString(tunnelMAC(secret, nonce, path))
+	}
+	tests := []struct {
+		name string
+		resp tunnelAuthResponse
+		path string
+		want bool
+	}{
+		{"token", tunnelAuthResponse{Token: "token"}, "a", true},
+		{"token with ID", tunnelAuthResponse{ID: "tok", Token: "token"}, "b", true},
+		{"wrong token", tunnelAuthResponse{Token: "nope"}, "a", false},
+		{"token path not allowed", tunnelAuthResponse{Token: "token"}, "c", false},
+		{"token with other ID", tunnelAuthResponse{ID: "mac", Token: "token"}, "a", false},
+		{"mac", tunnelAuthResponse{ID: "mac", MAC: mac("secret", "team-x")}, "team-x", true},
+		{"mac prefix not matched", tunnelAuthResponse{ID: "mac", MAC: mac("secret", "x")}, "x", false},
+		{"mac wrong secret", tunnelAuthResponse{ID: "mac", MAC: mac("nope", "team-x")}, "team-x", false},
+		// A MAC for one path can't be used for another
+		{"mac other path", tunnelAuthResponse{ID: "mac", MAC: mac("secret", "team-x")}, "team-y", false},
+		{"mac not hex", tunnelAuthResponse{ID: "mac", MAC: "zz"}, "team-x", false},
+		{"nothing", tunnelAuthResponse{}, "a", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := ta.check(test.resp, nonce, test.path); (got != nil) != test.want {
+				t.Fatalf("got %v, want %v", got, test.want)
+			} else if got != nil && got.ID != test.resp.ID && test.resp.ID != "" {
+				t.Fatalf("matched credential %s", got.ID)
+			}
+		})
+	}
+}
+
+func TestAuthTunnel(t *testing.T) {
+	ta := &TunnelAuth{Credentials: []TunnelCredential{
+		{ID: "tok", Token: "token", Paths: []string{"t"}},
+		{ID: "mac", Secret: "secret", Paths: []string{"t"}},
+	}}
+	tests := []struct {
+		name string
+		ta   *TunnelAuth
+		cfg  TunnelConfig
+		// Whether the challenge goes over the legacy handshake
+		legacy bool
+		err    error
+	}{
+		{"no auth", nil, TunnelConfig{}, false, nil},
+		{"token", ta, TunnelConfig{Token: "token"}, false, nil},
+		{"hmac", ta, TunnelConfig{CredentialID: "mac", Secret: "secret"}, false, nil},
+		{"wrong secret", ta, TunnelConfig{CredentialID: "mac", Secret: "nope"}, false, errTunnelUnauthorized},
+		{"legacy token", ta, TunnelConfig{Token: "token"}, true, nil},
+		{"legacy hmac", ta, TunnelConfig{CredentialID: "mac", Secret: "secret"}, true, nil},
+		{"legacy wrong token", ta, TunnelConfig{Token: "nope"}, true, errTunnelUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			router := NewRouterHandler()
+			if err := router.SetTunnelAuth(test.ta); err != nil {
+				t.Fatal(err)
+			}
+			exchange := func(nonce []byte) (tunnelAuthResponse, error) {
+				return test.cfg.authResponse(nonce, "t")
+			}
+			if test.legacy {
+				c1, c2 := net.Pipe()
+				defer c1.Close()
+				defer c2.Close()
+				go func() {
+					// Answer the challenge like a legacy tunnel would
+					buf := make([]byte, 4+tunnelNonceLen)
+					if _, err := io.ReadFull(c1, buf); err == nil && getHeader(buf) == HeaderChallenge {
+						test.cfg.answerChallenge(c1, buf[4:], "t")
+					}
+				}()
+				exchange = legacyAuthExchange(c2)
+			}
+			secret, cred, err := router.authTunnel("t", exchange)
+			if err != test.err {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			} else if err == nil && (test.ta != nil) != (len(secret) == tunnelSecretLen) {
+				t.Fatalf("got secret of %d bytes", len(secret))
+			} else if err == nil && (test.ta != nil) != (cred != nil) {
+				t.Fatalf("got credential %v", cred)
+			}
+		})
+	}
+}
+
+func TestAuthTunnelService(t *testing.T) {
+	cred := &TunnelCredential{Token: "token", Paths: []string{"t", "svc"}}
+	tests := []struct {
+		name string
+		ta   *TunnelAuth
+		cred *TunnelCredential
+		path string
+		want bool
+	}{
+		{"no auth", nil, nil, "any", true},
+		{"allowed", &TunnelAuth{}, cred, "svc", true},
+		{"not allowed", &TunnelAuth{}, cred, "other", false},
+		{"no credential", &TunnelAuth{}, nil, "svc", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			router := NewRouterHandler()
+			router.tunnelAuth.Store(test.ta)
+			s := &Server{Path: "t", tunnelCred: test.cred}
+			if got := router.authTunnelService(s, test.path); got != test.want {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"crypto/subtle"
+	"sync"
+	"time"
+)
+
+// Max time a request waits for a tunnel to dial back a conn
+const tunnelConnTimeout = 30 * time.Second
+
+// pendingTunnelConns holds the requests waiting for their tunnel to dial back
+// a conn, by the ID sent in the connect message.
+type pendingTunnelConns struct {
+	mtx     sync.Mutex
+	waiters map[uint32]*pendingTunnelConn
+	// Number of conns that arrived after their request stopped waiting, that
+	// had an ID that was never sent and that had the wrong secret
+	late, unknown, mismatched uint64
+}
+
+type pendingTunnelConn struct {
+	id uint32
+	s  *Server
+	// Buffered so delivering never blocks
+	ch      chan tunnelDataConn
+	expires time.Time
+}
+
+// add registers a request to the server waiting for the conn with the ID.
+func (p *pendingTunnelConns) add(id uint32, s *Server) *pendingTunnelConn {
+	pc := &pendingTunnelConn{
+		id:      id,
+		s:       s,
+		ch:      make(chan tunnelDataConn, 1),
+		expires: time.Now().Add(tunnelConnTimeout),
+	}
+	p.mtx.Lock()
+	if p.waiters == nil {
+		p.waiters = make(map[uint32]*pendingTunnelConn)
+	}
+	p.waiters[id] = pc
+	p.mtx.Unlock()
+	return pc
+}
+
+// remove unregisters the request once it's no longer waiting. If a conn was
+// delivered in the meantime, it's closed.
+func (p *pendingTunnelConns) remove(pc *pendingTunnelConn) {
+	p.mtx.Lock()
+	if p.waiters[pc.id] == pc {
+		delete(p.waiters, pc.id)
+	}
+	p.mtx.Unlock()
+	select {
+	case tc := <-pc.ch:
+		p.mtx.Lock()
+		p.late++
+		p.mtx.Unlock()
+		Logger.Printf("tunnel conn %d for %s arrived after the request stopped waiting", pc.id, pc.s.Path)
+		tc.Close()
+	default:
+	}
+}
+
+// expectsSecret returns whether the conn with the ID must send a secret, which
+// is the case if the tunnel of the request waiting for it registered with one.
+func (p *pendingTunnelConns) expectsSecret(id uint32) bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	pc, ok := p.waiters[id]
+	return ok && pc.s.tunnelSecret != nil
+}
+
+// deliver passes the conn to the request waiting for it, closing it if there
+// is none or it has the wrong secret. issued is the last ID sent.
+func (p *pendingTunnelConns) deliver(id uint32, tc tunnelDataConn, issued uint32) {
+	p.mtx.Lock()
+	pc, ok := p.waiters[id]
+	if ok && time.Now().After(pc.expires) {
+		delete(p.waiters, id)
+		ok = false
+	}
+	if !ok {
+		// Compared as a difference so it still works once IDs wrap around
+		if int32(id-issued) > 0 {
+			p.unknown++
+			p.mtx.Unlock()
+			Logger.Printf("tunnel conn with unknown ID %d", id)
+		} else {
+			p.late++
+			p.mtx.Unlock()
+			Logger.Printf("tunnel conn %d arrived after the request stopped waiting", id)
+		}
+		tc.Close()
+		return
+	}
+	if subtle.ConstantTimeCompare(tc.secret, pc.s.tunnelSecret) != 1 {
+		// Keep waiting for the right one
+		p.mismatched++
+		p.mtx.Unlock()
+		Logger.Printf("tunnel conn %d for %s had the wrong secret", id, pc.s.Path)
+		tc.Close()
+		return
+	}
+	delete(p.waiters, id)
+	p.mtx.Unlock()
+	pc.ch <- tc
+}
+
+// timeout returns the time left before the request stops waiting.
+func (pc *pendingTunnelConn) timeout() time.Duration {
+	return time.Until(pc.expires)
+}
+
+// writeMetrics adds the metrics of the registry.
+func (p *pendingTunnelConns) writeMetrics(mw *metricsWriter) {
+	p.mtx.Lock()
+	pending, late, unknown, mismatched := len(p.waiters), p.late, p.unknown, p.mismatched
+	p.mtx.Unlock()
+	mw.gauge(
+		"tunnel_pending_conns",
+		"Number of requests waiting for a tunnel to dial back a conn",
+		float64(pending),
+	)
+	mw.counter(
+		"tunnel_conns_rejected_total",
+		"Number of conns dialed back by tunnels that were closed",
+		float64(late), "reason", "late",
+	)
+	mw.counter(
+		"tunnel_conns_rejected_total",
+		"Number of conns dialed back by tunnels that were closed",
+		float64(unknown), "reason", "unknown_id",
+	)
+	mw.counter(
+		"tunnel_conns_rejected_total",
+		"Number of conns dialed back by tunnels that were closed",
+		float64(mismatched), "reason", "wrong_secret",
+	)
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPendingTunnelConnsUnmatched(t *testing.T) {
+	tests := []struct {
+		name          string
+		id, issued    uint32
+		late, unknown uint64
+	}{
+		{"late", 3, 5, 1, 0},
+		{"last issued", 5, 5, 1, 0},
+		{"unknown", 9, 5, 0, 1},
+		{"late across wraparound", 0xFFFFFFFE, 2, 1, 0},
+		{"unknown across wraparound", 3, 0xFFFFFFF0, 0, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var p pendingTunnelConns
+			c1, c2 := net.Pipe()
+			defer c2.Close()
+			p.deliver(test.id, tunnelDataConn{Conn: c1}, test.issued)
+			if p.late != test.late || p.unknown != test.unknown {
+				t.Fatalf("got %d late and %d unknown", p.late, p.unknown)
+			}
+			// The conn was closed
+			c2.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := c2.Read(make([]byte, 1)); err == nil {
+				t.Fatal("unmatched conn wasn't closed")
+			}
+		})
+	}
+}
+
+func TestPendingTunnelConnsDeliver(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	tests := []struct {
+		name   string
+		secret []byte
+		sent   []byte
+		want   bool
+	}{
+		{"no secret", nil, nil, true},
+		{"right secret", secret, secret, true},
+		{"wrong secret", secret, []byte("fedcba9876543210fedcba9876543210"), false},
+		{"missing secret", secret, nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var p pendingTunnelConns
+			pc := p.add(1, &Server{Path: "t", tunnelSecret: test.secret})
+			defer p.remove(pc)
+			if got := p.expectsSecret(1); got != (test.secret != nil) {
+				t.Fatalf("expects secret: got %v", got)
+			}
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+			defer c2.Close()
+			p.deliver(1, tunnelDataConn{Conn: c1, secret: test.sent}, 1)
+			select {
+			case <-pc.ch:
+				if !test.want {
+					t.Fatal("conn delivered")
+				}
+			default:
+				if test.want {
+					t.Fatal("conn not delivered")
+				} else if p.mismatched != 1 {
+					t.Fatalf("got %d mismatched", p.mismatched)
+				}
+			}
+		})
+	}
+}
+
+func TestPendingTunnelConnsRemove(t *testing.T) {
+	var p pendingTunnelConns
+	pc := p.add(1, &Server{Path: "t"})
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	p.deliver(1, tunnelDataConn{Conn: c1}, 1)
+	// The request stopped waiting without taking the conn
+	p.remove(pc)
+	if p.late != 1 || len(p.waiters) != 0 {
+		t.Fatalf("got %d late with %d waiting", p.late, len(p.waiters))
+	}
+	c2.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c2.Read(make([]byte, 1)); err == nil {
+		t.Fatal("conn delivered after the request stopped waiting wasn't closed")
+	}
+}
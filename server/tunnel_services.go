@@ -0,0 +1,674 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Ops of tunnel control messages
+const (
+	// ctlRegister registers a service's server
+	ctlRegister = "register"
+	// ctlUpdate replaces the server of a registered service
+	ctlUpdate = "update"
+	// ctlWithdraw removes a registered service
+	ctlWithdraw = "withdraw"
+	// ctlResult answers one of the other ops
+	ctlResult = "result"
+)
+
+// Max time to wait for the result of a control message
+const tunnelControlTimeout = 30 * time.Second
+
+var (
+	ErrTunnelServicesUnsupported = fmt.Errorf("tunneled-to server doesn't support tunnel services")
+	ErrTunnelServiceExists       = fmt.Errorf("tunnel service already exists")
+	ErrTunnelServiceNotExist     = fmt.Errorf("tunnel service does not exist")
+	ErrTunnelNotConnected        = fmt.Errorf("tunnel not connected")
+)
+
+// tunnelControl is a control message sent over a multiplexed tunnel session.
+type tunnelControl struct {
+	// Seq matches a result to the message it answers
+	Seq    uint32  `json:"seq"`
+	Op     string  `json:"op"`
+	Server *Server `json:"server,omitempty"`
+	Path   string  `json:"path,omitempty"`
+	// TCP and UDP are set when registering a TCP or UDP service
+	TCP *tunnelTCP `json:"tcp,omitempty"`
+	UDP *tunnelUDP `json:"udp,omitempty"`
+	// Port is the port allocated to a TCP or UDP service, in results
+	Port int `json:"port,omitempty"`
+	// IdleTimeout is how long the flows of a UDP service are kept without
+	// datagrams, in results
+	IdleTimeout Duration `json:"idleTimeout,omitempty"`
+	// Code and Error are set on results of failed ops. Code is one of the
+	// handshake error codes.
+	Code  string `json:"code,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// TunnelService is a server a tunnel registers with the tunneled-to proxy in
+// addition to its own. Requests to it are sent to a route of the tunnel's
+// router or straight to an upstream. TCP services are exposed on a port of the
+// tunneled-to proxy (or by TLS SNI on its listeners) instead and their conns
+// are spliced with conns to a target. UDP services are also exposed on a port
+// and their datagrams are relayed to a target.
+type TunnelService struct {
+	// Protocol is "http" (default), "tcp" or "udp"
+	Protocol string `json:"protocol,omitempty"`
+	// Name and Path are what the service is registered with on the
+	// tunneled-to proxy. Path identifies the service.
+	Name string `json:"name"`
+	Path string `json:"path"`
+	// Hidden is whether the service is hidden on the tunneled-to proxy's site
+	Hidden bool `json:"hidden,omitempty"`
+	// Route is the path of the route of the tunnel's router requests are sent
+	// to
+	Route string `json:"route,omitempty"`
+	// Upstream is the URL requests are proxied to if Route isn't set
+	Upstream string `json:"upstream,omitempty"`
+	// Target is the address conns or datagrams to a TCP or UDP service are
+	// sent to
+	Target string `json:"target,omitempty"`
+	// Port is the port requested for a TCP or UDP service (any free one if
+	// 0). It's only honored if the tunneled-to proxy allocates ports from a
+	// range. Once registered, it's the port allocated to it.
+	Port int `json:"port,omitempty"`
+	// SNI routes TLS conns for the server name on the tunneled-to proxy's
+	// listeners to a TCP service rather than allocating it a port
+	SNI string `json:"sni,omitempty"`
+}
+
+func (ts *TunnelService) validate() error {
+	if ts.Name == "" || ts.Path == "" {
+		return fmt.Errorf("tunnel service must have name and path")
+	}
+	switch ts.Protocol {
+	case "", TunnelProtoHTTP:
+		if (ts.Route == "") == (ts.Upstream == "") {
+			return fmt.Errorf("tunnel service must have exactly one of route or upstream")
+		} else if ts.Target != "" || ts.Port != 0 || ts.SNI != "" {
+			return fmt.Errorf("only TCP and UDP tunnel services can have a target, port or SNI")
+		}
+	case TunnelProtoTCP:
+		if ts.Target == "" {
+			return fmt.Errorf("TCP tunnel service must have a target")
+		} else if ts.Route != "" || ts.Upstream != "" {
+			return fmt.Errorf("TCP tunnel service can't have a route or upstream")
+		} else if ts.Port < 0 || ts.Port > 65535 {
+			return fmt.Errorf("bad TCP tunnel service port: %d", ts.Port)
+		} else if ts.Port != 0 && ts.SNI != "" {
+			return fmt.Errorf("TCP tunnel service can't have both a port and SNI")
+		}
+	case TunnelProtoUDP:
+		if ts.Target == "" {
+			return fmt.Errorf("UDP tunnel service must have a target")
+		} else if ts.Route != "" || ts.Upstream != "" || ts.SNI != "" {
+			return fmt.Errorf("UDP tunnel service can't have a route, upstream or SNI")
+		} else if ts.Port < 0 || ts.Port > 65535 {
+			return fmt.Errorf("bad UDP tunnel service port: %d", ts.Port)
+		} else if len(ts.Path) > maxUDPServicePath {
+			return fmt.Errorf("UDP tunnel service path can't be longer than %d bytes", maxUDPServicePath)
+		}
+	default:
+		return fmt.Errorf("unknown tunnel service protocol: %q", ts.Protocol)
+	}
+	return nil
+}
+
+func (ts *TunnelService) isTCP() bool {
+	return ts.Protocol == TunnelProtoTCP
+}
+
+func (ts *TunnelService) isUDP() bool {
+	return ts.Protocol == TunnelProtoUDP
+}
+
+// hasPort returns whether the service is allocated a port on the tunneled-to
+// proxy.
+func (ts *TunnelService) hasPort() bool {
+	return (ts.isTCP() && ts.SNI == "") || ts.isUDP()
+}
+
+// server returns the server registered for the service.
+func (ts *TunnelService) server() *Server {
+	return &Server{Name: ts.Name, Path: ts.Path, Addr: "tunnel", Hidden: ts.Hidden}
+}
+
+// controlMsg returns the message registering or updating the service.
+func (ts *TunnelService) controlMsg(op string) tunnelControl {
+	msg := tunnelControl{Op: op, Server: ts.server()}
+	if ts.isTCP() {
+		msg.TCP = &tunnelTCP{Port: ts.Port, SNI: ts.SNI}
+	} else if ts.isUDP() {
+		msg.UDP = &tunnelUDP{Port: ts.Port}
+	}
+	return msg
+}
+
+// ParseTunnelServiceSpec parses a tunnel service from a comma-separated list
+// of key=value pairs, e.g.,
+// "name=app,path=app,upstream=http://127.0.0.1:3000",
+// "name=app,path=app,route=local" or
+// "name=db,path=db,protocol=tcp,target=127.0.0.1:5432,port=15432" or
+// "name=dns,path=dns,protocol=udp,target=127.0.0.1:53".
+func ParseTunnelServiceSpec(spec string) (TunnelService, error) {
+	ts := TunnelService{}
+	for _, kv := range strings.Split(spec, ",") {
+		k, v, _ := strings.Cut(kv, "=")
+		switch k {
+		case "name":
+			ts.Name = v
+		case "path":
+			ts.Path = v
+		case "hidden":
+			ts.Hidden = v == "" || v == "true"
+		case "route":
+			ts.Route = v
+		case "upstream":
+			ts.Upstream = v
+		case "protocol":
+			ts.Protocol = v
+		case "target":
+			ts.Target = v
+		case "port":
+			port, err := strconv.Atoi(v)
+			if err != nil {
+				return ts, fmt.Errorf("bad tunnel service port: %q", v)
+			}
+			ts.Port = port
+		case "sni":
+			ts.SNI = v
+		default:
+			return ts, fmt.Errorf("unknown tunnel service key: %q", k)
+		}
+	}
+	return ts, ts.validate()
+}
+
+// tunnelService is a service registered by the router's tunnel.
+type tunnelService struct {
+	cfg     TunnelService
+	handler http.Handler
+	// Port allocated to a TCP or UDP service
+	port int32
+	// Idle timeout of the flows of a UDP service sent by the tunneled-to
+	// server, in nanoseconds
+	udpIdle int64
+}
+
+// udpIdleTimeout returns how long the UDP service's flows are kept without
+// datagrams.
+func (svc *tunnelService) udpIdleTimeout() time.Duration {
+	if idle := atomic.LoadInt64(&svc.udpIdle); idle > 0 {
+		return time.Duration(idle)
+	}
+	return tunnelUDPIdleTimeout
+}
+
+func (router *Router) newTunnelService(ts TunnelService) (*tunnelService, error) {
+	if err := ts.validate(); err != nil {
+		return nil, err
+	}
+	svc := &tunnelService{cfg: ts, port: int32(ts.Port)}
+	if ts.isTCP() || ts.isUDP() {
+		return svc, nil
+	} else if ts.Route != "" {
+		route := ts.Route
+		svc.handler = http.HandlerFunc(func(w RW, r Req) {
+			router.serveRoute(w, r, route)
+		})
+		return svc, nil
+	}
+	handler, err := NewUpstreamHandler(ts.Upstream, "")
+	if err != nil {
+		return nil, fmt.Errorf("bad tunnel service upstream: %w", err)
+	}
+	svc.handler = handler
+	return svc, nil
+}
+
+// NewUpstreamHandler returns a handler proxying requests to the upstream URL.
+// If host is set, it's sent as the Host header instead of the request's,
+// which is passed in X-Forwarded-Host.
+func NewUpstreamHandler(upstream, host string) (http.Handler, error) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, err
+	} else if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("upstream must include proto and host")
+	}
+	p := httputil.NewSingleHostReverseProxy(u)
+	p.ErrorLog = Logger
+	if host != "" {
+		d := p.Director
+		p.Director = func(r *http.Request) {
+			d(r)
+			if r.Header.Get("X-Forwarded-Host") == "" {
+				r.Header.Set("X-Forwarded-Host", r.Host)
+			}
+			r.Host = host
+		}
+	}
+	return p, nil
+}
+
+// serveRoute serves the request with the server of the route, the request's
+// path being relative to the route.
+func (router *Router) serveRoute(w RW, r Req, route string) {
+	if server, ok := router.routes.Load(route); ok {
+		server.ServeHTTP(w, r)
+	} else if server, ok := router.draining.Load(route); ok {
+		router.serveDraining(w, server)
+	} else {
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// AddTunnelService registers the service with the tunneled-to proxy over the
+// router's tunnel. The service is registered again whenever the tunnel
+// reconnects.
+func (router *Router) AddTunnelService(ts TunnelService) error {
+	svc, err := router.newTunnelService(ts)
+	if err != nil {
+		return err
+	}
+	link := router.currentTunnel()
+	if link == nil {
+		return ErrTunnelNotConnected
+	}
+	// Store it first so that requests can be served as soon as it's
+	// registered
+	if _, loaded := router.tunnelServices.LoadOrStore(ts.Path, svc); loaded {
+		return ErrTunnelServiceExists
+	}
+	if err := svc.register(link); err != nil {
+		router.tunnelServices.Delete(ts.Path)
+		return err
+	}
+	if ts.hasPort() {
+		Logger.Printf("registered tunnel service %s on port %d", ts.Path, atomic.LoadInt32(&svc.port))
+	} else {
+		Logger.Printf("registered tunnel service %s", ts.Path)
+	}
+	return nil
+}
+
+// register registers the service over the tunnel link.
+func (svc *tunnelService) register(link *tunnelLink) error {
+	if svc.cfg.isTCP() && !hasCap(link.caps, capTCP) {
+		return ErrTunnelTCPUnsupported
+	} else if svc.cfg.isUDP() && !hasCap(link.caps, capUDP) {
+		return ErrTunnelUDPUnsupported
+	}
+	msg := svc.cfg.controlMsg(ctlRegister)
+	// Ask for the same port again when reconnecting
+	if msg.TCP != nil {
+		msg.TCP.Port = int(atomic.LoadInt32(&svc.port))
+	} else if msg.UDP != nil {
+		msg.UDP.Port = int(atomic.LoadInt32(&svc.port))
+	}
+	res, err := link.control(msg)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&svc.port, int32(res.Port))
+	atomic.StoreInt64(&svc.udpIdle, int64(res.IdleTimeout))
+	return nil
+}
+
+// UpdateTunnelService replaces the service with the same path, updating its
+// registration with the tunneled-to proxy.
+func (router *Router) UpdateTunnelService(ts TunnelService) error {
+	svc, err := router.newTunnelService(ts)
+	if err != nil {
+		return err
+	}
+	old, ok := router.tunnelServices.Load(ts.Path)
+	if !ok {
+		return ErrTunnelServiceNotExist
+	} else if old.cfg.isTCP() || ts.isTCP() || old.cfg.isUDP() || ts.isUDP() {
+		if old.cfg.Protocol != ts.Protocol || old.cfg.Name != ts.Name ||
+			(ts.Port != 0 && int32(ts.Port) != atomic.LoadInt32(&old.port)) || old.cfg.SNI != ts.SNI {
+			return fmt.Errorf("only the target of a TCP or UDP tunnel service can be updated")
+		}
+		svc.port = atomic.LoadInt32(&old.port)
+		svc.udpIdle = atomic.LoadInt64(&old.udpIdle)
+		router.tunnelServices.Store(ts.Path, svc)
+		Logger.Printf("updated tunnel service %s", ts.Path)
+		return nil
+	}
+	link := router.currentTunnel()
+	if link == nil {
+		return ErrTunnelNotConnected
+	}
+	if old.cfg.Name != ts.Name || old.cfg.Hidden != ts.Hidden {
+		if _, err := link.control(ts.controlMsg(ctlUpdate)); err != nil {
+			return err
+		}
+	}
+	router.tunnelServices.Store(ts.Path, svc)
+	Logger.Printf("updated tunnel service %s", ts.Path)
+	return nil
+}
+
+// RemoveTunnelService withdraws the service with the path from the
+// tunneled-to proxy.
+func (router *Router) RemoveTunnelService(path string) error {
+	if _, ok := router.tunnelServices.LoadAndDelete(path); !ok {
+		return ErrTunnelServiceNotExist
+	}
+	Logger.Printf("removed tunnel service %s", path)
+	link := router.currentTunnel()
+	if link == nil {
+		// It won't be registered when the tunnel reconnects
+		return nil
+	}
+	_, err := link.control(tunnelControl{Op: ctlWithdraw, Path: path})
+	return err
+}
+
+// TunnelServices returns the services registered by the router's tunnel.
+func (router *Router) TunnelServices() []TunnelService {
+	var services []TunnelService
+	router.tunnelServices.Range(func(_ string, svc *tunnelService) bool {
+		ts := svc.cfg
+		ts.Port = int(atomic.LoadInt32(&svc.port))
+		services = append(services, ts)
+		return true
+	})
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Path < services[j].Path
+	})
+	return services
+}
+
+// registerTunnelServices registers all the router's services over a new
+// tunnel connection.
+func (router *Router) registerTunnelServices(link *tunnelLink) {
+	router.tunnelServices.Range(func(path string, svc *tunnelService) bool {
+		if err := svc.register(link); err != nil {
+			Logger.Printf("error registering tunnel service %s: %v", path, err)
+		}
+		return true
+	})
+}
+
+func (router *Router) currentTunnel() *tunnelLink {
+	router.tunnelMtx.Lock()
+	defer router.tunnelMtx.Unlock()
+	return router.tunnel
+}
+
+type tunnelServiceCtxKey struct{}
+
+// serveTunnelServices serves the streams for the tunnel's services, and those
+// for its server if the tunnel has a handler.
+func (router *Router) serveTunnelServices() {
+	s := &http.Server{
+		Handler:  http.HandlerFunc(router.serveTunnelService),
+		ErrorLog: Logger,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			ctx = context.WithValue(ctx, connCtxKey{}, c)
+			if st, ok := c.(*muxStream); ok {
+				ctx = context.WithValue(ctx, tunnelServiceCtxKey{}, st.service)
+			}
+			return ctx
+		},
+	}
+	s.Serve(serviceListener{router})
+}
+
+func (router *Router) serveTunnelService(w RW, r Req) {
+	path, _ := r.Context().Value(tunnelServiceCtxKey{}).(string)
+	if path == "" && router.tunnelCfg.Handler != nil {
+		router.tunnelCfg.Handler.ServeHTTP(w, r)
+		return
+	}
+	svc, ok := router.tunnelServices.Load(path)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	svc.handler.ServeHTTP(w, r)
+}
+
+// serviceListener passes the streams for the tunnel's services to the server
+// serving them.
+type serviceListener struct {
+	router *Router
+}
+
+func (sl serviceListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-sl.router.serviceConns:
+		return c, nil
+	case <-sl.router.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (sl serviceListener) Close() error {
+	return nil
+}
+
+func (sl serviceListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+// serveControl reads the results of control messages sent by the tunnel.
+func (link *tunnelLink) serveControl() {
+	for {
+		var payload []byte
+		select {
+		case payload = <-link.mux.Control():
+		case <-link.mux.Done():
+			return
+		}
+		var msg tunnelControl
+		if err := json.Unmarshal(payload, &msg); err != nil || msg.Op != ctlResult {
+			Logger.Printf("bad tunnel control message: %s", payload)
+			continue
+		}
+		link.ctlMtx.Lock()
+		ch := link.pending[msg.Seq]
+		delete(link.pending, msg.Seq)
+		link.ctlMtx.Unlock()
+		if ch != nil {
+			ch <- msg
+		}
+	}
+}
+
+// control sends a control message and waits for its result.
+func (link *tunnelLink) control(msg tunnelControl) (tunnelControl, error) {
+	if !hasCap(link.caps, capServices) {
+		return tunnelControl{}, ErrTunnelServicesUnsupported
+	}
+	ch := make(chan tunnelControl, 1)
+	link.ctlMtx.Lock()
+	link.ctlSeq++
+	seq := link.ctlSeq
+	if link.pending == nil {
+		link.pending = make(map[uint32]chan tunnelControl)
+	}
+	link.pending[seq] = ch
+	link.ctlMtx.Unlock()
+	defer func() {
+		link.ctlMtx.Lock()
+		delete(link.pending, seq)
+		link.ctlMtx.Unlock()
+	}()
+	msg.Seq = seq
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return tunnelControl{}, err
+	} else if len(payload) > muxMaxPayload {
+		return tunnelControl{}, fmt.Errorf("tunnel control message too large")
+	} else if err := link.mux.writeFrame(frameControl, 0, payload); err != nil {
+		return tunnelControl{}, err
+	}
+	timer := time.NewTimer(tunnelControlTimeout)
+	defer timer.Stop()
+	select {
+	case res := <-ch:
+		if res.Code != "" {
+			return res, tunnelHandshakeError{Code: res.Code, Message: res.Error}.toError()
+		}
+		return res, nil
+	case <-link.mux.Done():
+		return tunnelControl{}, ErrMuxClosed
+	case <-timer.C:
+		return tunnelControl{}, fmt.Errorf("timed out waiting for tunnel control result")
+	}
+}
+
+// serveTunnelControl handles the control messages sent by the tunnel of the
+// server until its session is closed.
+func (router *Router) serveTunnelControl(s *Server) {
+	ms := s.tunnelMux
+	for {
+		var payload []byte
+		select {
+		case payload = <-ms.Control():
+		case <-ms.Done():
+			return
+		}
+		var msg tunnelControl
+		res := tunnelControl{Op: ctlResult}
+		if err := json.Unmarshal(payload, &msg); err != nil {
+			res.Code, res.Error = hsErrBadMessage, "bad control message"
+		} else {
+			res.Seq = msg.Seq
+			router.handleTunnelControl(s, msg, &res)
+		}
+		buf, _ := json.Marshal(res)
+		if err := ms.writeFrame(frameControl, 0, buf); err != nil {
+			return
+		}
+	}
+}
+
+// handleTunnelControl handles a control message sent by the tunnel of the
+// server, setting the error code and message of the result if it fails.
+func (router *Router) handleTunnelControl(s *Server, msg tunnelControl, res *tunnelControl) {
+	fail := func(code, msg string) {
+		res.Code, res.Error = code, msg
+	}
+	switch msg.Op {
+	case ctlRegister, ctlUpdate:
+		if msg.Server == nil || msg.Server.Name == "" || msg.Server.Path == "" {
+			fail(hsErrBadMessage, "bad name or path")
+			return
+		}
+		srvr := tunneledServer(msg.Server)
+		if !router.authTunnelService(s, srvr.Path) {
+			Logger.Printf("unauthorized tunnel service registration for path %s", srvr.Path)
+			fail(hsErrUnauthorized, errTunnelUnauthorized.Error())
+			return
+		}
+		if msg.TCP != nil {
+			if msg.Op == ctlUpdate {
+				fail(hsErrBadMessage, "TCP tunnel services can't be updated")
+				return
+			}
+			port, err := router.registerTCPService(s, srvr.Name, srvr.Path, *msg.TCP)
+			if err == errTunnelExists {
+				fail(hsErrAlreadyExists, err.Error())
+			} else if err == errTunnelUnauthorized {
+				fail(hsErrUnauthorized, err.Error())
+			} else if err != nil {
+				fail(hsErrBadMessage, err.Error())
+			} else {
+				res.Port = port
+				Logger.Printf("tunnel %s registered TCP service %s", s.Path, srvr.Path)
+			}
+			return
+		} else if msg.UDP != nil {
+			if msg.Op == ctlUpdate {
+				fail(hsErrBadMessage, "UDP tunnel services can't be updated")
+				return
+			}
+			svc, err := router.registerUDPService(s, srvr.Name, srvr.Path, *msg.UDP)
+			if err == errTunnelExists {
+				fail(hsErrAlreadyExists, err.Error())
+			} else if err != nil {
+				fail(hsErrBadMessage, err.Error())
+			} else {
+				// The tunnel expires its flows to the target at the same time
+				res.Port, res.IdleTimeout = svc.port, Duration(svc.idle)
+				Logger.Printf("tunnel %s registered UDP service %s", s.Path, srvr.Path)
+			}
+			return
+		}
+		var old *Server
+		cur, ok := router.routes.Load(srvr.Path)
+		if msg.Op == ctlUpdate {
+			if !ok || cur.tunnelMux != s.tunnelMux || cur == s {
+				fail(hsErrBadMessage, ErrTunnelServiceNotExist.Error())
+				return
+			}
+			old = cur
+		} else if ok {
+			// Checked before preparing the server so nothing needs undoing
+			fail(hsErrAlreadyExists, errTunnelExists.Error())
+			return
+		}
+		srvr.AddProxy(router.newTunnelProxy(srvr, nil))
+		srvr.isTunnel = true
+		srvr.tunnelMux = s.tunnelMux
+		srvr.tunnelSecret = s.tunnelSecret
+		srvr.tunnelCred = s.tunnelCred
+		srvr.tunnelService = srvr.Path
+		if err := srvr.prepare(); err != nil {
+			fail(hsErrBadMessage, err.Error())
+			return
+		}
+		if old == nil {
+			if _, loaded := router.routes.LoadOrStore(srvr.Path, srvr); loaded {
+				// Registered in the meantime
+				srvr.stop()
+				fail(hsErrAlreadyExists, errTunnelExists.Error())
+				return
+			}
+			Logger.Printf("tunnel %s registered service %s", s.Path, srvr.Path)
+		} else {
+			router.routes.Store(srvr.Path, srvr)
+			go router.drainServer(context.Background(), old)
+			Logger.Printf("tunnel %s updated service %s", s.Path, srvr.Path)
+		}
+		go router.watchTunnel(srvr)
+	case ctlWithdraw:
+		if svc, ok := router.tcpServices.Load(msg.Path); ok && svc.mux == s.tunnelMux {
+			router.removeTCPService(svc)
+			return
+		} else if svc, ok := router.udpServices.Load(msg.Path); ok && svc.mux == s.tunnelMux {
+			router.removeUDPService(svc)
+			return
+		}
+		cur, ok := router.routes.Load(msg.Path)
+		if !ok || cur.tunnelMux != s.tunnelMux || cur == s {
+			fail(hsErrBadMessage, ErrTunnelServiceNotExist.Error())
+			return
+		}
+		if !router.unroute(cur) {
+			fail(hsErrBadMessage, ErrTunnelServiceNotExist.Error())
+			return
+		}
+		Logger.Printf("tunnel %s withdrew service %s", s.Path, msg.Path)
+		go router.drainServer(context.Background(), cur)
+	default:
+		fail(hsErrBadMessage, fmt.Sprintf("unknown control op %q", msg.Op))
+	}
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTunnelControlRegister(t *testing.T) {
+	tests := []struct {
+		name string
+		op   string
+		// Path registered by another server before the op, if any
+		taken string
+		code  string
+	}{
+		{name: "register", op: ctlRegister},
+		{name: "register taken path", op: ctlRegister, taken: "svc", code: hsErrAlreadyExists},
+		{name: "update not registered", op: ctlUpdate, code: hsErrBadMessage},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			router := NewRouterHandler()
+			_, ms := muxPair(t)
+			s := &Server{Name: "t", Path: "t", isTunnel: true, tunnelMux: ms}
+			var taken *Server
+			if test.taken != "" {
+				taken = &Server{Name: test.taken, Path: test.taken, Addr: "http://127.0.0.1:1"}
+				if err := taken.AddTargetsProxy(); err != nil {
+					t.Fatal(err)
+				} else if err := router.AddServer(taken); err != nil {
+					t.Fatal(err)
+				}
+				taken, _ = router.routes.Load(test.taken)
+			}
+			// Everything but the name, path and whether it's hidden is up to
+			// the tunneled-to router
+			msg := tunnelControl{Op: test.op, Server: &Server{
+				Name:         "svc",
+				Path:         "svc",
+				Addr:         "http://127.0.0.1:1",
+				Hidden:       true,
+				Timeouts:     &Timeouts{Streaming: true},
+				DrainTimeout: Duration(time.Hour),
+				Concurrency:  &ConcurrencyLimit{},
+			}}
+			var res tunnelControl
+			router.handleTunnelControl(s, msg, &res)
+			if res.Code != test.code {
+				t.Fatalf("got code %q (%s), want %q", res.Code, res.Error, test.code)
+			}
+			got, ok := router.routes.Load("svc")
+			if test.code != "" {
+				if ok && got != taken {
+					t.Fatal("route changed by failed op")
+				}
+				return
+			} else if !ok {
+				t.Fatal("service not registered")
+			}
+			if got.Addr != "tunnel" || !got.Hidden || got.tunnelService != "svc" ||
+				got.Timeouts != nil || got.DrainTimeout != 0 || got.Concurrency != nil {
+				t.Fatalf("registered %+v", got)
+			}
+		})
+	}
+}
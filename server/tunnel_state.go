@@ -0,0 +1,251 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// TunnelState is the state of a router's tunnel connection.
+type TunnelState int
+
+const (
+	// TunnelConnecting is connecting to the tunneled-to proxy
+	TunnelConnecting TunnelState = iota
+	// TunnelConnected is registered with the tunneled-to proxy
+	TunnelConnected
+	// TunnelBackoff is waiting to try connecting again
+	TunnelBackoff
+	// TunnelFailed has given up on connecting
+	TunnelFailed
+)
+
+func (ts TunnelState) String() string {
+	switch ts {
+	case TunnelConnecting:
+		return "connecting"
+	case TunnelConnected:
+		return "connected"
+	case TunnelBackoff:
+		return "backoff"
+	case TunnelFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+func (ts TunnelState) MarshalText() ([]byte, error) {
+	return []byte(ts.String()), nil
+}
+
+// TunnelStatus is a snapshot of the state of a router's tunnel.
+type TunnelStatus struct {
+	State TunnelState `json:"state"`
+	// Since is when the tunnel entered the state
+	Since time.Time `json:"since"`
+	// Attempts is the number of failed attempts to connect since the tunnel
+	// was last connected
+	Attempts int `json:"attempts,omitempty"`
+	// LastError is the error of the last failed attempt, if any
+	LastError string `json:"lastError,omitempty"`
+	// NextAttempt is when the next attempt is made, while backing off
+	NextAttempt *time.Time `json:"nextAttempt,omitempty"`
+	// Version and Capabilities negotiated with the tunneled-to proxy, while
+	// connected
+	Version      int      `json:"version,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	// Reconnects and Failures are the total number of times the tunnel has
+	// reconnected and failed to connect
+	Reconnects uint64 `json:"reconnects"`
+	Failures   uint64 `json:"failures"`
+}
+
+// TunnelReconnect configures how a tunnel reconnects once disconnected. The
+// first attempt is made right away and the delay between later attempts
+// doubles each time.
+type TunnelReconnect struct {
+	// MinDelay is the delay after the first failed attempt. Defaults to 1s.
+	MinDelay Duration `json:"minDelay,omitempty"`
+	// MaxDelay caps the delay. Defaults to 1m.
+	MaxDelay Duration `json:"maxDelay,omitempty"`
+	// Jitter is the fraction of each delay that's randomized so that tunnels
+	// don't all reconnect at once. Defaults to 0.2.
+	Jitter float64 `json:"jitter,omitempty"`
+	// MaxAttempts is the number of failed attempts in a row before giving up.
+	// No limit if 0.
+	MaxAttempts int `json:"maxAttempts,omitempty"`
+}
+
+func (tr *TunnelReconnect) validate() error {
+	if tr.MinDelay < 0 || tr.MaxDelay < 0 || tr.MaxAttempts < 0 {
+		return fmt.Errorf("tunnel reconnect values can't be negative")
+	} else if tr.Jitter < 0 || tr.Jitter > 1 {
+		return fmt.Errorf("tunnel reconnect jitter must be between 0 and 1")
+	} else if tr.MaxDelay != 0 && tr.MaxDelay < tr.MinDelay {
+		return fmt.Errorf("tunnel reconnect max delay can't be less than min delay")
+	}
+	return nil
+}
+
+func (tr *TunnelReconnect) minDelay() time.Duration {
+	return tr.MinDelay.Or(time.Second)
+}
+
+func (tr *TunnelReconnect) maxDelay() time.Duration {
+	return tr.MaxDelay.Or(time.Minute)
+}
+
+func (tr *TunnelReconnect) jitter() float64 {
+	if tr.Jitter == 0 {
+		return 0.2
+	}
+	return tr.Jitter
+}
+
+// delay returns how long to wait after the given number of failed attempts.
+func (tr *TunnelReconnect) delay(attempts int) time.Duration {
+	d, max := tr.minDelay(), tr.maxDelay()
+	for i := 1; i < attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d - time.Duration(rand.Float64()*tr.jitter()*float64(d))
+}
+
+// TunnelStatus returns the status of the router's tunnel, if it has one.
+func (router *Router) TunnelStatus() (TunnelStatus, bool) {
+	router.tunnelMtx.Lock()
+	defer router.tunnelMtx.Unlock()
+	if router.tunnelServer == nil {
+		return TunnelStatus{}, false
+	}
+	status := router.tunnelStatus
+	status.Capabilities = append([]string(nil), status.Capabilities...)
+	return status, true
+}
+
+// setTunnelState updates the tunnel's status, passing it to the config's
+// OnStateChange. err is the error of the last attempt, if any.
+func (router *Router) setTunnelState(state TunnelState, link *tunnelLink, err error) {
+	router.tunnelMtx.Lock()
+	status := &router.tunnelStatus
+	// Only the first connect happens before any state was set
+	reconnect := !status.Since.IsZero()
+	if state != status.State {
+		status.Since = time.Now()
+	}
+	status.State = state
+	status.NextAttempt = nil
+	status.Version, status.Capabilities = 0, nil
+	switch state {
+	case TunnelConnected:
+		if reconnect {
+			status.Reconnects++
+		}
+		status.Attempts, status.LastError = 0, ""
+		status.Version, status.Capabilities = link.version, link.caps
+		router.tunnel = link
+	case TunnelBackoff, TunnelFailed:
+		status.Attempts++
+		status.Failures++
+		status.LastError = err.Error()
+		if state == TunnelBackoff {
+			next := time.Now().Add(router.tunnelCfg.Reconnect.delay(status.Attempts))
+			status.NextAttempt = &next
+		}
+	}
+	snapshot := *status
+	router.tunnelMtx.Unlock()
+	if router.tunnelCfg.OnStateChange != nil {
+		router.tunnelCfg.OnStateChange(snapshot)
+	}
+}
+
+// dropTunnel clears the router's tunnel once the link is disconnected, unless
+// it was already replaced.
+func (router *Router) dropTunnel(link *tunnelLink) {
+	router.tunnelMtx.Lock()
+	defer router.tunnelMtx.Unlock()
+	if router.tunnel == link {
+		router.tunnel = nil
+	}
+}
+
+// reconnectTunnel connects the tunnel again after it was disconnected,
+// backing off between attempts. Returns false if it gave up or the router was
+// closed.
+func (router *Router) reconnectTunnel(old *tunnelLink) bool {
+	rc := &router.tunnelCfg.Reconnect
+	for {
+		select {
+		case <-router.closed:
+			return false
+		default:
+		}
+		router.setTunnelState(TunnelConnecting, nil, nil)
+		link, err := dialTunnel(router.tunnelCfg, router.tunnelServer, old.takeover)
+		if err == nil {
+			router.setTunnelState(TunnelConnected, link, nil)
+			Logger.Printf("tunnel reconnected to %s", router.tunnelCfg.Addr)
+			go router.registerTunnelServices(link)
+			return true
+		}
+		status, _ := router.TunnelStatus()
+		if isPermanentTunnelError(err) ||
+			(rc.MaxAttempts != 0 && status.Attempts+1 >= rc.MaxAttempts) {
+			router.setTunnelState(TunnelFailed, nil, err)
+			Logger.Printf("giving up reconnecting tunnel: %v", err)
+			return false
+		}
+		router.setTunnelState(TunnelBackoff, nil, err)
+		status, _ = router.TunnelStatus()
+		Logger.Printf(
+			"error reconnecting tunnel (attempt %d): %v; retrying at %s",
+			status.Attempts, err, status.NextAttempt.Format(time.RFC3339),
+		)
+		timer := time.NewTimer(time.Until(*status.NextAttempt))
+		select {
+		case <-timer.C:
+		case <-router.closed:
+			timer.Stop()
+			return false
+		}
+	}
+}
+
+// isPermanentTunnelError returns whether trying to connect again won't help.
+// A path that's already registered isn't since a stale registration is
+// removed once the tunneled-to proxy notices its conn is gone.
+func isPermanentTunnelError(err error) bool {
+	te, ok := err.(*TunnelError)
+	return ok && (te.header == HeaderUnauthorized || te.header == HeaderBadMessage)
+}
+
+// writeTunnelMetrics adds the metrics of the router's tunnel, if it has one.
+func (router *Router) writeTunnelMetrics(mw *metricsWriter) {
+	status, ok := router.TunnelStatus()
+	if !ok {
+		return
+	}
+	path := router.tunnelServer.Path
+	for _, state := range []TunnelState{TunnelConnecting, TunnelConnected, TunnelBackoff, TunnelFailed} {
+		mw.gauge(
+			"tunnel_state",
+			"State of the router's tunnel",
+			boolMetric(status.State == state), "tunnel", path, "state", state.String(),
+		)
+	}
+	mw.counter(
+		"tunnel_reconnects_total",
+		"Number of times the router's tunnel has reconnected",
+		float64(status.Reconnects), "tunnel", path,
+	)
+	mw.counter(
+		"tunnel_connect_failures_total",
+		"Number of failed attempts to connect the router's tunnel",
+		float64(status.Failures), "tunnel", path,
+	)
+}
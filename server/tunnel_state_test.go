@@ -0,0 +1,197 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestTunnelReconnectValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		tr   TunnelReconnect
+		err  bool
+	}{
+		{"defaults", TunnelReconnect{}, false},
+		{"jitter of 1", TunnelReconnect{Jitter: 1}, false},
+		{"negative delay", TunnelReconnect{MinDelay: Duration(-time.Second)}, true},
+		{"negative attempts", TunnelReconnect{MaxAttempts: -1}, true},
+		{"jitter over 1", TunnelReconnect{Jitter: 1.5}, true},
+		{"max under min", TunnelReconnect{MinDelay: Duration(time.Minute), MaxDelay: 1}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.tr.validate(); (err != nil) != test.err {
+				t.Fatalf("got error %v", err)
+			}
+		})
+	}
+}
+
+func TestTunnelReconnectDelay(t *testing.T) {
+	custom := TunnelReconnect{
+		MinDelay: Duration(time.Millisecond),
+		MaxDelay: Duration(5 * time.Millisecond),
+	}
+	tests := []struct {
+		name     string
+		tr       TunnelReconnect
+		attempts int
+		// The delay before jitter
+		want time.Duration
+	}{
+		{"first", TunnelReconnect{}, 1, time.Second},
+		{"doubles", TunnelReconnect{}, 3, 4 * time.Second},
+		{"capped", TunnelReconnect{}, 20, time.Minute},
+		{"custom", custom, 3, 4 * time.Millisecond},
+		{"custom capped", custom, 4, 5 * time.Millisecond},
+		{"full jitter", TunnelReconnect{Jitter: 1}, 2, 2 * time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			min := test.want - time.Duration(test.tr.jitter()*float64(test.want))
+			for i := 0; i < 20; i++ {
+				if got := test.tr.delay(test.attempts); got < min || got > test.want {
+					t.Fatalf("got %s, want between %s and %s", got, min, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestTunnelStatus(t *testing.T) {
+	type step struct {
+		state TunnelState
+		err   error
+	}
+	errDial := errors.New("dial error")
+	tests := []struct {
+		name  string
+		steps []step
+		want  TunnelStatus
+	}{
+		{
+			name:  "connected",
+			steps: []step{{TunnelConnecting, nil}, {TunnelConnected, nil}},
+			want:  TunnelStatus{State: TunnelConnected},
+		},
+		{
+			name: "backing off",
+			steps: []step{
+				{TunnelConnecting, nil}, {TunnelBackoff, errDial},
+				{TunnelConnecting, nil}, {TunnelBackoff, errDial},
+			},
+			want: TunnelStatus{State: TunnelBackoff, Attempts: 2, Failures: 2, LastError: errDial.Error()},
+		},
+		{
+			name: "reconnected",
+			steps: []step{
+				{TunnelConnected, nil}, {TunnelConnecting, nil},
+				{TunnelBackoff, errDial}, {TunnelConnecting, nil}, {TunnelConnected, nil},
+			},
+			want: TunnelStatus{State: TunnelConnected, Reconnects: 1, Failures: 1},
+		},
+		{
+			name:  "failed",
+			steps: []step{{TunnelConnecting, nil}, {TunnelFailed, errDial}},
+			want:  TunnelStatus{State: TunnelFailed, Attempts: 1, Failures: 1, LastError: errDial.Error()},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			router := NewRouterHandler()
+			router.tunnelServer = &Server{Path: "t"}
+			var changes []TunnelStatus
+			router.tunnelCfg.OnStateChange = func(status TunnelStatus) {
+				changes = append(changes, status)
+			}
+			for _, st := range test.steps {
+				router.setTunnelState(st.state, &tunnelLink{}, st.err)
+			}
+			status, _ := router.TunnelStatus()
+			if len(changes) != len(test.steps) {
+				t.Fatalf("got %d state changes, want %d", len(changes), len(test.steps))
+			} else if (status.State == TunnelBackoff) != (status.NextAttempt != nil) {
+				t.Fatalf("got next attempt %v in state %s", status.NextAttempt, status.State)
+			}
+			status.Since, status.NextAttempt = time.Time{}, nil
+			if status.State != test.want.State || status.Attempts != test.want.Attempts ||
+				status.Failures != test.want.Failures || status.Reconnects != test.want.Reconnects ||
+				status.LastError != test.want.LastError {
+				t.Fatalf("got %+v, want %+v", status, test.want)
+			}
+		})
+	}
+}
+
+func TestTunnelTakeover(t *testing.T) {
+	tests := []struct {
+		name string
+		// Whether the second session sends the first's token, a wrong one or
+		// none
+		token  string
+		header uint32
+	}{
+		{"right token", "right", 0},
+		{"wrong token", "wrong", HeaderAlreadyExists},
+		{"no token", "", HeaderAlreadyExists},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			router, err := NewRouterWithListeners()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer router.Close()
+			hello := func(takeover []byte) (*tunnelLink, net.Conn, error) {
+				c1, c2 := net.Pipe()
+				go router.handleHello(NewBufConn(c2))
+				link, err := clientHello(c1, TunnelConfig{}, &Server{Name: "t", Path: "t"}, takeover)
+				return link, c1, err
+			}
+			first, c1, err := hello(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c1.Close()
+			prev, _ := router.routes.Load("t")
+			var token []byte
+			switch test.token {
+			case "right":
+				token = first.takeover
+			case "wrong":
+				token = make([]byte, len(first.takeover))
+			}
+			_, c2, err := hello(token)
+			if c2 != nil {
+				defer c2.Close()
+			}
+			if test.header != 0 {
+				var te *TunnelError
+				if !errors.As(err, &te) || te.header != test.header {
+					t.Fatalf("got %v, want tunnel error with header %x", err, test.header)
+				} else if cur, _ := router.routes.Load("t"); cur != prev {
+					t.Fatal("registration replaced")
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if cur, _ := router.routes.Load("t"); cur == prev {
+				t.Fatal("registration not replaced")
+			}
+			// The previous session's conn is closed
+			c1.SetReadDeadline(time.Now().Add(time.Second))
+			for {
+				if _, err := c1.Read(make([]byte, 64)); err != nil {
+					if errors.Is(err, os.ErrDeadlineExceeded) {
+						t.Fatal("previous session wasn't closed")
+					}
+					break
+				}
+			}
+		})
+	}
+}
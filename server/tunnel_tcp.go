@@ -0,0 +1,395 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Protocols of tunnel services
+const (
+	TunnelProtoHTTP = "http"
+	TunnelProtoTCP  = "tcp"
+	TunnelProtoUDP  = "udp"
+)
+
+var (
+	ErrTunnelTCPUnsupported = fmt.Errorf("tunneled-to server doesn't support TCP tunnel services")
+	errTunnelTCPDisabled    = fmt.Errorf("TCP tunnel services aren't allowed")
+	errTunnelPortTaken      = fmt.Errorf("no free port for tunnel service")
+	errTunnelSNIExists      = fmt.Errorf("server name already routed to another TCP tunnel service")
+	errTunnelSNIServed      = fmt.Errorf("server name is served by the router's listeners")
+	errSNIPeeked            = fmt.Errorf("peeked SNI")
+)
+
+// Type of the TLS record a ClientHello is sent in
+const recordTypeHandshake = 0x16
+
+// TunnelTCP configures the raw TCP services tunnels can expose through a
+// router. Each gets its own port unless it's routed by TLS SNI on the
+// router's listeners.
+type TunnelTCP struct {
+	// Host is the host ports are opened on. Defaults to all interfaces.
+	Host string `json:"host,omitempty"`
+	// MinPort and MaxPort are the range ports are allocated from. Tunnels can
+	// only request a port in the range. If not set, a random port is
+	// allocated and the port requested is ignored.
+	MinPort int `json:"minPort,omitempty"`
+	MaxPort int `json:"maxPort,omitempty"`
+}
+
+func (tt *TunnelTCP) validate() error {
+	return validatePortRange("TCP", tt.MinPort, tt.MaxPort)
+}
+
+func validatePortRange(proto string, min, max int) error {
+	if min < 0 || max > 65535 || min > max {
+		return fmt.Errorf("bad %s tunnel port range: %d-%d", proto, min, max)
+	} else if (min == 0) != (max == 0) {
+		return fmt.Errorf("%s tunnel port range must have min and max", proto)
+	}
+	return nil
+}
+
+// ParsePortRange parses a port range in the form "min-max".
+func ParsePortRange(s string) (min, max int, err error) {
+	lo, hi, ok := strings.Cut(s, "-")
+	if !ok {
+		hi = lo
+	}
+	if min, err = strconv.Atoi(lo); err != nil {
+		return 0, 0, fmt.Errorf("bad port range %q", s)
+	} else if max, err = strconv.Atoi(hi); err != nil {
+		return 0, 0, fmt.Errorf("bad port range %q", s)
+	}
+	return min, max, nil
+}
+
+// SetTunnelTCP allows tunnels to expose TCP services with the config. If nil,
+// TCP services can't be registered. Services already registered aren't
+// affected.
+func (router *Router) SetTunnelTCP(tt *TunnelTCP) error {
+	if tt != nil {
+		if err := tt.validate(); err != nil {
+			return err
+		}
+	}
+	router.tunnelTCP.Store(tt)
+	return nil
+}
+
+// tunnelTCP is sent with the register message of a TCP service.
+type tunnelTCP struct {
+	// Port requested, any free one if 0
+	Port int    `json:"port,omitempty"`
+	SNI  string `json:"sni,omitempty"`
+}
+
+// TCPServiceStatus is a snapshot of a TCP service registered by a tunnel.
+type TCPServiceStatus struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	// Port is the port allocated to the service, if it isn't routed by SNI
+	Port int    `json:"port,omitempty"`
+	SNI  string `json:"sni,omitempty"`
+	// Tunnel is the path of the server of the tunnel that registered it
+	Tunnel      string `json:"tunnel"`
+	ActiveConns int64  `json:"activeConns"`
+}
+
+// tcpService is a TCP service registered by a tunnel.
+type tcpService struct {
+	name, path, sni, tunnel string
+	port                    int
+	active                  int64
+
+	ln        net.Listener
+	mux       *muxSession
+	closeOnce sync.Once
+}
+
+// registerTCPService registers a TCP service for the tunnel of the server,
+// returning the port allocated to it.
+func (router *Router) registerTCPService(s *Server, name, path string, req tunnelTCP) (int, error) {
+	tt := router.tunnelTCP.Load()
+	if tt == nil {
+		return 0, errTunnelTCPDisabled
+	}
+	svc := &tcpService{
+		name:   name,
+		path:   path,
+		sni:    req.SNI,
+		tunnel: s.Path,
+		mux:    s.tunnelMux,
+	}
+	if _, loaded := router.tcpServices.LoadOrStore(path, svc); loaded {
+		return 0, errTunnelExists
+	}
+	if svc.sni != "" {
+		// SNI services are checked before the listeners' own TLS, so they
+		// must not take over names the listeners serve
+		if !router.authTunnelServerName(s, svc.sni) {
+			router.tcpServices.Delete(path)
+			Logger.Printf("unauthorized tunnel server name %s for path %s", svc.sni, path)
+			return 0, errTunnelUnauthorized
+		} else if router.servesServerName(svc.sni) {
+			router.tcpServices.Delete(path)
+			return 0, errTunnelSNIServed
+		}
+		if _, loaded := router.sniServices.LoadOrStore(svc.sni, svc); loaded {
+			router.tcpServices.Delete(path)
+			return 0, errTunnelSNIExists
+		}
+		atomic.AddInt32(&router.numSNIServices, 1)
+	} else {
+		ln, err := tt.listen(req.Port)
+		if err != nil {
+			router.tcpServices.Delete(path)
+			return 0, err
+		}
+		svc.ln = ln
+		svc.port = ln.Addr().(*net.TCPAddr).Port
+		go router.acceptTCPService(svc)
+	}
+	go func() {
+		<-svc.mux.Done()
+		router.removeTCPService(svc)
+	}()
+	return svc.port, nil
+}
+
+// servesServerName returns whether one of the router's TLS listeners has a
+// cert for the server name.
+func (router *Router) servesServerName(name string) bool {
+	served := false
+	router.listeners.Range(func(_ string, l *Listener) bool {
+		served = l.servesServerName(name)
+		return !served
+	})
+	return served
+}
+
+func (l *Listener) servesServerName(name string) bool {
+	if l.tlsConfig == nil {
+		return false
+	}
+	certs := l.tlsConfig.Certificates
+	if gc := l.tlsConfig.GetCertificate; gc != nil {
+		if cert, err := gc(&tls.ClientHelloInfo{ServerName: name}); err == nil && cert != nil {
+			certs = append(certs[:len(certs):len(certs)], *cert)
+		}
+	}
+	for _, cert := range certs {
+		leaf := cert.Leaf
+		if leaf == nil && len(cert.Certificate) != 0 {
+			leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+		}
+		if leaf != nil && leaf.VerifyHostname(name) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// listen opens the port for a service. The first free one in the range is
+// used if port is 0.
+func (tt *TunnelTCP) listen(port int) (net.Listener, error) {
+	return listenPort(tt.Host, tt.MinPort, tt.MaxPort, port, func(addr string) (net.Listener, error) {
+		return net.Listen("tcp", addr)
+	})
+}
+
+// listenPort opens the port on the host with listen. If port is 0, the first
+// free one in the range is used. If there's no range, any free one is used and
+// port is ignored so that tunnels can't pick arbitrary ports.
+func listenPort[T any](host string, min, max, port int, listen func(string) (T, error)) (T, error) {
+	var zero T
+	if min == 0 {
+		return listen(net.JoinHostPort(host, "0"))
+	} else if port != 0 {
+		if port < min || port > max {
+			return zero, fmt.Errorf("port %d not in range %d-%d", port, min, max)
+		}
+		return listen(net.JoinHostPort(host, strconv.Itoa(port)))
+	}
+	for p := min; p <= max; p++ {
+		if l, err := listen(net.JoinHostPort(host, strconv.Itoa(p))); err == nil {
+			return l, nil
+		}
+	}
+	return zero, errTunnelPortTaken
+}
+
+// removeTCPService closes the service's port and removes it.
+func (router *Router) removeTCPService(svc *tcpService) {
+	svc.closeOnce.Do(func() {
+		if cur, ok := router.tcpServices.Load(svc.path); ok && cur == svc {
+			router.tcpServices.Delete(svc.path)
+		}
+		if svc.ln != nil {
+			svc.ln.Close()
+		} else if cur, ok := router.sniServices.Load(svc.sni); ok && cur == svc {
+			router.sniServices.Delete(svc.sni)
+			atomic.AddInt32(&router.numSNIServices, -1)
+		}
+		Logger.Printf("removed TCP tunnel service %s", svc.path)
+	})
+}
+
+// removeTunnelTCPServices removes the TCP services registered over the
+// session.
+func (router *Router) removeTunnelTCPServices(ms *muxSession) {
+	router.tcpServices.Range(func(_ string, svc *tcpService) bool {
+		if svc.mux == ms {
+			router.removeTCPService(svc)
+		}
+		return true
+	})
+}
+
+func (router *Router) acceptTCPService(svc *tcpService) {
+	for {
+		c, err := svc.ln.Accept()
+		if err != nil {
+			return
+		}
+		go router.serveTCPService(svc, c)
+	}
+}
+
+// serveTCPService splices the conn with a stream to the service's tunnel.
+func (router *Router) serveTCPService(svc *tcpService, c net.Conn) {
+	st, err := svc.mux.OpenService(svc.path)
+	if err != nil {
+		Logger.Printf("error opening stream for TCP tunnel service %s: %v", svc.path, err)
+		c.Close()
+		return
+	}
+	atomic.AddInt64(&svc.active, 1)
+	defer atomic.AddInt64(&svc.active, -1)
+	splice(c, st)
+}
+
+// TCPServices returns the TCP services registered by tunnels.
+func (router *Router) TCPServices() []TCPServiceStatus {
+	var services []TCPServiceStatus
+	router.tcpServices.Range(func(_ string, svc *tcpService) bool {
+		services = append(services, TCPServiceStatus{
+			Name:        svc.name,
+			Path:        svc.path,
+			Port:        svc.port,
+			SNI:         svc.sni,
+			Tunnel:      svc.tunnel,
+			ActiveConns: atomic.LoadInt64(&svc.active),
+		})
+		return true
+	})
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Path < services[j].Path
+	})
+	return services
+}
+
+// handleSNI checks if the conn starts with a TLS ClientHello for the server
+// name of a TCP service, splicing it with the service if so. Otherwise, a conn
+// replaying what was read is returned.
+func (router *Router) handleSNI(bc BufConn) (net.Conn, bool) {
+	var buf bytes.Buffer
+	var sni string
+	tls.Server(readOnlyConn{bc, io.TeeReader(bc, &buf)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			sni = hello.ServerName
+			return nil, errSNIPeeked
+		},
+	}).Handshake()
+	c := &replayConn{Conn: bc, r: io.MultiReader(&buf, bc)}
+	svc, ok := router.sniServices.Load(sni)
+	if sni == "" || !ok {
+		return c, false
+	}
+	c.SetReadDeadline(time.Time{})
+	go router.serveTCPService(svc, c)
+	return nil, true
+}
+
+// readOnlyConn reads from r and drops writes.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c readOnlyConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+// replayConn is a conn that reads from r rather than the conn.
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// splice copies between the conns until both sides are done, closing them
+// afterwards.
+func splice(a, b net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		io.Copy(a, b)
+		closeWrite(a)
+		close(done)
+	}()
+	io.Copy(b, a)
+	closeWrite(b)
+	<-done
+	a.Close()
+	b.Close()
+}
+
+// closeWrite closes the writing side of the conn, or the whole conn if that
+// isn't supported.
+func closeWrite(c net.Conn) {
+	for {
+		switch conn := c.(type) {
+		case interface{ CloseWrite() error }:
+			conn.CloseWrite()
+			return
+		case BufConn:
+			c = conn.Conn
+		case listenerConn:
+			c = conn.Conn
+		case *replayConn:
+			c = conn.Conn
+		default:
+			c.Close()
+			return
+		}
+	}
+}
+
+// serveTunnelTCP splices a stream for a TCP service with a conn to the
+// service's target.
+func serveTunnelTCP(st net.Conn, target string) {
+	c, err := net.DialTimeout("tcp", target, 10*time.Second)
+	if err != nil {
+		Logger.Printf("error dialing TCP tunnel service target %s: %v", target, err)
+		st.Close()
+		return
+	}
+	splice(st, c)
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		in       string
+		min, max int
+		err      bool
+	}{
+		{"8000-8100", 8000, 8100, false},
+		{"8000", 8000, 8000, false},
+		{"0-0", 0, 0, false},
+		{"8000-", 0, 0, true},
+		{"-8000", 0, 0, true},
+		{"a-b", 0, 0, true},
+		{"", 0, 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.in, func(t *testing.T) {
+			min, max, err := ParsePortRange(test.in)
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v", err)
+			} else if min != test.min || max != test.max {
+				t.Fatalf("got %d-%d, want %d-%d", min, max, test.min, test.max)
+			}
+		})
+	}
+}
+
+func TestValidatePortRange(t *testing.T) {
+	tests := []struct {
+		min, max int
+		err      bool
+	}{
+		{0, 0, false},
+		{8000, 8100, false},
+		{8000, 8000, false},
+		{1, 65535, false},
+		{8100, 8000, true},
+		{-1, 8000, true},
+		{8000, 65536, true},
+		{0, 8000, true},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%d-%d", test.min, test.max), func(t *testing.T) {
+			if err := validatePortRange("TCP", test.min, test.max); (err != nil) != test.err {
+				t.Fatalf("got error %v", err)
+			}
+		})
+	}
+}
+
+func TestListenPort(t *testing.T) {
+	tests := []struct {
+		name     string
+		min, max int
+		port     int
+		// Ports that are taken
+		taken []int
+		want  int
+		err   bool
+	}{
+		{name: "no range", port: 0, want: 0},
+		{name: "no range ignores requested port", port: 22, want: 0},
+		{name: "first free in range", min: 100, max: 102, taken: []int{100}, want: 101},
+		{name: "requested in range", min: 100, max: 102, port: 102, want: 102},
+		{name: "requested out of range", min: 100, max: 102, port: 22, err: true},
+		{name: "requested taken", min: 100, max: 102, port: 101, taken: []int{101}, err: true},
+		{name: "range full", min: 100, max: 101, taken: []int{100, 101}, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			port, err := listenPort("", test.min, test.max, test.port, func(addr string) (int, error) {
+				_, p, _ := net.SplitHostPort(addr)
+				port, _ := strconv.Atoi(p)
+				for _, taken := range test.taken {
+					if port == taken {
+						return 0, fmt.Errorf("port %d taken", port)
+					}
+				}
+				return port, nil
+			})
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v", err)
+			} else if err == nil && port != test.want {
+				t.Fatalf("listened on %d, want %d", port, test.want)
+			}
+		})
+	}
+}
+
+func TestHandleSNIReplays(t *testing.T) {
+	tests := []struct {
+		name string
+		// Writes to the conn, returning the first byte written
+		write func(c net.Conn) byte
+	}{
+		{"plain", func(c net.Conn) byte {
+			c.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+			return 'G'
+		}},
+		{"unknown server name", func(c net.Conn) byte {
+			go tls.Client(c, &tls.Config{ServerName: "unknown.example.com"}).Handshake()
+			return recordTypeHandshake
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			router := NewRouterHandler()
+			router.sniServices.Store("known.example.com", &tcpService{})
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+			defer c2.Close()
+			want := make(chan byte, 1)
+			go func() { want <- test.write(c1) }()
+			c, ok := router.handleSNI(NewBufConn(c2))
+			if ok {
+				t.Fatal("conn handled as TCP service")
+			}
+			// What was peeked is read again
+			buf := make([]byte, 1)
+			if _, err := io.ReadFull(c, buf); err != nil {
+				t.Fatal(err)
+			} else if w := <-want; buf[0] != w {
+				t.Fatalf("got first byte %x, want %x", buf[0], w)
+			}
+		})
+	}
+}
+
+func TestAllowsServerName(t *testing.T) {
+	cred := TunnelCredential{ServerNames: []string{"app.example.com", "*.Apps.Example.com"}}
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"app.example.com", true},
+		{"APP.example.com", true},
+		{"a.apps.example.com", true},
+		{"apps.example.com", false},
+		{"a.b.apps.example.com", false},
+		{"other.example.com", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := cred.allowsServerName(test.name); got != test.want {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// selfSignedCert returns a cert for the DNS names.
+func selfSignedCert(t *testing.T, names ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestListenerServesServerName(t *testing.T) {
+	byName := selfSignedCert(t, "dynamic.example.com")
+	l := &Listener{tlsConfig: &tls.Config{
+		Certificates: []tls.Certificate{selfSignedCert(t, "example.com", "*.wild.example.com")},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName == "dynamic.example.com" {
+				return &byName, nil
+			}
+			return nil, nil
+		},
+	}}
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"example.com", true},
+		{"a.wild.example.com", true},
+		{"dynamic.example.com", true},
+		{"other.example.com", false},
+		{"wild.example.com", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := l.servesServerName(test.name); got != test.want {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+	if (&Listener{}).servesServerName("example.com") {
+		t.Fatal("listener without TLS serves a server name")
+	}
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// TunnelALPN is the ALPN protocol tunnels negotiate so they can share a TLS
+// listener with HTTP.
+const TunnelALPN = "gory-tunnel"
+
+// NewTunnelTLSConfig creates the TLS config a tunnel connects with. The
+// proxy's cert is verified with the CA in caFile (the system roots are used
+// if empty). The cert and key files are optional and are sent as the
+// client's cert. If serverName is empty, the host of the tunnel's address is
+// used.
+func NewTunnelTLSConfig(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: serverName}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certs found in %s", caFile)
+		}
+	}
+	if (certFile == "") != (keyFile == "") {
+		return nil, fmt.Errorf("must have both cert and key file")
+	} else if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// loadClientCAs loads the CAs used to verify client certs.
+func loadClientCAs(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certs found in %s", path)
+	}
+	return pool, nil
+}
+
+// dial connects to the tunneled-to proxy, through the HTTP proxy and using
+// TLS if configured. If the tunnel's transport is over HTTP, the conn is
+// upgraded before being returned.
+func (tc *TunnelConfig) dial() (net.Conn, error) {
+	c, err := tc.dialAddr()
+	if err != nil {
+		return nil, err
+	}
+	// Don't hang on a peer that never finishes the TLS handshake or upgrade
+	c.SetDeadline(time.Now().Add(tunnelHandshakeTimeout))
+	if tc.TLS != nil {
+		cfg := tc.TLS.Clone()
+		if cfg.ServerName == "" {
+			cfg.ServerName, _, _ = net.SplitHostPort(tc.Addr)
+		}
+		if tc.overHTTP() {
+			// The upgrade is a normal HTTP request
+			cfg.NextProtos = []string{"http/1.1"}
+		} else {
+			cfg.NextProtos = []string{TunnelALPN}
+		}
+		tlsConn := tls.Client(c, cfg)
+		if err := tlsConn.Handshake(); err != nil {
+			c.Close()
+			return nil, err
+		}
+		if !tc.overHTTP() && tlsConn.ConnectionState().NegotiatedProtocol != TunnelALPN {
+			tlsConn.Close()
+			return nil, fmt.Errorf("tunneled-to server doesn't support tunnels over TLS")
+		}
+		c = plainConn{tlsConn}
+	}
+	if tc.overHTTP() {
+		uc, err := tc.upgrade(c)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c = uc
+	}
+	c.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// plainConn hides that a conn uses TLS. Otherwise, the http package would
+// treat a dialed-back conn as one it accepted over TLS and close it since it
+// doesn't know the tunnel's ALPN protocol.
+type plainConn struct {
+	net.Conn
+}
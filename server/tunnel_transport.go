@@ -0,0 +1,263 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// Transports tunnels connect over
+const (
+	// TunnelTransportTCP sends the tunnel protocol straight over the conn
+	TunnelTransportTCP = "tcp"
+	// TunnelTransportUpgrade upgrades an HTTP/1.1 request to the router's
+	// TunnelUpgradePath to the tunnel protocol first
+	TunnelTransportUpgrade = "upgrade"
+	// TunnelTransportWebSocket sends the tunnel protocol in the binary
+	// messages of a WebSocket to the router's TunnelUpgradePath
+	TunnelTransportWebSocket = "websocket"
+)
+
+// TunnelUpgradePath is the path on a router's listeners tunnels upgrade HTTP
+// requests on. Since tunnels then look like normal HTTP to what's in between,
+// this works through HTTP proxies and L7 load balancers.
+const TunnelUpgradePath = "/" + reservedRoute + "/tunnel"
+
+// reservedRoute is the route the router's own paths are under, which servers
+// can't use.
+const reservedRoute = ".gory-proxy"
+
+// upgradeProtocol is the Upgrade header of requests upgraded to the tunnel
+// protocol.
+const upgradeProtocol = TunnelALPN
+
+func (tc *TunnelConfig) validateTransport() error {
+	switch tc.Transport {
+	case "", TunnelTransportTCP, TunnelTransportUpgrade, TunnelTransportWebSocket:
+		return nil
+	}
+	return fmt.Errorf("unknown tunnel transport: %q", tc.Transport)
+}
+
+// overHTTP returns whether the tunnel's conns are upgraded HTTP requests.
+func (tc *TunnelConfig) overHTTP() bool {
+	return tc.Transport == TunnelTransportUpgrade || tc.Transport == TunnelTransportWebSocket
+}
+
+// dialAddr dials the tunneled-to proxy's address, through the HTTP proxy if
+// the config has one for it.
+func (tc *TunnelConfig) dialAddr() (net.Conn, error) {
+	var proxyURL *url.URL
+	if tc.Proxy != nil {
+		scheme := "http"
+		if tc.TLS != nil {
+			scheme = "https"
+		}
+		u, err := tc.Proxy(&http.Request{URL: &url.URL{Scheme: scheme, Host: tc.Addr}})
+		if err != nil {
+			return nil, fmt.Errorf("error getting tunnel proxy: %w", err)
+		}
+		proxyURL = u
+	}
+	if proxyURL == nil {
+		return net.Dial("tcp", tc.Addr)
+	}
+	return dialConnect(proxyURL, tc.Addr)
+}
+
+// dialConnect connects to addr through the HTTP proxy with a CONNECT request.
+func dialConnect(proxyURL *url.URL, addr string) (net.Conn, error) {
+	host := proxyURL.Host
+	if proxyURL.Port() == "" {
+		if proxyURL.Scheme == "https" {
+			host = net.JoinHostPort(proxyURL.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(proxyURL.Hostname(), "80")
+		}
+	}
+	var c net.Conn
+	var err error
+	switch proxyURL.Scheme {
+	case "http", "":
+		c, err = net.Dial("tcp", host)
+	case "https":
+		c, err = tls.Dial("tcp", host, &tls.Config{ServerName: proxyURL.Hostname()})
+	default:
+		return nil, fmt.Errorf("unsupported tunnel proxy scheme: %q", proxyURL.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(tunnelHandshakeTimeout))
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := proxyURL.User; u != nil {
+		pass, _ := u.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	bc := NewBufConn(c)
+	if err := req.Write(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	resp, err := http.ReadResponse(bc.r, req)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		c.Close()
+		return nil, fmt.Errorf("tunnel proxy refused connect: %s", resp.Status)
+	}
+	return bc, nil
+}
+
+// upgrade upgrades an HTTP request over the conn to the tunneled-to proxy's
+// TunnelUpgradePath, returning the conn the tunnel protocol is then sent over.
+func (tc *TunnelConfig) upgrade(c net.Conn) (net.Conn, error) {
+	scheme := "http"
+	if tc.TLS != nil {
+		scheme = "https"
+	}
+	if tc.Transport == TunnelTransportWebSocket {
+		wsScheme := strings.Replace(scheme, "http", "ws", 1)
+		cfg, err := websocket.NewConfig(
+			wsScheme+"://"+tc.Addr+TunnelUpgradePath, scheme+"://"+tc.Addr,
+		)
+		if err != nil {
+			return nil, err
+		}
+		ws, err := websocket.NewClient(cfg, c)
+		if err != nil {
+			return nil, fmt.Errorf("error upgrading tunnel to WebSocket: %w", err)
+		}
+		ws.PayloadType = websocket.BinaryFrame
+		return &upgradedConn{Conn: ws, raw: c}, nil
+	}
+	req, err := http.NewRequest(http.MethodGet, scheme+"://"+tc.Addr+TunnelUpgradePath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", upgradeProtocol)
+	if err := req.Write(c); err != nil {
+		return nil, err
+	}
+	bc := NewBufConn(c)
+	resp, err := http.ReadResponse(bc.r, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("tunneled-to server doesn't support tunnels over HTTP upgrade: %s", resp.Status)
+	}
+	return bc, nil
+}
+
+// serveTunnelUpgrade upgrades a request to TunnelUpgradePath to the tunnel
+// protocol, handling the conn like one that started with a tunnel header.
+func (router *Router) serveTunnelUpgrade(w RW, r Req) {
+	switch strings.ToLower(r.Header.Get("Upgrade")) {
+	case "websocket":
+		websocket.Server{
+			// Tunnels aren't browsers so there's no origin to check
+			Handshake: func(*websocket.Config, *http.Request) error { return nil },
+			Handler: func(ws *websocket.Conn) {
+				ws.PayloadType = websocket.BinaryFrame
+				raw, _ := r.Context().Value(connCtxKey{}).(net.Conn)
+				c := &upgradedConn{Conn: ws, raw: raw, done: make(chan struct{})}
+				router.handleUpgradedTunnel(NewBufConn(c))
+				// The conn is closed once this returns, so wait until it's
+				// done with or the client goes away
+				select {
+				case <-c.done:
+				case <-ws.Request().Context().Done():
+				}
+			},
+		}.ServeHTTP(w, r)
+	case upgradeProtocol:
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "can't upgrade connection", http.StatusInternalServerError)
+			return
+		}
+		c, rw, err := hj.Hijack()
+		if err != nil {
+			return
+		}
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+		rw.WriteString("Connection: Upgrade\r\nUpgrade: " + upgradeProtocol + "\r\n\r\n")
+		if err := rw.Flush(); err != nil {
+			c.Close()
+			return
+		}
+		router.handleUpgradedTunnel(BufConn{rw.Reader, c})
+	default:
+		w.Header().Set("Connection", "Upgrade")
+		w.Header().Set("Upgrade", upgradeProtocol)
+		http.Error(w, "tunnels must upgrade the connection", http.StatusUpgradeRequired)
+	}
+}
+
+// handleUpgradedTunnel handles an upgraded conn, which must start with a
+// tunnel header.
+func (router *Router) handleUpgradedTunnel(bc BufConn) {
+	// Clear the deadlines set by the http server
+	bc.SetDeadline(time.Time{})
+	bc.SetReadDeadline(time.Now().Add(time.Second * 30))
+	h, err := bc.Peek(4)
+	if err != nil || !isTunnelHeader(getHeader(h)) {
+		bc.Close()
+		return
+	}
+	router.handleTunnel(bc, getHeader(h))
+}
+
+// upgradedConn is a WebSocket used by a tunnel. Its addresses are those of the
+// underlying conn rather than the WebSocket's URLs.
+type upgradedConn struct {
+	net.Conn
+	raw net.Conn
+	// Closed once the conn is closed, if set
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *upgradedConn) LocalAddr() net.Addr {
+	if c.raw == nil {
+		return c.Conn.LocalAddr()
+	}
+	return c.raw.LocalAddr()
+}
+
+func (c *upgradedConn) RemoteAddr() net.Addr {
+	if c.raw == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.raw.RemoteAddr()
+}
+
+func (c *upgradedConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		if c.done != nil {
+			close(c.done)
+		}
+	})
+	return err
+}
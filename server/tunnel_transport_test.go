@@ -0,0 +1,171 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTunnelConfigValidateTransport(t *testing.T) {
+	tests := []struct {
+		transport string
+		err       bool
+	}{
+		{"", false},
+		{TunnelTransportTCP, false},
+		{TunnelTransportUpgrade, false},
+		{TunnelTransportWebSocket, false},
+		{"quic", true},
+	}
+	for _, test := range tests {
+		t.Run(test.transport, func(t *testing.T) {
+			tc := TunnelConfig{Transport: test.transport}
+			if err := tc.validateTransport(); (err != nil) != test.err {
+				t.Fatalf("got error %v", err)
+			}
+		})
+	}
+}
+
+// serveRouter serves the router's accepted conns until the test ends.
+func serveRouter(t *testing.T, router *Router) {
+	srv := &http.Server{Handler: router, ConnContext: router.ConnContext}
+	go srv.Serve(router)
+	t.Cleanup(func() {
+		router.Close()
+		srv.Close()
+	})
+}
+
+// connectProxy returns an HTTP proxy only handling CONNECT requests, counting
+// them.
+func connectProxy(t *testing.T, connects *int32) *httptest.Server {
+	ps := httptest.NewServer(http.HandlerFunc(func(w RW, r Req) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "only CONNECT", http.StatusMethodNotAllowed)
+			return
+		}
+		atomic.AddInt32(connects, 1)
+		dst, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		c, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			dst.Close()
+			return
+		}
+		io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go splice(c, dst)
+	}))
+	t.Cleanup(ps.Close)
+	return ps
+}
+
+func TestTunnelTransports(t *testing.T) {
+	tests := []struct {
+		name      string
+		transport string
+		proxy     bool
+	}{
+		{"tcp", TunnelTransportTCP, false},
+		{"upgrade", TunnelTransportUpgrade, false},
+		{"websocket", TunnelTransportWebSocket, false},
+		{"upgrade through proxy", TunnelTransportUpgrade, true},
+		{"websocket through proxy", TunnelTransportWebSocket, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			router, err := NewRouterWithListeners(ListenerConfig{Addr: "127.0.0.1:0"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			serveRouter(t, router)
+			addr := router.Listeners()[0].Addr().String()
+
+			var connects int32
+			tc := TunnelConfig{
+				Addr:      addr,
+				Transport: test.transport,
+				Handler: http.HandlerFunc(func(w RW, r Req) {
+					io.WriteString(w, "tunneled")
+				}),
+			}
+			if test.proxy {
+				proxyURL, _ := url.Parse(connectProxy(t, &connects).URL)
+				tc.Proxy = http.ProxyURL(proxyURL)
+			}
+			tunneled, err := NewTunneledRouterWithConfig(tc, &Server{Name: "app", Path: "app"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tunneled.Close()
+
+			resp, err := http.Get("http://" + addr + "/app/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || string(body) != "tunneled" {
+				t.Fatalf("got %d: %q", resp.StatusCode, body)
+			} else if test.proxy && atomic.LoadInt32(&connects) == 0 {
+				t.Fatal("tunnel didn't connect through the proxy")
+			}
+		})
+	}
+}
+
+func TestServeTunnelUpgradeRequired(t *testing.T) {
+	router, err := NewRouterWithListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+	w := httptest.NewRecorder()
+	router.serveTunnelUpgrade(w, httptest.NewRequest(http.MethodGet, TunnelUpgradePath, nil))
+	if w.Code != http.StatusUpgradeRequired {
+		t.Fatalf("got status %d", w.Code)
+	} else if got := w.Header().Get("Upgrade"); got != upgradeProtocol {
+		t.Fatalf("got Upgrade header %q", got)
+	}
+}
+
+func TestTunnelTransportsNoTunnels(t *testing.T) {
+	for _, transport := range []string{TunnelTransportTCP, TunnelTransportUpgrade, TunnelTransportWebSocket} {
+		t.Run(transport, func(t *testing.T) {
+			router, err := NewRouterWithListeners(ListenerConfig{Addr: "127.0.0.1:0", NoTunnels: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			serveRouter(t, router)
+			tc := TunnelConfig{
+				Addr:      router.Listeners()[0].Addr().String(),
+				Transport: transport,
+			}
+			if tunneled, err := NewTunneledRouterWithConfig(tc, &Server{Name: "app", Path: "app"}); err == nil {
+				tunneled.Close()
+				t.Fatal("tunnel connected over listener without tunnels")
+			}
+		})
+	}
+}
+
+func TestReservedPath(t *testing.T) {
+	for _, path := range []string{reservedRoute, reservedRoute + "/tunnel"} {
+		t.Run(path, func(t *testing.T) {
+			router := NewRouterHandler()
+			s := &Server{Name: "s", Path: path, Addr: "http://127.0.0.1:1"}
+			if err := s.AddTargetsProxy(); err != nil {
+				t.Fatal(err)
+			} else if err := router.AddServer(s); err != ErrReservedPath {
+				t.Fatalf("got error %v, want %v", err, ErrReservedPath)
+			}
+		})
+	}
+}
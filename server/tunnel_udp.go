@@ -0,0 +1,442 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrTunnelUDPUnsupported = fmt.Errorf("tunneled-to server doesn't support UDP tunnel services")
+	errTunnelUDPDisabled    = fmt.Errorf("UDP tunnel services aren't allowed")
+)
+
+const (
+	// Max length of the path of a UDP service, since it's sent with each
+	// datagram
+	maxUDPServicePath = 255
+	// Max size of a datagram relayed through a tunnel. Larger ones are dropped.
+	maxTunnelDatagram = muxMaxPayload - 1 - maxUDPServicePath
+	// Time a tunnel keeps a flow to a UDP service's target without datagrams
+	// if the tunneled-to server doesn't say
+	tunnelUDPIdleTimeout = time.Minute
+)
+
+// TunnelUDP configures the UDP services tunnels can expose through a router.
+// Each gets its own port and datagrams from each client address are relayed
+// as a separate flow, which expires once idle.
+type TunnelUDP struct {
+	// Host is the host ports are opened on. Defaults to all interfaces.
+	Host string `json:"host,omitempty"`
+	// MinPort and MaxPort are the range ports are allocated from. Tunnels can
+	// only request a port in the range. If not set, a random port is
+	// allocated and the port requested is ignored.
+	MinPort int `json:"minPort,omitempty"`
+	MaxPort int `json:"maxPort,omitempty"`
+	// IdleTimeout is how long a client's flow is kept without datagrams.
+	// Defaults to 1m.
+	IdleTimeout Duration `json:"idleTimeout,omitempty"`
+}
+
+func (tu *TunnelUDP) validate() error {
+	if tu.IdleTimeout < 0 {
+		return fmt.Errorf("UDP tunnel idle timeout can't be negative")
+	}
+	return validatePortRange("UDP", tu.MinPort, tu.MaxPort)
+}
+
+func (tu *TunnelUDP) idleTimeout() time.Duration {
+	return tu.IdleTimeout.Or(time.Minute)
+}
+
+// listen opens the port for a service. The first free one in the range is
+// used if port is 0.
+func (tu *TunnelUDP) listen(port int) (net.PacketConn, error) {
+	return listenPort(tu.Host, tu.MinPort, tu.MaxPort, port, func(addr string) (net.PacketConn, error) {
+		return net.ListenPacket("udp", addr)
+	})
+}
+
+// SetTunnelUDP allows tunnels to expose UDP services with the config. If nil,
+// UDP services can't be registered. Services already registered aren't
+// affected.
+func (router *Router) SetTunnelUDP(tu *TunnelUDP) error {
+	if tu != nil {
+		if err := tu.validate(); err != nil {
+			return err
+		}
+	}
+	router.tunnelUDP.Store(tu)
+	return nil
+}
+
+// tunnelUDP is sent with the register message of a UDP service.
+type tunnelUDP struct {
+	// Port requested, any free one if 0
+	Port int `json:"port,omitempty"`
+}
+
+// encodeDatagram returns the payload of a datagram frame for the service.
+func encodeDatagram(path string, data []byte) []byte {
+	buf := make([]byte, 1+len(path)+len(data))
+	buf[0] = byte(len(path))
+	copy(buf[1:], path)
+	copy(buf[1+len(path):], data)
+	return buf
+}
+
+// decodeDatagram returns the path of the service and the datagram in the
+// payload of a datagram frame.
+func decodeDatagram(payload []byte) (string, []byte, bool) {
+	if len(payload) == 0 || len(payload) < 1+int(payload[0]) {
+		return "", nil, false
+	}
+	n := 1 + int(payload[0])
+	return string(payload[1:n]), payload[n:], true
+}
+
+// UDPServiceStatus is a snapshot of a UDP service registered by a tunnel.
+type UDPServiceStatus struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	Port int    `json:"port"`
+	// Tunnel is the path of the server of the tunnel that registered it
+	Tunnel string `json:"tunnel"`
+	// ActiveFlows is the number of client addresses with a flow that hasn't
+	// expired
+	ActiveFlows int `json:"activeFlows"`
+}
+
+// udpService is a UDP service registered by a tunnel.
+type udpService struct {
+	name, path, tunnel string
+	port               int
+	idle               time.Duration
+
+	pc        net.PacketConn
+	mux       *muxSession
+	closeOnce sync.Once
+	done      chan struct{}
+
+	mtx sync.Mutex
+	// Flows by client address and by ID
+	flows  map[string]*udpFlow
+	byID   map[uint32]*udpFlow
+	nextID uint32
+}
+
+// udpFlow is the datagrams exchanged with a client address.
+type udpFlow struct {
+	id   uint32
+	addr net.Addr
+	// Guarded by the service's mutex
+	last time.Time
+}
+
+// registerUDPService registers a UDP service for the tunnel of the server,
+// returning the port allocated to it.
+func (router *Router) registerUDPService(s *Server, name, path string, req tunnelUDP) (*udpService, error) {
+	tu := router.tunnelUDP.Load()
+	if tu == nil {
+		return nil, errTunnelUDPDisabled
+	} else if len(path) > maxUDPServicePath {
+		return nil, fmt.Errorf("UDP tunnel service path too long")
+	}
+	svc := &udpService{
+		name:   name,
+		path:   path,
+		tunnel: s.Path,
+		idle:   tu.idleTimeout(),
+		mux:    s.tunnelMux,
+		done:   make(chan struct{}),
+		flows:  make(map[string]*udpFlow),
+		byID:   make(map[uint32]*udpFlow),
+	}
+	if _, loaded := router.udpServices.LoadOrStore(path, svc); loaded {
+		return nil, errTunnelExists
+	}
+	pc, err := tu.listen(req.Port)
+	if err != nil {
+		router.udpServices.Delete(path)
+		return nil, err
+	}
+	svc.pc = pc
+	svc.port = pc.LocalAddr().(*net.UDPAddr).Port
+	go svc.readClients()
+	go svc.expireFlows()
+	go func() {
+		<-svc.mux.Done()
+		router.removeUDPService(svc)
+	}()
+	return svc, nil
+}
+
+// removeUDPService closes the service's port and removes it.
+func (router *Router) removeUDPService(svc *udpService) {
+	svc.closeOnce.Do(func() {
+		if cur, ok := router.udpServices.Load(svc.path); ok && cur == svc {
+			router.udpServices.Delete(svc.path)
+		}
+		svc.pc.Close()
+		close(svc.done)
+		Logger.Printf("removed UDP tunnel service %s", svc.path)
+	})
+}
+
+// removeTunnelUDPServices removes the UDP services registered over the
+// session.
+func (router *Router) removeTunnelUDPServices(ms *muxSession) {
+	router.udpServices.Range(func(_ string, svc *udpService) bool {
+		if svc.mux == ms {
+			router.removeUDPService(svc)
+		}
+		return true
+	})
+}
+
+// readClients sends the datagrams received on the service's port through the
+// tunnel until the port is closed.
+func (svc *udpService) readClients() {
+	buf := make([]byte, 1<<16)
+	for {
+		n, addr, err := svc.pc.ReadFrom(buf)
+		if err != nil {
+			return
+		} else if n > maxTunnelDatagram {
+			continue
+		}
+		flow := svc.flow(addr)
+		// The frame is a copy so buf can be reused
+		if err := svc.mux.writeFrame(frameDatagram, flow.id, encodeDatagram(svc.path, buf[:n])); err != nil {
+			return
+		}
+	}
+}
+
+// flow returns the flow of the client address, starting one if needed.
+func (svc *udpService) flow(addr net.Addr) *udpFlow {
+	key := addr.String()
+	svc.mtx.Lock()
+	defer svc.mtx.Unlock()
+	flow, ok := svc.flows[key]
+	if !ok {
+		svc.nextID++
+		flow = &udpFlow{id: svc.nextID, addr: addr}
+		svc.flows[key] = flow
+		svc.byID[flow.id] = flow
+	}
+	flow.last = time.Now()
+	return flow
+}
+
+// reply sends a datagram sent back through the tunnel to the client of the
+// flow. It's dropped if the flow has expired.
+func (svc *udpService) reply(id uint32, data []byte) {
+	svc.mtx.Lock()
+	flow, ok := svc.byID[id]
+	if ok {
+		flow.last = time.Now()
+	}
+	svc.mtx.Unlock()
+	if ok {
+		svc.pc.WriteTo(data, flow.addr)
+	}
+}
+
+// expireFlows removes the flows that have been idle for too long until the
+// service is removed.
+func (svc *udpService) expireFlows() {
+	interval := svc.idle / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-svc.done:
+			return
+		}
+		svc.mtx.Lock()
+		for key, flow := range svc.flows {
+			if time.Since(flow.last) > svc.idle {
+				delete(svc.flows, key)
+				delete(svc.byID, flow.id)
+			}
+		}
+		svc.mtx.Unlock()
+	}
+}
+
+// serveTunnelDatagrams passes the datagrams sent by the tunnel of the server
+// to the clients of its UDP services until its session is closed.
+func (router *Router) serveTunnelDatagrams(s *Server) {
+	ms := s.tunnelMux
+	for {
+		var dg muxDatagram
+		select {
+		case dg = <-ms.Datagrams():
+		case <-ms.Done():
+			return
+		}
+		path, data, ok := decodeDatagram(dg.payload)
+		if !ok {
+			continue
+		}
+		if svc, ok := router.udpServices.Load(path); ok && svc.mux == ms {
+			svc.reply(dg.flow, data)
+		}
+	}
+}
+
+// UDPServices returns the UDP services registered by tunnels.
+func (router *Router) UDPServices() []UDPServiceStatus {
+	var services []UDPServiceStatus
+	router.udpServices.Range(func(_ string, svc *udpService) bool {
+		svc.mtx.Lock()
+		flows := len(svc.flows)
+		svc.mtx.Unlock()
+		services = append(services, UDPServiceStatus{
+			Name:        svc.name,
+			Path:        svc.path,
+			Port:        svc.port,
+			Tunnel:      svc.tunnel,
+			ActiveFlows: flows,
+		})
+		return true
+	})
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Path < services[j].Path
+	})
+	return services
+}
+
+// tunnelUDPFlows are the flows of the tunnel's UDP services to their targets,
+// by service path and flow ID.
+type tunnelUDPFlows struct {
+	ms    *muxSession
+	mtx   sync.Mutex
+	flows map[tunnelUDPFlowKey]*tunnelUDPFlow
+}
+
+type tunnelUDPFlowKey struct {
+	path string
+	id   uint32
+}
+
+type tunnelUDPFlow struct {
+	conn net.Conn
+	// How long the flow is kept without datagrams
+	timeout time.Duration
+	// Unix nanos of the last datagram either way
+	last int64
+}
+
+func (f *tunnelUDPFlow) touch() {
+	atomic.StoreInt64(&f.last, time.Now().UnixNano())
+}
+
+func (f *tunnelUDPFlow) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&f.last)))
+}
+
+// serveServiceDatagrams relays the datagrams sent by the tunneled-to server
+// to the targets of the tunnel's UDP services until the session is closed.
+func (router *Router) serveServiceDatagrams(ms *muxSession) {
+	flows := &tunnelUDPFlows{ms: ms, flows: make(map[tunnelUDPFlowKey]*tunnelUDPFlow)}
+	defer flows.closeAll()
+	for {
+		var dg muxDatagram
+		select {
+		case dg = <-ms.Datagrams():
+		case <-ms.Done():
+			return
+		}
+		path, data, ok := decodeDatagram(dg.payload)
+		if !ok {
+			continue
+		}
+		svc, ok := router.tunnelServices.Load(path)
+		if !ok || !svc.cfg.isUDP() {
+			continue
+		}
+		flow, err := flows.get(tunnelUDPFlowKey{path, dg.flow}, svc)
+		if err != nil {
+			Logger.Printf("error dialing UDP tunnel service target %s: %v", svc.cfg.Target, err)
+			continue
+		}
+		flow.touch()
+		flow.conn.Write(data)
+	}
+}
+
+// get returns the flow with the key, dialing the service's target if there's
+// none.
+func (flows *tunnelUDPFlows) get(key tunnelUDPFlowKey, svc *tunnelService) (*tunnelUDPFlow, error) {
+	flows.mtx.Lock()
+	flow, ok := flows.flows[key]
+	flows.mtx.Unlock()
+	if ok {
+		return flow, nil
+	}
+	// Dialing resolves the target, so don't hold up the other flows
+	c, err := net.Dial("udp", svc.cfg.Target)
+	if err != nil {
+		return nil, err
+	}
+	flows.mtx.Lock()
+	defer flows.mtx.Unlock()
+	if flow, ok := flows.flows[key]; ok {
+		// Another datagram of the flow got here first
+		c.Close()
+		return flow, nil
+	}
+	flow = &tunnelUDPFlow{conn: c, timeout: svc.udpIdleTimeout()}
+	flow.touch()
+	flows.flows[key] = flow
+	go flows.relay(key, flow)
+	return flow, nil
+}
+
+// relay sends the datagrams from the target back through the tunnel until the
+// flow is idle for too long.
+func (flows *tunnelUDPFlows) relay(key tunnelUDPFlowKey, flow *tunnelUDPFlow) {
+	defer func() {
+		flows.mtx.Lock()
+		if flows.flows[key] == flow {
+			delete(flows.flows, key)
+		}
+		flows.mtx.Unlock()
+		flow.conn.Close()
+	}()
+	buf := make([]byte, 1<<16)
+	for {
+		flow.conn.SetReadDeadline(time.Now().Add(flow.timeout - flow.idle()))
+		n, err := flow.conn.Read(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && flow.idle() < flow.timeout {
+				continue
+			}
+			return
+		} else if n > maxTunnelDatagram {
+			continue
+		}
+		flow.touch()
+		if err := flows.ms.writeFrame(frameDatagram, key.id, encodeDatagram(key.path, buf[:n])); err != nil {
+			return
+		}
+	}
+}
+
+// closeAll closes the flows once the session is closed.
+func (flows *tunnelUDPFlows) closeAll() {
+	flows.mtx.Lock()
+	defer flows.mtx.Unlock()
+	for _, flow := range flows.flows {
+		flow.conn.Close()
+	}
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDatagramRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		data []byte
+	}{
+		{"path and data", "dns", []byte("query")},
+		{"empty path", "", []byte("query")},
+		{"empty data", "dns", nil},
+		{"longest path", strings.Repeat("p", 255), []byte{0, 1, 2}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path, data, ok := decodeDatagram(encodeDatagram(test.path, test.data))
+			if !ok {
+				t.Fatal("couldn't decode encoded datagram")
+			} else if path != test.path || !bytes.Equal(data, test.data) {
+				t.Fatalf("got %q with %q, want %q with %q", path, data, test.path, test.data)
+			}
+		})
+	}
+}
+
+func TestDecodeDatagramMalformed(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"empty", nil},
+		{"path longer than payload", []byte{4, 'd', 'n', 's'}},
+		{"only length", []byte{1}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if path, data, ok := decodeDatagram(test.payload); ok {
+				t.Fatalf("decoded %q with %q", path, data)
+			}
+		})
+	}
+}